@@ -0,0 +1,218 @@
+package CSRF
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Mode int
+
+const (
+	// checks Origin/Referer and the double submit token (default)
+	TokenMode Mode = iota
+	// only checks Origin/Referer, for SPAs that can not send the token
+	OriginMode
+	// no checks at all
+	Off
+)
+
+// the __Host- prefix makes browsers refuse the cookie if it is not Secure,
+// for the whole host and without Domain, so subdomains can not overwrite it
+const (
+	CookieName = "__Host-csrf_token"
+	HeaderName = "X-CSRF-Token"
+	FormField  = "csrf_token"
+)
+
+// Service checks the requests of one server, Tokenize builds one in Initialize
+type Service struct {
+	sync.RWMutex
+	mode Mode
+	// the origin of the app, it is always trusted
+	domain         string
+	trustedOrigins []string
+	exempt         map[string]bool
+}
+
+// New returns a Service in TokenMode that trusts domain (like
+// "https://example.com"), Init reads the env variables that change it
+func New(domain string) *Service {
+	return &Service{
+		mode:   TokenMode,
+		domain: strings.TrimSuffix(strings.TrimSpace(domain), "/"),
+		exempt: make(map[string]bool),
+	}
+}
+
+func (svc *Service) SetMode(mode Mode) {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.mode = mode
+}
+
+// origins (like "https://app.example.com") allowed to send requests besides
+// the domain, for frontends served from another origin
+func (svc *Service) SetTrustedOrigins(origins []string) {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.trustedOrigins = nil
+	for _, origin := range origins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			svc.trustedOrigins = append(svc.trustedOrigins, origin)
+		}
+	}
+}
+
+// paths that are never checked, like webhooks authenticated by a signature
+func (svc *Service) Exempt(paths ...string) {
+	svc.Lock()
+	defer svc.Unlock()
+	for _, path := range paths {
+		svc.exempt[path] = true
+	}
+}
+
+// CSRF_MODE=origin only checks Origin/Referer, CSRF_MODE=off disables the
+// checks. CSRF_TRUSTED_ORIGINS is a comma separated list of extra origins.
+func (svc *Service) Init() {
+	switch os.Getenv("CSRF_MODE") {
+	case "", "token":
+		svc.SetMode(TokenMode)
+	case "origin":
+		svc.SetMode(OriginMode)
+	case "off":
+		svc.SetMode(Off)
+	default:
+		log.Fatal("Invalid CSRF_MODE, use token, origin or off")
+	}
+
+	svc.SetTrustedOrigins(strings.Split(os.Getenv("CSRF_TRUSTED_ORIGINS"), ","))
+}
+
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Token returns the CSRF token of the browser, it sets the cookie if the
+// browser does not have one yet. Frontends send it back in the X-CSRF-Token
+// header or in the csrf_token field of a form.
+func Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(CookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	// not HttpOnly so frontends on this origin can also read it
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS" || method == "TRACE"
+}
+
+func (svc *Service) isTrustedOrigin(origin string) bool {
+	svc.RLock()
+	defer svc.RUnlock()
+	if svc.domain != "" && origin == svc.domain {
+		return true
+	}
+	for _, trusted := range svc.trustedOrigins {
+		if origin == trusted {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the origin of the request from Origin or, when the browser did not
+// send it, from Referer. An Origin of "null" is returned as is and is never
+// trusted.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		parsed, err := url.Parse(referer)
+		if err != nil || parsed.Host == "" {
+			return "invalid"
+		}
+		return parsed.Scheme + "://" + parsed.Host
+	}
+	return ""
+}
+
+// Check returns false if the request may be a cross site request forgery
+func (svc *Service) Check(r *http.Request) bool {
+	svc.RLock()
+	mode := svc.mode
+	exempt := svc.exempt[r.URL.Path]
+	svc.RUnlock()
+
+	if mode == Off || exempt || isSafeMethod(r.Method) {
+		return true
+	}
+	// requests authenticated with a header do not use the cookies of the
+	// browser, so they can not be forged
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	origin := requestOrigin(r)
+	if origin != "" && !svc.isTrustedOrigin(origin) {
+		return false
+	}
+	if mode == OriginMode {
+		return true
+	}
+
+	// clients that are not browsers (no Origin/Referer) and have no session
+	// cookie, like scripts calling /login-user, have nothing to forge
+	if origin == "" {
+		if _, err := r.Cookie("token"); err != nil {
+			return true
+		}
+	}
+
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	sent := r.Header.Get(HeaderName)
+	if sent == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		sent = r.PostFormValue(FormField)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) == 1
+}
+
+// Protect rejects the mutating requests that fail Check with 403
+func (svc *Service) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !svc.Check(r) {
+			http.Error(w, "Invalid CSRF token or origin", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,176 @@
+package CSRF
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testOrigin = "https://tokenize.test"
+
+func setupCSRFTest(mode Mode) *Service {
+	svc := New(testOrigin + "/")
+	svc.SetMode(mode)
+	svc.SetTrustedOrigins([]string{"https://app.tokenize.test/"})
+	return svc
+}
+
+type csrfRequest struct {
+	method      string
+	path        string
+	origin      string
+	referer     string
+	auth        string
+	session     bool
+	csrfCookie  string
+	csrfHeader  string
+	form        string
+	contentType string
+}
+
+func (c csrfRequest) build() *http.Request {
+	method := c.method
+	if method == "" {
+		method = "POST"
+	}
+	path := c.path
+	if path == "" {
+		path = "/change-password"
+	}
+
+	var r *http.Request
+	if c.form != "" {
+		r = httptest.NewRequest(method, path, strings.NewReader(url.Values{FormField: {c.form}}.Encode()))
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	if c.contentType != "" {
+		r.Header.Set("Content-Type", c.contentType)
+	}
+	if c.origin != "" {
+		r.Header.Set("Origin", c.origin)
+	}
+	if c.referer != "" {
+		r.Header.Set("Referer", c.referer)
+	}
+	if c.auth != "" {
+		r.Header.Set("Authorization", c.auth)
+	}
+	if c.session {
+		r.AddCookie(&http.Cookie{Name: "token", Value: "session"})
+	}
+	if c.csrfCookie != "" {
+		r.AddCookie(&http.Cookie{Name: CookieName, Value: c.csrfCookie})
+	}
+	if c.csrfHeader != "" {
+		r.Header.Set(HeaderName, c.csrfHeader)
+	}
+	return r
+}
+
+func TestCheckTokenMode(t *testing.T) {
+	svc := setupCSRFTest(TokenMode)
+	form := "application/x-www-form-urlencoded"
+
+	tests := []struct {
+		name string
+		req  csrfRequest
+		ok   bool
+	}{
+		{"safe method", csrfRequest{method: "GET", origin: "https://evil.test", session: true}, true},
+		{"header token", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", csrfHeader: "abc"}, true},
+		{"trusted origin without slash", csrfRequest{origin: "https://app.tokenize.test", session: true, csrfCookie: "abc", csrfHeader: "abc"}, true},
+		{"wrong token", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", csrfHeader: "abd"}, false},
+		{"no token", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc"}, false},
+		{"no cookie", csrfRequest{origin: testOrigin, session: true, csrfHeader: "abc"}, false},
+		{"untrusted origin", csrfRequest{origin: "https://evil.test", session: true, csrfCookie: "abc", csrfHeader: "abc"}, false},
+		{"null origin", csrfRequest{origin: "null", session: true, csrfCookie: "abc", csrfHeader: "abc"}, false},
+		{"referer", csrfRequest{referer: testOrigin + "/settings", session: true, csrfCookie: "abc", csrfHeader: "abc"}, true},
+		{"untrusted referer", csrfRequest{referer: "https://evil.test/page", session: true, csrfCookie: "abc", csrfHeader: "abc"}, false},
+		{"invalid referer", csrfRequest{referer: "not a url", session: true, csrfCookie: "abc", csrfHeader: "abc"}, false},
+
+		// requests with an Authorization header do not use the cookies
+		{"authorization header", csrfRequest{origin: "https://evil.test", auth: "Bearer token"}, true},
+		{"authorization header with cookies", csrfRequest{auth: "Bearer token", session: true}, true},
+
+		// clients that are not browsers and have no session have nothing to forge
+		{"no origin and no session", csrfRequest{}, true},
+		{"no origin with a session", csrfRequest{session: true}, false},
+		{"no origin with a session and token", csrfRequest{session: true, csrfCookie: "abc", csrfHeader: "abc"}, true},
+
+		// forms can send the token in a field instead of the header
+		{"form field", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", form: "abc", contentType: form}, true},
+		{"wrong form field", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", form: "abd", contentType: form}, false},
+		{"form field of another content type", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", form: "abc", contentType: "multipart/form-data"}, false},
+		{"header wins over the form field", csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", csrfHeader: "abd", form: "abc", contentType: form}, false},
+	}
+	for _, test := range tests {
+		if ok := svc.Check(test.req.build()); ok != test.ok {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestCheckOtherModes(t *testing.T) {
+	svc := setupCSRFTest(OriginMode)
+	if !svc.Check(csrfRequest{origin: testOrigin, session: true}.build()) {
+		t.Error("origin mode asked for a token")
+	}
+	if svc.Check(csrfRequest{origin: "https://evil.test", session: true}.build()) {
+		t.Error("origin mode accepted an untrusted origin")
+	}
+
+	svc.SetMode(Off)
+	if !svc.Check(csrfRequest{origin: "https://evil.test", session: true}.build()) {
+		t.Error("checks were not turned off")
+	}
+
+	svc.SetMode(TokenMode)
+	svc.Exempt("/webhook")
+	if !svc.Check(csrfRequest{path: "/webhook", origin: "https://evil.test", session: true}.build()) {
+		t.Error("exempt path was checked")
+	}
+
+	// every server keeps its own configuration
+	if New(testOrigin).Check(csrfRequest{path: "/webhook", origin: "https://evil.test", session: true}.build()) {
+		t.Error("the exempt path of another server was not checked")
+	}
+}
+
+func TestTokenCookie(t *testing.T) {
+	w := httptest.NewRecorder()
+	token, err := Token(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil || token == "" {
+		t.Fatalf("no token: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CookieName || cookies[0].Value != token || !cookies[0].Secure || cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookie %+v", cookies)
+	}
+
+	// the browser keeps its token
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+	w = httptest.NewRecorder()
+	if again, err := Token(w, r); err != nil || again != token || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("token changed: %q %v", again, err)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	svc := setupCSRFTest(TokenMode)
+	handler := svc.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, csrfRequest{origin: "https://evil.test", session: true}.build())
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("forged request got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, csrfRequest{origin: testOrigin, session: true, csrfCookie: "abc", csrfHeader: "abc"}.build())
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid request got %d", w.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package Login
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// every API key starts with this so it is never mistaken for a session token
+const apiKeyPrefix = "tkz_"
+
+// CreateAPIKey creates a long lived key for scripts and integrations, the key
+// is only returned here since just its hash is saved. The key can only use the
+// given permissions, which the user must have. A zero expires never expires.
+func (svc *Service) CreateAPIKey(userID int, name string, expires time.Time, permissionIDs []int) (string, database.APIKey, error) {
+	if name == "" {
+		return "", database.APIKey{}, fmt.Errorf("api key name is empty")
+	}
+	if !expires.IsZero() && expires.Before(time.Now()) {
+		return "", database.APIKey{}, fmt.Errorf("api key expiration is in the past")
+	}
+
+	for _, permissionID := range permissionIDs {
+		if !svc.store.CheckUserPermission(userID, permissionID) {
+			return "", database.APIKey{}, fmt.Errorf("user %d does not have permission %d", userID, permissionID)
+		}
+	}
+
+	secret, err := generateSecureToken(48)
+	if err != nil {
+		return "", database.APIKey{}, err
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := database.APIKey{
+		UserID:  userID,
+		Name:    name,
+		Prefix:  key[:len(apiKeyPrefix)+8],
+		KeyHash: hashToken(key),
+		Created: time.Now().Unix(),
+	}
+	if !expires.IsZero() {
+		apiKey.Expires = expires.Unix()
+	}
+
+	id, err := svc.store.AddAPIKey(apiKey, permissionIDs)
+	if err != nil {
+		return "", database.APIKey{}, err
+	}
+	apiKey.ID = int(id)
+	return key, apiKey, nil
+}
+
+func (svc *Service) ListAPIKeys(userID int) ([]database.APIKey, error) {
+	return svc.store.GetUserAPIKeys(userID)
+}
+
+func (svc *Service) RevokeAPIKey(userID int, apiKeyID int) error {
+	revoked, err := svc.store.RevokeAPIKey(userID, apiKeyID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return fmt.Errorf("api key %d not found", apiKeyID)
+	}
+	return nil
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func (svc *Service) verifyAPIKey(key string) (Login, bool) {
+	apiKey, err := svc.store.GetAPIKeyByHash(hashToken(key))
+	if err != nil || apiKey.Revoked {
+		return Login{}, false
+	}
+
+	now := time.Now()
+	if apiKey.Expires != 0 && now.Unix() >= apiKey.Expires {
+		return Login{}, false
+	}
+
+	if now.Sub(time.Unix(apiKey.LastUsed, 0)) >= touchInterval {
+		svc.store.TouchAPIKey(apiKey.ID, now.Unix())
+	}
+
+	return Login{
+		UserID:   apiKey.UserID,
+		Token:    key,
+		Created:  apiKey.Created,
+		LastSeen: now.Unix(),
+		Expires:  apiKey.Expires,
+		APIKeyID: apiKey.ID,
+	}, true
+}
+
+// HasPermission checks a permission for the user of the request, requests
+// made with an API key are limited to the scope of the key
+func (svc *Service) HasPermission(r *http.Request, requiredPermission string) bool {
+	login, ok := svc.authenticate(r)
+	if !ok {
+		return false
+	}
+	return svc.permissions.HasPermission(login.Subject(), requiredPermission)
+}
@@ -0,0 +1,73 @@
+package Login
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Permissions"
+)
+
+func addTestPermission(t *testing.T, svc *Service, userID int, name, permission string) int {
+	if err := svc.store.CreateNewPermission(name, permission); err != nil {
+		t.Fatal(err)
+	}
+	perm, err := svc.store.GetPermissionWithPermission(permission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.store.AddUserPermission(userID, perm.ID); err != nil {
+		t.Fatal(err)
+	}
+	return perm.ID
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	svc, userID := setupTest(t)
+	readID := addTestPermission(t, svc, userID, "Read", "read:things")
+	addTestPermission(t, svc, userID, "Write", "write:things")
+
+	key, apiKey, err := svc.CreateAPIKey(userID, "script", time.Time{}, []int{readID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+key)
+
+	if !svc.HasPermission(r, "read:things") {
+		t.Fatal("key can not use a permission in its scope")
+	}
+	if svc.HasPermission(r, "write:things") {
+		t.Fatal("key used a permission of its owner outside its scope")
+	}
+
+	// the permissions service also checks the scope for the login of a key
+	login, ok := svc.authenticate(r)
+	if !ok || login.APIKeyID != apiKey.ID {
+		t.Fatalf("key did not authenticate: %+v", login)
+	}
+	if svc.permissions.HasPermission(login.Subject(), "write:things") {
+		t.Fatal("subject of the key skipped its scope")
+	}
+	if !svc.permissions.HasPermission(Permissions.Subject{UserID: userID}, "write:things") {
+		t.Fatal("user lost a permission")
+	}
+	otherUser := Permissions.Subject{UserID: userID + 1, APIKeyID: apiKey.ID}
+	if svc.permissions.HasPermission(otherUser, "read:things") {
+		t.Fatal("key was used for another user")
+	}
+
+	// the owner losing the permission also takes it from the key
+	svc.store.RemoveUserPermission(userID, readID)
+	if svc.HasPermission(r, "read:things") {
+		t.Fatal("key kept a permission its owner lost")
+	}
+	svc.store.AddUserPermission(userID, readID)
+
+	if err := svc.RevokeAPIKey(userID, apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	if svc.HasPermission(r, "read:things") || svc.permissions.HasPermission(login.Subject(), "read:things") {
+		t.Fatal("revoked key kept its permissions")
+	}
+}
@@ -0,0 +1,547 @@
+package Login
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	functions "github.com/Maruqes/Tokenize/Functions"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// OAuthError is an error of the authorization server, Code is the OAuth2
+// error code sent to the client
+type OAuthError struct {
+	Code        string
+	Description string
+	err         error
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func (e *OAuthError) Unwrap() error {
+	return e.err
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+var ErrInvalidConsent = errors.New("invalid or expired consent request")
+
+// users that can not log in can not use their grants either, the error keeps
+// ErrUserProhibited or ErrEmailNotVerified for errors.Is
+func (svc *Service) checkOAuthUser(usr database.User, code string) error {
+	err := svc.checkEmailVerified(usr)
+	if usr.IsProhibited {
+		err = ErrUserProhibited
+	}
+	if err != nil {
+		return &OAuthError{Code: code, Description: err.Error(), err: err}
+	}
+	return nil
+}
+
+// the scopes a client can ask for, "openid" is always required
+var supportedScopes = []string{"openid", "profile", "email", "permissions"}
+
+const (
+	authorizationCodeTimeout = time.Minute
+	consentTimeout           = 10 * time.Minute
+)
+
+// the issuer of the authorization server, OAUTH_ISSUER defaults to DOMAIN
+func (svc *Service) oauthIssuer() string {
+	issuer := svc.oauthIssuerURL
+	if issuer == "" {
+		issuer = svc.domain
+	}
+	return strings.TrimSuffix(issuer, "/")
+}
+
+// OIDCConfiguration is the discovery document of the authorization server
+type OIDCConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func (svc *Service) GetOIDCConfiguration() OIDCConfiguration {
+	issuer := svc.oauthIssuer()
+	return OIDCConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserinfoEndpoint:                  issuer + "/oauth/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   supportedScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "email", "email_verified", "name", "is_active", "permissions"},
+	}
+}
+
+// RegisterOAuthClient adds an app that can log in with Tokenize. Confidential
+// clients (apps with a backend) get a secret, it is only returned here.
+// Public clients (single page and mobile apps) have none and rely on PKCE.
+func (svc *Service) RegisterOAuthClient(name string, redirectURIs []string, confidential bool) (database.OAuthClient, string, error) {
+	if name == "" || len(redirectURIs) == 0 {
+		return database.OAuthClient{}, "", fmt.Errorf("client needs a name and at least one redirect URI")
+	}
+	for _, uri := range redirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.ContainsAny(uri, " \t\n") {
+			return database.OAuthClient{}, "", fmt.Errorf("invalid redirect URI %s", uri)
+		}
+	}
+
+	client := database.OAuthClient{
+		ID:           functions.GenerateUUID(),
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Created:      time.Now().Unix(),
+	}
+	var secret string
+	if confidential {
+		var err error
+		secret, err = generateSecureToken(48)
+		if err != nil {
+			return database.OAuthClient{}, "", err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	if err := svc.store.AddOAuthClient(client); err != nil {
+		return database.OAuthClient{}, "", err
+	}
+	return client, secret, nil
+}
+
+func (svc *Service) ListOAuthClients() ([]database.OAuthClient, error) {
+	return svc.store.GetOAuthClients()
+}
+
+func (svc *Service) DeleteOAuthClient(clientID string) error {
+	return svc.store.DeleteOAuthClient(clientID)
+}
+
+// removes the consent a user gave to a client, it asks again on the next login
+func (svc *Service) RevokeOAuthConsent(userID int, clientID string) error {
+	return svc.store.DeleteOAuthConsent(userID, clientID)
+}
+
+// AuthorizeRequest is a validated request to /oauth/authorize
+type AuthorizeRequest struct {
+	ClientID      string
+	ClientName    string
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	// prompt=consent asks for consent even if the user already gave it
+	ForceConsent bool
+}
+
+// the URL the user is sent back to with the result of the request
+func (req AuthorizeRequest) redirect(values url.Values) string {
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+	separator := "?"
+	if strings.Contains(req.RedirectURI, "?") {
+		separator = "&"
+	}
+	return req.RedirectURI + separator + values.Encode()
+}
+
+// ErrorRedirect returns the redirect URL that reports an OAuth error to the client
+func (req AuthorizeRequest) ErrorRedirect(err *OAuthError) string {
+	return req.redirect(url.Values{"error": {err.Code}, "error_description": {err.Description}})
+}
+
+// ParseAuthorizeRequest validates the parameters of /oauth/authorize. When the
+// client or the redirect URI are invalid the user must not be redirected, so
+// the returned bool is false. Otherwise the error can be sent to the client
+// with ErrorRedirect.
+func (svc *Service) ParseAuthorizeRequest(query url.Values) (AuthorizeRequest, bool, error) {
+	req := AuthorizeRequest{
+		ClientID:      query.Get("client_id"),
+		RedirectURI:   query.Get("redirect_uri"),
+		State:         query.Get("state"),
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: query.Get("code_challenge"),
+		ForceConsent:  query.Get("prompt") == "consent",
+	}
+
+	client, err := svc.store.GetOAuthClient(req.ClientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return req, false, oauthError("invalid_client", "unknown client")
+	}
+	if err != nil {
+		return req, false, err
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return req, false, oauthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+	req.ClientName = client.Name
+
+	if query.Get("response_type") != "code" {
+		return req, true, oauthError("unsupported_response_type", "only the code response type is supported")
+	}
+	if req.CodeChallenge == "" || query.Get("code_challenge_method") != "S256" {
+		return req, true, oauthError("invalid_request", "PKCE with code_challenge_method S256 is required")
+	}
+	if query.Get("prompt") == "none" {
+		return req, true, oauthError("interaction_required", "prompt=none is not supported")
+	}
+
+	for _, scope := range strings.Fields(query.Get("scope")) {
+		if slices.Contains(supportedScopes, scope) && !slices.Contains(req.Scopes, scope) {
+			req.Scopes = append(req.Scopes, scope)
+		}
+	}
+	if !slices.Contains(req.Scopes, "openid") {
+		return req, true, oauthError("invalid_scope", "the openid scope is required")
+	}
+	return req, true, nil
+}
+
+func (svc *Service) deleteExpiredOAuthGrants(now time.Time) {
+	if err := svc.store.DeleteExpiredOAuthGrants(now.Unix()); err != nil {
+		log.Printf("Error deleting expired authorization codes: %v", err)
+	}
+}
+
+// Authorize continues a valid request for the logged in user. If the user
+// already allowed the client these scopes it returns the redirect URL with
+// the authorization code, otherwise the ID of the consent the user has to
+// answer with FinishConsent.
+func (svc *Service) Authorize(session Login, req AuthorizeRequest) (string, string, error) {
+	if !req.ForceConsent {
+		scope, err := svc.store.GetOAuthConsent(session.UserID, req.ClientID)
+		if err != nil {
+			return "", "", err
+		}
+		allowed := strings.Fields(scope)
+		covered := true
+		for _, requested := range req.Scopes {
+			if !slices.Contains(allowed, requested) {
+				covered = false
+			}
+		}
+		if covered {
+			redirect, err := svc.issueAuthorizationCode(session.UserID, session.Created, req)
+			return redirect, "", err
+		}
+	}
+
+	consentID, err := generateSecureToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	err = svc.store.AddOAuthConsentRequest(database.OAuthConsentRequest{
+		IDHash:        hashToken(consentID),
+		UserID:        session.UserID,
+		ClientID:      req.ClientID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(req.Scopes, " "),
+		State:         req.State,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      session.Created,
+		Expires:       time.Now().Add(consentTimeout).Unix(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return "", consentID, nil
+}
+
+// turns a saved consent request back into the request it came from, the
+// client name is read again in case it changed
+func (svc *Service) consentRequest(consent database.OAuthConsentRequest) (AuthorizeRequest, error) {
+	if time.Now().Unix() >= consent.Expires {
+		return AuthorizeRequest{}, ErrInvalidConsent
+	}
+	client, err := svc.store.GetOAuthClient(consent.ClientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AuthorizeRequest{}, ErrInvalidConsent
+	}
+	if err != nil {
+		return AuthorizeRequest{}, err
+	}
+	return AuthorizeRequest{
+		ClientID:      consent.ClientID,
+		ClientName:    client.Name,
+		RedirectURI:   consent.RedirectURI,
+		Scopes:        strings.Fields(consent.Scope),
+		State:         consent.State,
+		Nonce:         consent.Nonce,
+		CodeChallenge: consent.CodeChallenge,
+	}, nil
+}
+
+// GetConsentRequest returns what the user is asked to allow
+func (svc *Service) GetConsentRequest(userID int, consentID string) (AuthorizeRequest, error) {
+	consent, err := svc.store.GetOAuthConsentRequest(hashToken(consentID), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AuthorizeRequest{}, ErrInvalidConsent
+	}
+	if err != nil {
+		return AuthorizeRequest{}, err
+	}
+	return svc.consentRequest(consent)
+}
+
+// FinishConsent saves the answer of the user and returns the redirect URL
+// back to the client, with the authorization code or an access_denied error
+func (svc *Service) FinishConsent(userID int, consentID string, approve bool) (string, error) {
+	consent, err := svc.store.TakeOAuthConsentRequest(hashToken(consentID), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidConsent
+	}
+	if err != nil {
+		return "", err
+	}
+	req, err := svc.consentRequest(consent)
+	if err != nil {
+		return "", err
+	}
+
+	if !approve {
+		return req.ErrorRedirect(oauthError("access_denied", "the user denied the request")), nil
+	}
+	err = svc.store.SetOAuthConsent(userID, req.ClientID, strings.Join(req.Scopes, " "), time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return svc.issueAuthorizationCode(userID, consent.AuthTime, req)
+}
+
+func (svc *Service) issueAuthorizationCode(userID int, authTime int64, req AuthorizeRequest) (string, error) {
+	code, err := generateSecureToken(48)
+	if err != nil {
+		return "", err
+	}
+
+	err = svc.store.AddOAuthCode(database.OAuthCode{
+		CodeHash:      hashToken(code),
+		UserID:        userID,
+		ClientID:      req.ClientID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(req.Scopes, " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      authTime,
+		Expires:       time.Now().Add(authorizationCodeTimeout).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return req.redirect(url.Values{"code": {code}}), nil
+}
+
+// TokenResponse is the answer of /oauth/token
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// IDTokenClaims are the claims of the ID tokens and of /oauth/userinfo
+type IDTokenClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	AuthTime  int64  `json:"auth_time,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	IsActive      bool   `json:"is_active"`
+	// only with the permissions scope
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// access tokens of the authorization server, they are only accepted by
+// /oauth/userinfo and by apps that verify them with the JWKS
+type accessTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Scope     string `json:"scope"`
+}
+
+func (svc *Service) userClaims(usr database.User, scopes []string) (IDTokenClaims, error) {
+	claims := IDTokenClaims{
+		Subject:  strconv.Itoa(usr.ID),
+		IsActive: usr.IsActive,
+	}
+	if slices.Contains(scopes, "email") {
+		verified := !usr.PendingVerification
+		claims.Email = usr.Email
+		claims.EmailVerified = &verified
+	}
+	if slices.Contains(scopes, "profile") {
+		claims.Name = usr.Name
+	}
+	if slices.Contains(scopes, "permissions") {
+		perms, err := svc.permissions.GetUserPermissions(usr.ID)
+		if err != nil {
+			return claims, err
+		}
+		claims.Permissions = []string{}
+		for _, perm := range perms {
+			claims.Permissions = append(claims.Permissions, perm.Permission)
+		}
+	}
+	return claims, nil
+}
+
+// checks the client credentials, public clients have no secret
+func (svc *Service) authenticateOAuthClient(clientID, clientSecret string) (database.OAuthClient, error) {
+	client, err := svc.store.GetOAuthClient(clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return client, oauthError("invalid_client", "unknown client")
+	}
+	if err != nil {
+		return client, err
+	}
+	if client.SecretHash != "" && subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(client.SecretHash)) != 1 {
+		return client, oauthError("invalid_client", "invalid client credentials")
+	}
+	return client, nil
+}
+
+// ExchangeAuthorizationCode is the authorization_code grant of /oauth/token,
+// codes work once and only with the verifier of their PKCE challenge and
+// only while the user can log in
+func (svc *Service) ExchangeAuthorizationCode(clientID, clientSecret, code, redirectURI, codeVerifier string) (TokenResponse, error) {
+	client, err := svc.authenticateOAuthClient(clientID, clientSecret)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	grant, err := svc.store.TakeOAuthCode(hashToken(code))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return TokenResponse{}, err
+	}
+	if err != nil || time.Now().Unix() >= grant.Expires || grant.ClientID != client.ID || grant.RedirectURI != redirectURI {
+		return TokenResponse{}, oauthError("invalid_grant", "invalid or expired authorization code")
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(grant.CodeChallenge)) != 1 {
+		return TokenResponse{}, oauthError("invalid_grant", "invalid code_verifier")
+	}
+
+	usr, err := svc.store.GetUser(grant.UserID)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if err := svc.checkOAuthUser(usr, "invalid_grant"); err != nil {
+		return TokenResponse{}, err
+	}
+
+	now := time.Now()
+	lifetime := svc.sessionConfig.AccessTimeout
+	claims, err := svc.userClaims(usr, strings.Fields(grant.Scope))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	claims.Issuer = svc.oauthIssuer()
+	claims.Audience = client.ID
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(lifetime).Unix()
+	claims.AuthTime = grant.AuthTime
+	claims.Nonce = grant.Nonce
+	idToken, err := svc.signJWT(claims)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	scope := grant.Scope
+	accessToken, err := svc.signJWT(accessTokenClaims{
+		Issuer:    svc.oauthIssuer(),
+		Subject:   claims.Subject,
+		Audience:  client.ID,
+		ID:        functions.GenerateUUID(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+		Scope:     scope,
+	})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(lifetime.Seconds()),
+		IDToken:     idToken,
+		Scope:       scope,
+	}, nil
+}
+
+// GetUserInfo returns the claims of the user of an access token issued by
+// ExchangeAuthorizationCode, limited to its scopes, the user is checked again
+// on every call so prohibited users lose access before the token expires
+func (svc *Service) GetUserInfo(accessToken string) (IDTokenClaims, error) {
+	var claims accessTokenClaims
+	if err := svc.verifyJWT(accessToken, &claims); err != nil {
+		return IDTokenClaims{}, oauthError("invalid_token", err.Error())
+	}
+	scopes := strings.Fields(claims.Scope)
+	if claims.Issuer != svc.oauthIssuer() || claims.Audience == "" || !slices.Contains(scopes, "openid") {
+		return IDTokenClaims{}, oauthError("invalid_token", "not an access token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return IDTokenClaims{}, oauthError("invalid_token", "token expired")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return IDTokenClaims{}, oauthError("invalid_token", "invalid subject")
+	}
+	usr, err := svc.store.GetUser(userID)
+	if err != nil {
+		return IDTokenClaims{}, oauthError("invalid_token", "unknown user")
+	}
+	if err := svc.checkOAuthUser(usr, "invalid_token"); err != nil {
+		return IDTokenClaims{}, err
+	}
+	return svc.userClaims(usr, scopes)
+}
@@ -0,0 +1,263 @@
+package Login
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+func setupAuthServerTest(t *testing.T) (*Service, Login, database.OAuthClient, string) {
+	svc, userID := setupTest(t)
+	client, secret, err := svc.RegisterOAuthClient("Other App", []string{"https://app.tokenize.test/callback"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := svc.createSession(userID, svc.sessionConfig.AbsoluteTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc, session, client, secret
+}
+
+func authorizeQuery(clientID, verifier string) url.Values {
+	challenge := sha256.Sum256([]byte(verifier))
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {"https://app.tokenize.test/callback"},
+		"scope":                 {"openid email profile permissions unknown"},
+		"state":                 {"state-1"},
+		"nonce":                 {"nonce-1"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func codeFromRedirect(t *testing.T, redirect string) string {
+	parsed, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Query().Get("state") != "state-1" || parsed.Query().Get("code") == "" {
+		t.Fatalf("unexpected redirect %s", redirect)
+	}
+	return parsed.Query().Get("code")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	svc, session, client, secret := setupAuthServerTest(t)
+	verifier := "verifier-with-enough-entropy-0123456789"
+
+	req, redirectable, err := svc.ParseAuthorizeRequest(authorizeQuery(client.ID, verifier))
+	if err != nil || !redirectable {
+		t.Fatal(err)
+	}
+	if !slices.Equal(req.Scopes, []string{"openid", "email", "profile", "permissions"}) {
+		t.Fatalf("unexpected scopes %v", req.Scopes)
+	}
+
+	// the first authorization asks for consent
+	redirect, consentID, err := svc.Authorize(session, req)
+	if err != nil || redirect != "" || consentID == "" {
+		t.Fatalf("consent not asked: %v %s", err, redirect)
+	}
+	if _, err := svc.FinishConsent(session.UserID+1, consentID, true); !errors.Is(err, ErrInvalidConsent) {
+		t.Fatalf("another user answered the consent: %v", err)
+	}
+	redirect, err = svc.FinishConsent(session.UserID, consentID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := codeFromRedirect(t, redirect)
+
+	if _, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, "wrong verifier"); err == nil {
+		t.Fatal("code exchanged with the wrong verifier")
+	}
+
+	// a failed exchange also burns the code
+	redirect, consentID, err = svc.Authorize(session, req)
+	if err != nil || consentID != "" {
+		t.Fatalf("consent asked again: %v", err)
+	}
+	code = codeFromRedirect(t, redirect)
+	if _, err := svc.ExchangeAuthorizationCode(client.ID, "wrong secret", code, req.RedirectURI, verifier); err == nil {
+		t.Fatal("code exchanged with the wrong client secret")
+	}
+
+	redirect, _, err = svc.Authorize(session, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = codeFromRedirect(t, redirect)
+	tokens, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier); err == nil {
+		t.Fatal("code used twice")
+	}
+
+	var claims IDTokenClaims
+	if err := svc.verifyJWT(tokens.IDToken, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != client.ID || claims.Nonce != "nonce-1" || claims.Subject != strconv.Itoa(session.UserID) {
+		t.Fatalf("unexpected ID token claims %+v", claims)
+	}
+	if claims.Email != testEmail || claims.Name != testUsername || claims.EmailVerified == nil {
+		t.Fatalf("ID token without user claims %+v", claims)
+	}
+
+	info, err := svc.GetUserInfo(tokens.AccessToken)
+	if err != nil || info.Email != testEmail {
+		t.Fatalf("userinfo failed: %v %+v", err, info)
+	}
+	if _, err := svc.GetUserInfo(tokens.IDToken); err == nil {
+		t.Fatal("ID token accepted as access token")
+	}
+
+	// tokens for other apps are not Tokenize logins
+	svc.SetTokenMode(SignedTokens)
+	defer svc.SetTokenMode(SessionTokens)
+	if _, ok := svc.verifyToken(tokens.IDToken); ok {
+		t.Fatal("ID token accepted as login")
+	}
+	if _, ok := svc.verifyToken(tokens.AccessToken); ok {
+		t.Fatal("access token accepted as login")
+	}
+}
+
+func TestAuthorizeRequestValidation(t *testing.T) {
+	svc, _, client, _ := setupAuthServerTest(t)
+
+	query := authorizeQuery(client.ID, "verifier")
+	query.Set("redirect_uri", "https://evil.test/callback")
+	if _, redirectable, err := svc.ParseAuthorizeRequest(query); err == nil || redirectable {
+		t.Fatal("unregistered redirect URI accepted")
+	}
+
+	query = authorizeQuery(client.ID, "verifier")
+	query.Del("code_challenge")
+	if _, redirectable, err := svc.ParseAuthorizeRequest(query); err == nil || !redirectable {
+		t.Fatal("request without PKCE accepted")
+	}
+
+	query = authorizeQuery(client.ID, "verifier")
+	query.Set("scope", "email")
+	if _, _, err := svc.ParseAuthorizeRequest(query); err == nil {
+		t.Fatal("request without openid scope accepted")
+	}
+}
+
+// codes and consent requests are in the database, so the instance that
+// answers /oauth/token does not have to be the one that issued the code
+func TestAuthorizationCodeOnAnotherInstance(t *testing.T) {
+	svc, session, client, secret := setupAuthServerTest(t)
+	other := New(svc.store, svc.permissions)
+	other.Init()
+	verifier := "verifier-with-enough-entropy-0123456789"
+
+	req, _, err := svc.ParseAuthorizeRequest(authorizeQuery(client.ID, verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, consentID, err := svc.Authorize(session, req)
+	if err != nil || consentID == "" {
+		t.Fatalf("consent not asked: %v", err)
+	}
+	consent, err := other.GetConsentRequest(session.UserID, consentID)
+	if err != nil || consent.ClientName != "Other App" || consent.State != "state-1" || !slices.Equal(consent.Scopes, req.Scopes) {
+		t.Fatalf("consent request not shared: %v %+v", err, consent)
+	}
+	redirect, err := other.FinishConsent(session.UserID, consentID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.FinishConsent(session.UserID, consentID, true); !errors.Is(err, ErrInvalidConsent) {
+		t.Fatalf("consent answered twice: %v", err)
+	}
+
+	code := codeFromRedirect(t, redirect)
+	if _, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier); err == nil {
+		t.Fatal("code used twice")
+	}
+}
+
+func authorizationCode(t *testing.T, svc *Service, session Login, clientID, verifier string) (string, AuthorizeRequest) {
+	req, _, err := svc.ParseAuthorizeRequest(authorizeQuery(clientID, verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect, consentID, err := svc.Authorize(session, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first authorization asks for consent
+	if consentID != "" {
+		if redirect, err = svc.FinishConsent(session.UserID, consentID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return codeFromRedirect(t, redirect), req
+}
+
+func TestAuthorizationCodeProhibitedUser(t *testing.T) {
+	svc, session, client, secret := setupAuthServerTest(t)
+	verifier := "verifier-with-enough-entropy-0123456789"
+
+	code, req := authorizationCode(t, svc, session, client.ID, verifier)
+	tokens, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = authorizationCode(t, svc, session, client.ID, verifier)
+
+	if err := svc.store.ProhibitUser(session.UserID); err != nil {
+		t.Fatal(err)
+	}
+	var oauthErr *OAuthError
+	_, err = svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier)
+	if !errors.Is(err, ErrUserProhibited) || !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_grant" {
+		t.Fatalf("prohibited user exchanged a code: %v", err)
+	}
+	_, err = svc.GetUserInfo(tokens.AccessToken)
+	if !errors.Is(err, ErrUserProhibited) || !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_token" {
+		t.Fatalf("prohibited user got the userinfo: %v", err)
+	}
+}
+
+func TestAuthorizationCodeUnverifiedUser(t *testing.T) {
+	svc, session, client, secret := setupAuthServerTest(t)
+	verifier := "verifier-with-enough-entropy-0123456789"
+
+	code, req := authorizationCode(t, svc, session, client.ID, verifier)
+	tokens, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = authorizationCode(t, svc, session, client.ID, verifier)
+
+	svc.SetRequireVerifiedEmail(true)
+	if _, err := svc.ExchangeAuthorizationCode(client.ID, secret, code, req.RedirectURI, verifier); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("unverified user exchanged a code: %v", err)
+	}
+	if _, err := svc.GetUserInfo(tokens.AccessToken); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("unverified user got the userinfo: %v", err)
+	}
+
+	if err := svc.store.SetEmailVerified(session.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.GetUserInfo(tokens.AccessToken); err != nil {
+		t.Fatalf("userinfo failed after the email was verified: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package Login
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCBORDecode(t *testing.T) {
+	encoded := cborEncode([]cborPair{
+		{1, 2},
+		{-7, "text"},
+		{"bytes", []byte{1, 2, 3}},
+		{"map", []cborPair{{300, 70000}}},
+	})
+	// the extension after the item is left for the caller
+	value, used, err := cborDecode(append(encoded, 0xa0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != len(encoded) {
+		t.Fatalf("used %d bytes, want %d", used, len(encoded))
+	}
+	want := map[any]any{
+		int64(1):  int64(2),
+		int64(-7): "text",
+		"bytes":   []byte{1, 2, 3},
+		"map":     map[any]any{int64(300): int64(70000)},
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Fatalf("got %#v, want %#v", value, want)
+	}
+
+	invalid := [][]byte{
+		{},
+		{0x18},                         // missing argument
+		{0x5f},                         // indefinite length
+		{0x45, 1, 2},                   // byte string longer than the data
+		{0x9a, 0xff, 0xff, 0xff, 0xff}, // array longer than the data
+		{0xa1, 0x41, 1, 1},             // byte string map key
+		{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // integer overflow
+		bytes.Repeat([]byte{0x81}, 20),                         // nesting too deep
+	}
+	for _, data := range invalid {
+		if _, _, err := cborDecode(data); err == nil {
+			t.Errorf("decoded invalid cbor %x", data)
+		}
+	}
+}
+
+func FuzzCBORDecode(f *testing.F) {
+	f.Add(cborEncode([]cborPair{{1, 2}, {3, coseES256}, {-1, 1}, {-2, make([]byte, 32)}, {-3, make([]byte, 32)}}))
+	f.Add(cborEncode([]cborPair{{"fmt", "none"}, {"attStmt", []cborPair{}}, {"authData", make([]byte, 37)}}))
+	f.Add([]byte{0x9a, 0xff, 0xff, 0xff, 0xff})
+	f.Add(bytes.Repeat([]byte{0x81}, 20))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, used, err := cborDecode(data)
+		if used < 0 || used > len(data) {
+			t.Fatalf("used %d bytes of %d", used, len(data))
+		}
+		if err == nil && used == 0 {
+			t.Fatal("decoded an item without reading it")
+		}
+		// whatever it decodes as a COSE key must not panic either
+		parseCOSEKey(data)
+	})
+}
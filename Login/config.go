@@ -0,0 +1,97 @@
+package Login
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SessionConfig controls how long a session created by LoginUser lives
+type SessionConfig struct {
+	// a session always ends this long after it was created
+	AbsoluteTimeout time.Duration
+	// a session ends if it is not used for this long, 0 disables it
+	IdleTimeout time.Duration
+	// absolute timeout for "remember me" sessions, these have no idle timeout
+	RememberTimeout time.Duration
+	// lifetime of the access sessions issued together with a refresh token
+	AccessTimeout time.Duration
+	// lifetime of a refresh token, every refresh issues a new one
+	RefreshTimeout time.Duration
+}
+
+func (svc *Service) SetSessionConfig(config SessionConfig) {
+	svc.sessionConfig = config
+}
+
+func (svc *Service) GetSessionConfig() SessionConfig {
+	return svc.sessionConfig
+}
+
+// ThrottleConfig controls the lockout of logins after failed attempts
+type ThrottleConfig struct {
+	// failed logins of one email before it is locked, 0 disables it
+	MaxFailures int
+	// failed logins of one client IP before it is locked, 0 disables it
+	MaxIPFailures int
+	// first lockout, it doubles with every failure after that
+	Lockout time.Duration
+	// the lockout never gets longer than this
+	MaxLockout time.Duration
+	// the failures are forgotten after this long without new ones
+	ResetAfter time.Duration
+}
+
+func (svc *Service) SetThrottleConfig(config ThrottleConfig) {
+	svc.throttleConfig = config
+}
+
+func (svc *Service) GetThrottleConfig() ThrottleConfig {
+	return svc.throttleConfig
+}
+
+func intFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid number in env variable %s: %v", name, err)
+	}
+	return i
+}
+
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration in env variable %s: %v", name, err)
+	}
+	return d
+}
+
+// SESSION_ABSOLUTE_TIMEOUT, SESSION_IDLE_TIMEOUT, SESSION_REMEMBER_TIMEOUT,
+// SESSION_ACCESS_TIMEOUT and SESSION_REFRESH_TIMEOUT override the defaults,
+// they use go durations like "12h" or "30m"
+func (svc *Service) loadSessionConfig() {
+	svc.sessionConfig.AbsoluteTimeout = durationFromEnv("SESSION_ABSOLUTE_TIMEOUT", svc.sessionConfig.AbsoluteTimeout)
+	svc.sessionConfig.IdleTimeout = durationFromEnv("SESSION_IDLE_TIMEOUT", svc.sessionConfig.IdleTimeout)
+	svc.sessionConfig.RememberTimeout = durationFromEnv("SESSION_REMEMBER_TIMEOUT", svc.sessionConfig.RememberTimeout)
+	svc.sessionConfig.AccessTimeout = durationFromEnv("SESSION_ACCESS_TIMEOUT", svc.sessionConfig.AccessTimeout)
+	svc.sessionConfig.RefreshTimeout = durationFromEnv("SESSION_REFRESH_TIMEOUT", svc.sessionConfig.RefreshTimeout)
+}
+
+// LOGIN_MAX_FAILURES, LOGIN_MAX_IP_FAILURES, LOGIN_LOCKOUT, LOGIN_MAX_LOCKOUT
+// and LOGIN_FAILURE_RESET override the defaults
+func (svc *Service) loadThrottleConfig() {
+	svc.throttleConfig.MaxFailures = intFromEnv("LOGIN_MAX_FAILURES", svc.throttleConfig.MaxFailures)
+	svc.throttleConfig.MaxIPFailures = intFromEnv("LOGIN_MAX_IP_FAILURES", svc.throttleConfig.MaxIPFailures)
+	svc.throttleConfig.Lockout = durationFromEnv("LOGIN_LOCKOUT", svc.throttleConfig.Lockout)
+	svc.throttleConfig.MaxLockout = durationFromEnv("LOGIN_MAX_LOCKOUT", svc.throttleConfig.MaxLockout)
+	svc.throttleConfig.ResetAfter = durationFromEnv("LOGIN_FAILURE_RESET", svc.throttleConfig.ResetAfter)
+}
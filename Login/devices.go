@@ -0,0 +1,64 @@
+package Login
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Logs"
+	"github.com/Maruqes/Tokenize/Mail"
+)
+
+// user agents are cut to this length before they are saved
+const maxUserAgentLength = 512
+
+func (svc *Service) SetNewDeviceEmail(enabled bool) {
+	svc.newDeviceEmail = enabled
+}
+
+// RecordSessionClient saves the client IP and user agent of a new session and
+// emails the user when the device is new (see SetNewDeviceEmail). The handlers
+// that log users in call it, sessions of signed tokens are not stored so only
+// the email applies to them.
+func (svc *Service) RecordSessionClient(session Login, ip, userAgent string) error {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	if err := svc.loginStore.SetClient(session.ID, ip, userAgent); err != nil {
+		return err
+	}
+
+	// the admin's device says nothing about the user
+	if session.ImpersonatorID != 0 {
+		return nil
+	}
+	return svc.checkNewDevice(session.UserID, ip, userAgent, time.Now())
+}
+
+// a device is known by its user agent, the IP changes too often to be used
+func (svc *Service) checkNewDevice(userID int, ip, userAgent string, now time.Time) error {
+	known, err := svc.store.CountUserDevices(userID)
+	if err != nil {
+		return err
+	}
+	isNew, err := svc.store.AddUserDevice(userID, hashToken(userAgent), now.Unix())
+	if err != nil {
+		return err
+	}
+	// the first device of a user is where the account was created
+	if !isNew || known == 0 {
+		return nil
+	}
+
+	Logs.LogMessage("New device login for user with id " + strconv.Itoa(userID) + " from IP " + ip)
+	if !svc.newDeviceEmail {
+		return nil
+	}
+	usr, err := svc.store.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hi %s,\n\nYour account was just used to log in from a new device:\n\nTime: %s\nIP address: %s\nDevice: %s\n\nIf this was you there is nothing to do. If not, change your password and log out the sessions you do not know at %s.",
+		usr.Name, now.UTC().Format("2006-01-02 15:04:05 UTC"), ip, userAgent, svc.domain)
+	return Mail.Send(usr.Email, "New login to your account", body)
+}
@@ -0,0 +1,76 @@
+package Login
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecordSessionClient(t *testing.T) {
+	forEachSessionStore(t, func(t *testing.T, svc *Service, userID int) {
+		session, _, err := svc.LoginUserSession(testEmail, "password", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userAgent := "Mozilla/5.0 " + strings.Repeat("x", maxUserAgentLength)
+		if err := svc.RecordSessionClient(session, "192.0.2.1", userAgent); err != nil {
+			t.Fatal(err)
+		}
+
+		sessions, err := svc.GetUserSessions(userID)
+		if err != nil || len(sessions) != 1 {
+			t.Fatalf("expected 1 session, got %d: %v", len(sessions), err)
+		}
+		if sessions[0].IP != "192.0.2.1" || sessions[0].UserAgent != userAgent[:maxUserAgentLength] {
+			t.Fatalf("client was not saved: %q %d", sessions[0].IP, len(sessions[0].UserAgent))
+		}
+	})
+}
+
+func TestNewDeviceEmail(t *testing.T) {
+	svc, _ := setupTest(t)
+	mailer := captureMail(t)
+	svc.SetNewDeviceEmail(true)
+
+	login := func(userAgent string) Login {
+		session, _, err := svc.LoginUserSession(testEmail, "password", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.RecordSessionClient(session, "192.0.2.1", userAgent); err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+
+	// the first device is where the account was created
+	login("laptop")
+	login("laptop")
+	if mailer.count() != 0 {
+		t.Fatalf("known devices sent %d emails", mailer.count())
+	}
+
+	login("phone")
+	if mailer.count() != 1 || mailer.mails[0].to != testEmail || !strings.Contains(mailer.mails[0].body, "192.0.2.1") {
+		t.Fatalf("new device did not send an email: %+v", mailer.mails)
+	}
+	login("phone")
+	if mailer.count() != 1 {
+		t.Fatal("the same device sent another email")
+	}
+
+	// the device of an admin impersonating the user is not the user's
+	session := login("laptop")
+	session.ImpersonatorID = session.UserID + 1
+	if err := svc.RecordSessionClient(session, "198.51.100.7", "admin browser"); err != nil {
+		t.Fatal(err)
+	}
+	if mailer.count() != 1 {
+		t.Fatal("impersonated session sent a new device email")
+	}
+
+	svc.SetNewDeviceEmail(false)
+	login("tablet")
+	if mailer.count() != 1 {
+		t.Fatal("new device email was sent while disabled")
+	}
+}
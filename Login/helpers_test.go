@@ -0,0 +1,55 @@
+package Login
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Maruqes/Tokenize/Permissions"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+const (
+	testOrigin   = "https://tokenize.test"
+	testEmail    = "user@tokenize.test"
+	testUsername = "user"
+)
+
+// setupTest opens a new database in a temporary directory and adds one user to
+// it, sessions are kept in memory
+func setupTest(t *testing.T) (*Service, int) {
+	t.Setenv("DOMAIN", testOrigin)
+	t.Setenv("SESSION_STORE", "memory")
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	s, err := database.OpenSQLite("./users.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	svc := New(s, Permissions.New(s))
+	svc.Init()
+
+	id, err := svc.store.AddUser("", testEmail, testUsername, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc, int(id)
+}
+
+func isLoggedIn(svc *Service, token string) bool {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return svc.CheckToken(r)
+}
@@ -0,0 +1,167 @@
+package Login
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Logs"
+	"github.com/Maruqes/Tokenize/Permissions"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+var (
+	ErrImpersonationNotAllowed = errors.New("impersonation not allowed")
+	ErrNotImpersonating        = errors.New("session is not impersonated")
+)
+
+// paths DenyImpersonation lets through even though they are wrapped in it
+type pathSet struct {
+	sync.RWMutex
+	paths map[string]bool
+}
+
+// AllowImpersonation lets impersonated sessions use paths that are blocked
+// for them by default, like /change-password
+func (svc *Service) AllowImpersonation(paths ...string) {
+	svc.impersonationAllowed.Lock()
+	defer svc.impersonationAllowed.Unlock()
+	for _, path := range paths {
+		svc.impersonationAllowed.paths[path] = true
+	}
+}
+
+// admins can not be impersonated, it would give their permissions to anyone
+// who can impersonate
+func (svc *Service) canImpersonate(usr database.User) bool {
+	return !usr.IsProhibited && svc.permissions.HasPermission(Permissions.Subject{UserID: usr.ID}, svc.impersonationPermission)
+}
+
+// StartImpersonation creates a session of the target user for the admin that
+// owns actor, the session is marked with the admin and the ID of actor. With
+// signed tokens it is saved in the session store too, so it can be revoked.
+func (svc *Service) StartImpersonation(actor Login, targetID int) (Login, database.User, error) {
+	if actor.APIKeyID != 0 || actor.ImpersonatorID != 0 || actor.UserID == targetID {
+		return Login{}, database.User{}, ErrImpersonationNotAllowed
+	}
+	admin, err := svc.store.GetUser(actor.UserID)
+	if err != nil {
+		return Login{}, database.User{}, err
+	}
+	if !svc.canImpersonate(admin) {
+		return Login{}, database.User{}, ErrImpersonationNotAllowed
+	}
+
+	target, err := svc.store.GetUser(targetID)
+	if err != nil {
+		return Login{}, database.User{}, err
+	}
+	subject := Permissions.Subject{UserID: target.ID}
+	if svc.permissions.HasPermission(subject, svc.impersonationPermission) || svc.permissions.HasPermission(subject, "all:all") {
+		return Login{}, target, ErrImpersonationNotAllowed
+	}
+
+	var session Login
+	if svc.tokenMode == SignedTokens {
+		session, err = svc.issueSignedToken(target, svc.impersonationTimeout, false, admin.ID)
+		if err == nil {
+			session.ImpersonatorSessionID = actor.ID
+			session, err = svc.loginStore.Add(session)
+		}
+	} else {
+		session, err = svc.storeSession(Login{UserID: target.ID, ImpersonatorID: admin.ID, ImpersonatorSessionID: actor.ID}, svc.impersonationTimeout)
+	}
+	if err != nil {
+		return Login{}, target, err
+	}
+
+	Logs.LogMessage("Impersonation of user with id " + strconv.Itoa(target.ID) + " started by user with id " + strconv.Itoa(admin.ID))
+	return session, target, nil
+}
+
+// StopImpersonation ends an impersonated session and revokes its token in
+// both token modes. impersonatorSessionID is the ID of the session the admin
+// started the impersonation with (can be empty), when it matches the one saved
+// with the impersonation the admin gets a new session so the caller can log
+// the admin back in.
+func (svc *Service) StopImpersonation(session Login, impersonatorSessionID string) (Login, error) {
+	if session.ImpersonatorID == 0 {
+		return Login{}, ErrNotImpersonating
+	}
+	if _, err := svc.loginStore.Delete(session.UserID, session.ID); err != nil {
+		return Login{}, err
+	}
+	Logs.LogMessage("Impersonation of user with id " + strconv.Itoa(session.UserID) + " ended by user with id " + strconv.Itoa(session.ImpersonatorID))
+
+	if impersonatorSessionID == "" || subtle.ConstantTimeCompare([]byte(impersonatorSessionID), []byte(session.ImpersonatorSessionID)) != 1 {
+		return Login{}, nil
+	}
+	admin, err := svc.store.GetUser(session.ImpersonatorID)
+	if err != nil {
+		return Login{}, err
+	}
+	return svc.restoreImpersonator(admin, impersonatorSessionID)
+}
+
+// the token the admin had before the impersonation is not kept anywhere, so
+// the admin gets a new one. A stored session is replaced by one with the same
+// expiration and only while it is still valid, signed tokens can not be
+// looked up so they get a new login.
+func (svc *Service) restoreImpersonator(admin database.User, sessionID string) (Login, error) {
+	if svc.tokenMode == SignedTokens {
+		return svc.issueLogin(admin, svc.sessionConfig.AbsoluteTimeout, false)
+	}
+
+	sessions, err := svc.loginStore.List(admin.ID)
+	if err != nil {
+		return Login{}, err
+	}
+	now := time.Now()
+	for _, old := range sessions {
+		if old.ID != sessionID || old.IsExpired(now, svc.sessionConfig.IdleTimeout) {
+			continue
+		}
+		deleted, err := svc.loginStore.Delete(admin.ID, old.ID)
+		if err != nil || !deleted {
+			return Login{}, err
+		}
+		return svc.storeSession(Login{UserID: admin.ID, Remember: old.Remember}, time.Unix(old.Expires, 0).Sub(now))
+	}
+	return Login{}, nil
+}
+
+// an impersonated session stops working as soon as its admin loses the
+// permission or is prohibited
+func (svc *Service) checkImpersonator(login Login) bool {
+	if login.ImpersonatorID == 0 {
+		return true
+	}
+	admin, err := svc.store.GetUser(login.ImpersonatorID)
+	return err == nil && svc.canImpersonate(admin)
+}
+
+// DenyImpersonation answers 403 to impersonated sessions, it wraps the
+// sensitive routes (password change, billing, 2FA...) unless their path was
+// given to AllowImpersonation. Use it inside RequireLogin or OptionalLogin.
+func (svc *Service) DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login, ok := CurrentLogin(r.Context())
+		if !ok {
+			login, ok = svc.authenticate(r)
+		}
+		if ok && login.ImpersonatorID != 0 {
+			svc.impersonationAllowed.RLock()
+			allowed := svc.impersonationAllowed.paths[r.URL.Path]
+			svc.impersonationAllowed.RUnlock()
+			if !allowed {
+				Logs.LogMessage("Blocked " + r.Method + " " + r.URL.Path + " for user with id " + strconv.Itoa(login.UserID) + " impersonated by user with id " + strconv.Itoa(login.ImpersonatorID))
+				http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,190 @@
+package Login
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+func setupImpersonationTest(t *testing.T) (*Service, Login, int) {
+	svc, targetID := setupTest(t)
+
+	adminID, err := svc.store.AddUser("", "admin@tokenize.test", "admin", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.store.CreateNewPermission("Impersonate", svc.impersonationPermission); err != nil {
+		t.Fatal(err)
+	}
+	permission, err := svc.store.GetPermissionWithPermission(svc.impersonationPermission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.store.AddUserPermission(int(adminID), permission.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := svc.createSession(int(adminID), svc.sessionConfig.AbsoluteTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc, admin, targetID
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("POST", "/change-password", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestImpersonation(t *testing.T) {
+	svc, admin, targetID := setupImpersonationTest(t)
+
+	session, _, err := svc.StartImpersonation(admin, targetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.UserID != targetID || session.ImpersonatorID != admin.UserID {
+		t.Fatalf("impersonated session has the wrong users %+v", session)
+	}
+
+	var actor database.User
+	handler := svc.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, _ = CurrentImpersonator(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), bearerRequest(session.Token))
+	if actor.ID != admin.UserID {
+		t.Fatalf("expected the admin in the request context, got %+v", actor)
+	}
+
+	denied := httptest.NewRecorder()
+	svc.RequireLogin(svc.DenyImpersonation(http.NotFoundHandler())).ServeHTTP(denied, bearerRequest(session.Token))
+	if denied.Code != http.StatusForbidden {
+		t.Fatalf("sensitive route answered %d to an impersonated session", denied.Code)
+	}
+
+	restored, err := svc.StopImpersonation(session, admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.UserID != admin.UserID || !isLoggedIn(svc, restored.Token) {
+		t.Fatalf("stopping did not return the admin session, got %+v", restored)
+	}
+	if restored.Expires != admin.Expires {
+		t.Fatalf("the new admin session expires at %d, want %d", restored.Expires, admin.Expires)
+	}
+	if _, ok := svc.verifyToken(session.Token); ok {
+		t.Fatal("impersonated session still works after stopping")
+	}
+	// the new session replaces the one the impersonation was started from
+	if _, ok := svc.verifyToken(admin.Token); ok {
+		t.Fatal("the old admin session still works")
+	}
+}
+
+func TestImpersonationSignedTokens(t *testing.T) {
+	svc, admin, targetID := setupImpersonationTest(t)
+	svc.SetTokenMode(SignedTokens)
+	admin, err := svc.issueSignedToken(database.User{ID: admin.UserID}, svc.sessionConfig.AbsoluteTimeout, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, _, err := svc.StartImpersonation(admin, targetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, ok := svc.authenticate(bearerRequest(session.Token))
+	if !ok || login.UserID != targetID || login.ImpersonatorID != admin.UserID {
+		t.Fatalf("impersonated token did not log in: %+v", login)
+	}
+
+	restored, err := svc.StopImpersonation(login, admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.UserID != admin.UserID || !isLoggedIn(svc, restored.Token) {
+		t.Fatalf("stopping did not log the admin back in, got %+v", restored)
+	}
+	if _, err := svc.VerifySignedToken(session.Token); err != nil {
+		t.Fatalf("the signature of the token should still be valid: %v", err)
+	}
+	if _, ok := svc.authenticate(bearerRequest(session.Token)); ok {
+		t.Fatal("signed impersonated token still works after stopping")
+	}
+
+	// the stored session is what makes the token work, not only its signature
+	other, _, err := svc.StartImpersonation(admin, targetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.LogoutUser(targetID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svc.authenticate(bearerRequest(other.Token)); ok {
+		t.Fatal("signed impersonated token still works after logging the user out")
+	}
+}
+
+func TestImpersonationForgedCookie(t *testing.T) {
+	svc, admin, targetID := setupImpersonationTest(t)
+
+	// another session of the admin is not the one the impersonation came from
+	otherAdmin, err := svc.createSession(admin.UserID, svc.sessionConfig.AbsoluteTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, forged := range []string{"", "forged", admin.Token, otherAdmin.ID} {
+		session, _, err := svc.StartImpersonation(admin, targetID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := svc.StopImpersonation(session, forged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Token != "" {
+			t.Fatalf("cookie %q logged the admin back in", forged)
+		}
+		if _, ok := svc.verifyToken(session.Token); ok {
+			t.Fatal("impersonated session still works after stopping")
+		}
+	}
+	if !isLoggedIn(svc, admin.Token) || !isLoggedIn(svc, otherAdmin.Token) {
+		t.Fatal("a forged cookie logged the admin out")
+	}
+}
+
+func TestImpersonationRequiresPermission(t *testing.T) {
+	svc, admin, targetID := setupImpersonationTest(t)
+
+	// the target has no permission to impersonate the admin back
+	target, err := svc.createSession(targetID, svc.sessionConfig.AbsoluteTimeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.StartImpersonation(target, admin.UserID); !errors.Is(err, ErrImpersonationNotAllowed) {
+		t.Fatalf("expected impersonation to be refused, got %v", err)
+	}
+
+	session, _, err := svc.StartImpersonation(admin, targetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.StartImpersonation(session, admin.UserID); !errors.Is(err, ErrImpersonationNotAllowed) {
+		t.Fatalf("impersonated session started another impersonation: %v", err)
+	}
+
+	// losing the permission ends the impersonation
+	permission, err := svc.store.GetPermissionWithPermission(svc.impersonationPermission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.store.RemoveUserPermission(admin.UserID, permission.ID)
+	if _, ok := svc.authenticate(bearerRequest(session.Token)); ok {
+		t.Fatal("impersonated session still works after the admin lost the permission")
+	}
+}
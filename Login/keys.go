@@ -0,0 +1,374 @@
+package Login
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	functions "github.com/Maruqes/Tokenize/Functions"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+type signingKey struct {
+	id      string
+	key     *rsa.PrivateKey
+	created time.Time
+	retired int64
+}
+
+// other instances may rotate the keys, so the keys in memory are read again
+// from the database when they are older than this
+const keyReloadInterval = time.Minute
+
+type keySet struct {
+	sync.RWMutex
+	store      database.TokenStore
+	keys       []signingKey // newest first, keys[0] signs
+	lastReload time.Time
+	// AES-256 key of the private keys saved in the database, nil saves them
+	// as plain PEM
+	secret []byte
+}
+
+// the PEM type of a private key encrypted with the signing key secret
+const encryptedKeyType = "TOKENIZE ENCRYPTED PRIVATE KEY"
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC keys, only read from the JWKS of OpenID Connect providers
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// SetSigningKeySecret encrypts the private signing keys saved in the database
+// with AES-GCM, SIGNING_KEY_SECRET sets it too. Every instance sharing the
+// database needs the same secret. Call it before Init, which encrypts the
+// keys saved in plain PEM before.
+func (svc *Service) SetSigningKeySecret(secret string) {
+	key := sha256.Sum256([]byte(secret))
+	svc.signingKeys.secret = key[:]
+}
+
+func (s *keySet) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the ID of the key is authenticated with it, so an encrypted key can not be
+// copied to another row
+func (s *keySet) encodePrivateKey(id string, key *rsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	if s.secret == nil {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+	}
+
+	aead, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, der, []byte(id))
+	return string(pem.EncodeToMemory(&pem.Block{Type: encryptedKeyType, Bytes: sealed})), nil
+}
+
+func (s *keySet) decodePrivateKey(id, data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	der := block.Bytes
+	switch block.Type {
+	case "PRIVATE KEY":
+	case encryptedKeyType:
+		if s.secret == nil {
+			return nil, fmt.Errorf("private key is encrypted, set SIGNING_KEY_SECRET")
+		}
+		aead, err := s.aead()
+		if err != nil {
+			return nil, err
+		}
+		if len(der) < aead.NonceSize() {
+			return nil, fmt.Errorf("invalid private key")
+		}
+		der, err = aead.Open(nil, der[:aead.NonceSize()], der[aead.NonceSize():], []byte(id))
+		if err != nil {
+			return nil, fmt.Errorf("private key can not be decrypted, check SIGNING_KEY_SECRET")
+		}
+	default:
+		return nil, fmt.Errorf("invalid private key type %s", block.Type)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not rsa")
+	}
+	return rsaKey, nil
+}
+
+// loads the keys from the database, creating the first one if there is no
+// active key
+func (s *keySet) load() error {
+	if err := s.encryptPlainKeys(); err != nil {
+		return err
+	}
+	if err := s.reload(); err != nil {
+		return err
+	}
+	s.RLock()
+	missing := len(s.keys) == 0 || s.keys[0].retired != 0
+	s.RUnlock()
+
+	if missing {
+		return s.rotateIfNoneSince(time.Now(), 0)
+	}
+	return nil
+}
+
+// with a secret, the keys saved in plain PEM before it was set are encrypted
+func (s *keySet) encryptPlainKeys() error {
+	if s.secret == nil {
+		return nil
+	}
+	dbKeys, err := s.store.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, dbKey := range dbKeys {
+		if block, _ := pem.Decode([]byte(dbKey.PrivateKey)); block == nil || block.Type != "PRIVATE KEY" {
+			continue
+		}
+		key, err := s.decodePrivateKey(dbKey.ID, dbKey.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("error decoding signing key %s: %v", dbKey.ID, err)
+		}
+		encoded, err := s.encodePrivateKey(dbKey.ID, key)
+		if err != nil {
+			return err
+		}
+		if err := s.store.SetSigningKeyPrivateKey(dbKey.ID, encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads the keys from the database
+func (s *keySet) reload() error {
+	dbKeys, err := s.store.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	var keys []signingKey
+	for _, dbKey := range dbKeys {
+		key, err := s.decodePrivateKey(dbKey.ID, dbKey.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("error decoding signing key %s: %v", dbKey.ID, err)
+		}
+		keys = append(keys, signingKey{id: dbKey.ID, key: key, created: time.Unix(dbKey.Created, 0), retired: dbKey.Retired})
+	}
+
+	s.Lock()
+	s.keys = keys
+	s.lastReload = time.Now()
+	s.Unlock()
+	return nil
+}
+
+// reloads the keys if they were read more than keyReloadInterval ago, on
+// errors the keys in memory are kept
+func (s *keySet) reloadIfStale() {
+	s.RLock()
+	stale := time.Since(s.lastReload) > keyReloadInterval
+	s.RUnlock()
+	if !stale {
+		return
+	}
+	if err := s.reload(); err != nil {
+		log.Printf("Error reloading the signing keys: %v", err)
+	}
+}
+
+func (s *keySet) current() (signingKey, error) {
+	s.reloadIfStale()
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.keys) == 0 {
+		return signingKey{}, fmt.Errorf("no signing key available")
+	}
+	return s.keys[0], nil
+}
+
+// another instance may have rotated the keys, so an unknown kid reloads them
+// from the database at most once every keyReloadInterval
+func (s *keySet) find(kid string) (signingKey, bool) {
+	s.RLock()
+	for _, key := range s.keys {
+		if key.id == kid {
+			s.RUnlock()
+			return key, true
+		}
+	}
+	canReload := time.Since(s.lastReload) > keyReloadInterval
+	s.RUnlock()
+
+	if canReload && s.reload() == nil {
+		return s.find(kid)
+	}
+	return signingKey{}, false
+}
+
+// RotateSigningKey creates a new key that signs every new token, the old keys
+// are still published and accepted until the tokens they signed expire
+func (svc *Service) RotateSigningKey() error {
+	return svc.signingKeys.rotate()
+}
+
+func (s *keySet) newSigningKey(created time.Time) (database.SigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return database.SigningKey{}, err
+	}
+	id := functions.GenerateUUID()
+	encoded, err := s.encodePrivateKey(id, key)
+	if err != nil {
+		return database.SigningKey{}, err
+	}
+	return database.SigningKey{
+		ID:         id,
+		PrivateKey: encoded,
+		Created:    created.Unix(),
+	}, nil
+}
+
+func (s *keySet) rotate() error {
+	key, err := s.newSigningKey(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := s.store.AddSigningKey(key); err != nil {
+		return err
+	}
+	if err := s.store.RetireSigningKeys(key.ID, key.Created); err != nil {
+		return err
+	}
+	return s.reload()
+}
+
+// adds a new active key created at now unless the database has one created at
+// or after since (unix time), then signs with the newest key of the database, which is
+// the one of another instance if it rotated first
+func (s *keySet) rotateIfNoneSince(now time.Time, since int64) error {
+	key, err := s.newSigningKey(now)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.AddSigningKeyIfNoneSince(key, since); err != nil {
+		return err
+	}
+	return s.reload()
+}
+
+func (svc *Service) SetKeyRotationInterval(interval time.Duration) {
+	svc.keyRotationInterval = interval
+}
+
+// the decision is made from the newest key in the database, so only one of
+// the instances sharing it rotates
+func (svc *Service) rotateSigningKeyIfDue(now time.Time) error {
+	if svc.keyRotationInterval <= 0 {
+		return nil
+	}
+	if err := svc.signingKeys.reload(); err != nil {
+		return err
+	}
+	svc.signingKeys.RLock()
+	due := len(svc.signingKeys.keys) == 0 || svc.signingKeys.keys[0].retired != 0
+	if !due {
+		due = now.Sub(svc.signingKeys.keys[0].created) >= svc.keyRotationInterval
+	}
+	svc.signingKeys.RUnlock()
+
+	if !due {
+		return nil
+	}
+	return svc.signingKeys.rotateIfNoneSince(now, now.Add(-svc.keyRotationInterval).Unix()+1)
+}
+
+// retired keys are deleted once every token they signed has expired
+func (svc *Service) deleteOldSigningKeys(now time.Time) error {
+	maxLifetime := max(svc.sessionConfig.AbsoluteTimeout, svc.sessionConfig.RememberTimeout, svc.sessionConfig.AccessTimeout, svc.emailVerificationTimeout)
+	before := now.Add(-maxLifetime).Unix()
+	err := svc.store.DeleteSigningKeysRetiredBefore(before)
+	if err != nil {
+		return err
+	}
+
+	svc.signingKeys.Lock()
+	var keys []signingKey
+	for _, key := range svc.signingKeys.keys {
+		if key.retired == 0 || key.retired >= before {
+			keys = append(keys, key)
+		}
+	}
+	svc.signingKeys.keys = keys
+	svc.signingKeys.Unlock()
+	return nil
+}
+
+// GetJWKS returns the public keys other services use to verify signed tokens,
+// including the ones added by other instances
+func (svc *Service) GetJWKS() JWKS {
+	svc.signingKeys.reloadIfStale()
+	svc.signingKeys.RLock()
+	defer svc.signingKeys.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range svc.signingKeys.keys {
+		pub := key.key.PublicKey
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kty: "RSA",
+			Kid: key.id,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return jwks
+}
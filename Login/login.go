@@ -1,74 +1,210 @@
 package Login
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"log"
 	"math/big"
 	"net/http"
+	"os"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
+	functions "github.com/Maruqes/Tokenize/Functions"
+	"github.com/Maruqes/Tokenize/Permissions"
 	"github.com/Maruqes/Tokenize/database"
 )
 
 type Login struct {
-	UserID  int
-	Token   string
-	Expires int64
+	ID     string
+	UserID int
+	Token  string
+	// unix times
+	Created  int64
+	LastSeen int64
+	Expires  int64
+	Remember bool
+	// set when the request was authenticated with an API key
+	APIKeyID int
+	// set on sessions created by StartImpersonation, the user acting as UserID
+	// and the session it was logged in with
+	ImpersonatorID        int
+	ImpersonatorSessionID string
+	// the client that logged in, saved by RecordSessionClient
+	IP        string
+	UserAgent string
 }
 
-type LoginStore struct {
-	sync.RWMutex
-	logins map[int]Login
+// the subject to check permissions for, so requests made with an API key
+// are limited to the scope of the key
+func (l Login) Subject() Permissions.Subject {
+	return Permissions.Subject{UserID: l.UserID, APIKeyID: l.APIKeyID}
+}
+
+// the session is expired if it passed its absolute expiration or, when it is
+// not a "remember me" session, if it was idle for too long
+func (l Login) IsExpired(now time.Time, idleTimeout time.Duration) bool {
+	if now.Unix() >= l.Expires {
+		return true
+	}
+	if !l.Remember && idleTimeout > 0 {
+		return now.Sub(time.Unix(l.LastSeen, 0)) >= idleTimeout
+	}
+	return false
 }
 
 const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
-func checkForExpiredLogins() {
-	const expirationDays = 7
+// only write the last seen time once per minute to not hit the store on every request
+const touchInterval = time.Minute
+
+func (svc *Service) checkForExpiredLogins() {
 	const checkInterval = time.Hour
 
 	for {
 		time.Sleep(checkInterval)
-		loginStore.Lock()
-		for id, login := range loginStore.logins {
-			loginTime := time.Unix(login.Expires, 0)
-			if loginTime.Add(time.Hour * 24 * expirationDays).Before(time.Now()) {
-				delete(loginStore.logins, id)
-			}
+		if err := svc.deleteExpiredLogins(time.Now()); err != nil {
+			log.Printf("Error deleting expired logins: %v", err)
+		}
+		if err := svc.store.DeleteExpiredRefreshTokens(time.Now().Unix()); err != nil {
+			log.Printf("Error deleting expired refresh tokens: %v", err)
+		}
+		svc.pendingLogins.deleteExpired(time.Now())
+		svc.webAuthnChallenges.deleteExpired(time.Now())
+		svc.deleteExpiredPasswordResets(time.Now())
+		svc.verificationEmails.deleteExpired(svc.verificationResendInterval, time.Now())
+		svc.deleteExpiredLoginLinks(time.Now())
+		svc.loginThrottles.deleteExpired(svc.throttleConfig.ResetAfter, time.Now())
+		svc.oidcLogins.deleteExpired(time.Now())
+		svc.deleteExpiredOAuthGrants(time.Now())
+		if err := svc.rotateSigningKeyIfDue(time.Now()); err != nil {
+			log.Printf("Error rotating signing key: %v", err)
+		}
+		if err := svc.deleteOldSigningKeys(time.Now()); err != nil {
+			log.Printf("Error deleting old signing keys: %v", err)
 		}
-		loginStore.Unlock()
 	}
 }
 
-func newLoginStore() *LoginStore {
-
-	return &LoginStore{
-		logins: make(map[int]Login),
+func (svc *Service) deleteExpiredLogins(now time.Time) error {
+	var idleBefore int64 = 0
+	if svc.sessionConfig.IdleTimeout > 0 {
+		idleBefore = now.Add(-svc.sessionConfig.IdleTimeout).Unix()
 	}
+	return svc.loginStore.DeleteExpired(now.Unix(), idleBefore)
+}
+
+// Service logs in the users of its store, Tokenize builds one in Initialize
+// and every handler and package that needs sessions gets it from there
+type Service struct {
+	// where users, sessions and credentials are saved
+	store       database.Store
+	permissions *Permissions.Service
+	loginStore  SessionStore
+	customStore bool
+
+	sessionConfig  SessionConfig
+	throttleConfig ThrottleConfig
+	tokenMode      TokenMode
+	// the origin of the app, like "https://example.com", it is the issuer of
+	// the signed tokens and the base of the links in emails. DOMAIN sets it.
+	domain string
+	// the issuer of the authorization server, OAUTH_ISSUER sets it and it
+	// defaults to domain
+	oauthIssuerURL string
+	// how often a new signing key is created, 0 only rotates with RotateSigningKey
+	keyRotationInterval time.Duration
+	// how long a password reset link is valid, PASSWORD_RESET_TIMEOUT changes it
+	passwordResetTimeout time.Duration
+	// how long a verification link is valid, EMAIL_VERIFICATION_TIMEOUT changes it
+	emailVerificationTimeout time.Duration
+	// minimum time between two verification emails to the same address,
+	// EMAIL_VERIFICATION_RESEND_INTERVAL changes it
+	verificationResendInterval time.Duration
+	// REQUIRE_VERIFIED_EMAIL=True stops unverified users from logging in
+	requireVerifiedEmail bool
+	// how long a login link is valid, LOGIN_LINK_TIMEOUT changes it
+	loginLinkTimeout time.Duration
+	// LOGIN_LINK_SAME_BROWSER=True only accepts the link in the browser that
+	// asked for it
+	loginLinkSameBrowser bool
+	// users with this permission can impersonate others, IMPERSONATION_PERMISSION
+	// changes it
+	impersonationPermission string
+	// how long an impersonated session lasts, IMPERSONATION_TIMEOUT changes it
+	impersonationTimeout time.Duration
+	impersonationAllowed *pathSet
+	// NEW_DEVICE_EMAIL=True emails users when they log in from a device they
+	// never used before
+	newDeviceEmail bool
+
+	signingKeys    *keySet
+	oidcProviders  *oidcClientSet
+	oidcHTTPClient *http.Client
+
+	// only in the memory of this process, see "Several instances" in the
+	// README
+	loginThrottles     *loginThrottle
+	pendingLogins      *pendingLoginStore
+	webAuthnChallenges *webAuthnChallengeStore
+	verificationEmails *verificationThrottle
+	oidcLogins         *oidcLoginStore
 }
 
-var loginStore = newLoginStore()
+// New returns a Service with the default configuration, Init reads the env
+// variables that change it and loads the signing keys
+func New(store database.Store, permissions *Permissions.Service) *Service {
+	return &Service{
+		store:       store,
+		permissions: permissions,
+
+		sessionConfig: SessionConfig{
+			AbsoluteTimeout: 7 * 24 * time.Hour,
+			IdleTimeout:     24 * time.Hour,
+			RememberTimeout: 30 * 24 * time.Hour,
+			AccessTimeout:   15 * time.Minute,
+			RefreshTimeout:  30 * 24 * time.Hour,
+		},
+		throttleConfig: ThrottleConfig{
+			MaxFailures:   5,
+			MaxIPFailures: 20,
+			Lockout:       time.Minute,
+			MaxLockout:    time.Hour,
+			ResetAfter:    24 * time.Hour,
+		},
+		tokenMode:                  SessionTokens,
+		keyRotationInterval:        30 * 24 * time.Hour,
+		passwordResetTimeout:       time.Hour,
+		emailVerificationTimeout:   24 * time.Hour,
+		verificationResendInterval: time.Minute,
+		loginLinkTimeout:           15 * time.Minute,
+		impersonationPermission:    "users:impersonate",
+		impersonationTimeout:       time.Hour,
+		impersonationAllowed:       &pathSet{paths: make(map[string]bool)},
 
-func (s *LoginStore) add(login Login) {
-	s.Lock()
-	defer s.Unlock()
-	login.Expires = time.Now().Unix()
-	s.logins[login.UserID] = login
+		signingKeys:        &keySet{store: store},
+		loginThrottles:     &loginThrottle{failures: make(map[string]loginFailures)},
+		pendingLogins:      &pendingLoginStore{logins: make(map[string]pendingLogin)},
+		webAuthnChallenges: &webAuthnChallengeStore{challenges: make(map[string]webAuthnChallenge)},
+		verificationEmails: &verificationThrottle{sent: make(map[string]time.Time)},
+		oidcProviders:      &oidcClientSet{clients: make(map[string]*oidcClient)},
+		oidcHTTPClient:     &http.Client{Timeout: 10 * time.Second},
+		oidcLogins:         &oidcLoginStore{logins: make(map[string]oidcLogin)},
+	}
 }
 
-func (s *LoginStore) get(userID int) (Login, bool) {
-	s.RLock()
-	defer s.RUnlock()
-	login, ok := s.logins[userID]
-	return login, ok
+// changes the origin of the app, call it before Init, which otherwise reads
+// it from DOMAIN
+func (svc *Service) SetDomain(domain string) {
+	svc.domain = domain
 }
 
-func (s *LoginStore) delete(userID int) {
-	s.Lock()
-	defer s.Unlock()
-	delete(s.logins, userID)
+// changes where sessions are saved, call it before Init
+func (svc *Service) SetSessionStore(s SessionStore) {
+	svc.loginStore = s
+	svc.customStore = true
 }
 
 func generateSecureToken(length int) (string, error) {
@@ -84,58 +220,318 @@ func generateSecureToken(length int) (string, error) {
 	return string(token), nil
 }
 
-func LoginUser(email, password string) (string, database.User, error) {
-	usr, err := database.GetUserByEmail(email)
+// identifier is the email or the username of the user
+func (svc *Service) LoginUser(identifier, password string) (string, database.User, error) {
+	return svc.LoginUserContext(context.Background(), identifier, password)
+}
+
+// same as LoginUser but the lookup of the user stops when ctx is done
+func (svc *Service) LoginUserContext(ctx context.Context, identifier, password string) (string, database.User, error) {
+	login, usr, err := svc.LoginUserSessionContext(ctx, identifier, password, false)
+	return login.Token, usr, err
+}
+
+// same as LoginUser but returns the whole session, a "remember me" session
+// uses the RememberTimeout of the session config. Users with 2FA get a
+// TwoFactorRequiredError instead of a session.
+func (svc *Service) LoginUserSession(identifier, password string, remember bool) (Login, database.User, error) {
+	return svc.LoginUserSessionContext(context.Background(), identifier, password, remember)
+}
+
+func (svc *Service) LoginUserSessionContext(ctx context.Context, identifier, password string, remember bool) (Login, database.User, error) {
+	return svc.LoginUserSessionFromIPContext(ctx, identifier, password, remember, "")
+}
+
+// same as LoginUserSession but the failed attempts are also counted for the
+// client IP, see ClientIP
+func (svc *Service) LoginUserSessionFromIP(identifier, password string, remember bool, ip string) (Login, database.User, error) {
+	return svc.LoginUserSessionFromIPContext(context.Background(), identifier, password, remember, ip)
+}
+
+func (svc *Service) LoginUserSessionFromIPContext(ctx context.Context, identifier, password string, remember bool, ip string) (Login, database.User, error) {
+	usr, err := svc.checkCredentials(ctx, identifier, password, ip)
+	if err != nil {
+		return Login{}, usr, err
+	}
+
+	if err := svc.requireTwoFactor(usr, remember, false); err != nil {
+		return Login{}, usr, err
+	}
+
+	session, _, err := svc.finishLogin(usr, remember, false)
+	if err != nil {
+		return Login{}, usr, err
+	}
+	return session, usr, nil
+}
+
+// issues the session of a user that passed every login check, with refresh it
+// is a short lived access session together with a new refresh token. Only
+// now the failed attempts of the account are forgotten, a right password is
+// not enough while the second factor is still being guessed
+func (svc *Service) finishLogin(usr database.User, remember bool, refresh bool) (Login, string, error) {
+	svc.loginThrottles.reset(svc.accountThrottleKey("", usr, nil))
+
+	if refresh {
+		session, err := svc.issueLogin(usr, svc.sessionConfig.AccessTimeout, false)
+		if err != nil {
+			return Login{}, "", err
+		}
+		refreshToken, err := svc.issueRefreshToken(usr.ID, functions.GenerateUUID(), session.ID)
+		if err != nil {
+			return Login{}, "", err
+		}
+		return session, refreshToken, nil
+	}
+
+	lifetime := svc.sessionConfig.AbsoluteTimeout
+	if remember {
+		lifetime = svc.sessionConfig.RememberTimeout
+	}
+	session, err := svc.issueLogin(usr, lifetime, remember)
+	return session, "", err
+}
+
+// locked accounts and IPs are refused before the password is hashed, so
+// guessing also can not be used to keep the CPU busy with bcrypt. A request
+// cancelled while the user is looked up is not counted as a failed attempt
+func (svc *Service) checkCredentials(ctx context.Context, identifier, password, ip string) (database.User, error) {
+	usr, err := svc.store.GetUserByLoginContext(ctx, identifier)
+	if ctx.Err() != nil {
+		return database.User{}, ctx.Err()
+	}
+	accountKey := svc.accountThrottleKey(identifier, usr, err)
+
+	keys := []string{accountKey}
+	if ip != "" {
+		keys = append(keys, ipThrottleKey(ip))
+	}
+	if err := svc.loginThrottles.check(time.Now(), keys...); err != nil {
+		return database.User{}, err
+	}
+
+	if err == nil && !svc.store.CheckUserPasswordContext(ctx, usr.ID, password) {
+		if ctx.Err() != nil {
+			return database.User{}, ctx.Err()
+		}
+		err = fmt.Errorf("invalid password or user")
+	}
 	if err != nil {
-		return "", usr, err
+		now := time.Now()
+		svc.loginThrottles.fail(accountKey, svc.throttleConfig.MaxFailures, svc.throttleConfig, now)
+		if ip != "" {
+			svc.loginThrottles.fail(ipThrottleKey(ip), svc.throttleConfig.MaxIPFailures, svc.throttleConfig, now)
+		}
+		return usr, err
 	}
 
-	login := database.CheckUserPassword(usr.ID, password)
-	if !login {
-		return "", usr, fmt.Errorf("invalid password or user")
+	// the failures of the account are reset by finishLogin and the IP keeps
+	// its failures, otherwise logging in to an own account would let it keep
+	// guessing others
+	return usr, svc.checkEmailVerified(usr)
+}
+
+// creates a stored session or a signed token depending on the token mode
+func (svc *Service) issueLogin(usr database.User, lifetime time.Duration, remember bool) (Login, error) {
+	if svc.tokenMode == SignedTokens {
+		return svc.issueSignedToken(usr, lifetime, remember, 0)
 	}
+	return svc.createSession(usr.ID, lifetime, remember)
+}
+
+func (svc *Service) createSession(userID int, lifetime time.Duration, remember bool) (Login, error) {
+	return svc.storeSession(Login{UserID: userID, Remember: remember}, lifetime)
+}
 
+// gives the session a token and its times and saves it in the session store
+func (svc *Service) storeSession(login Login, lifetime time.Duration) (Login, error) {
 	token, err := generateSecureToken(64)
 	if err != nil {
-		return "", usr, err
+		return Login{}, err
 	}
 
-	loginStore.add(Login{
-		UserID: usr.ID,
-		Token:  token,
-	})
-	return token, usr, nil
+	now := time.Now()
+	login.Token = token
+	login.Created = now.Unix()
+	login.LastSeen = now.Unix()
+	login.Expires = now.Add(lifetime).Unix()
+	return svc.loginStore.Add(login)
 }
 
-func LogoutUser(userID int) {
-	loginStore.delete(userID)
+// logs the user out of every device, signed tokens can not be revoked and
+// stay valid until they expire
+func (svc *Service) LogoutUser(userID int) error {
+	if err := svc.store.RevokeUserRefreshTokens(userID); err != nil {
+		return err
+	}
+	return svc.loginStore.DeleteAll(userID)
 }
 
-func CheckToken(r *http.Request) bool {
-	//get cookies id and token
-	cookie, err := r.Cookie("id")
+// logs out only the session that owns this token
+func (svc *Service) LogoutSession(userID int, token string) error {
+	if svc.tokenMode == SignedTokens {
+		return nil
+	}
+	login, ok := svc.loginStore.Get(token)
+	if !ok || login.UserID != userID {
+		return nil
+	}
+	_, err := svc.loginStore.Delete(userID, login.ID)
+	return err
+}
+
+// revokes one session of the user by its session ID
+func (svc *Service) RevokeSession(userID int, sessionID string) error {
+	deleted, err := svc.loginStore.Delete(userID, sessionID)
 	if err != nil {
-		return false
+		return err
 	}
-	id, err := strconv.Atoi(cookie.Value)
+	if !deleted {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+	return nil
+}
+
+// returns every active session of the user
+func (svc *Service) GetUserSessions(userID int) ([]Login, error) {
+	return svc.loginStore.List(userID)
+}
+
+// returns the token sent in the "Authorization: Bearer" header or, if there
+// is no header, in the token cookie
+func GetTokenWithRequest(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		token = strings.TrimSpace(token)
+		if !ok || token == "" {
+			return "", fmt.Errorf("invalid authorization header")
+		}
+		return token, nil
+	}
+
+	cookie, err := r.Cookie("token")
 	if err != nil {
-		return false
+		return "", err
 	}
-	cookie, err = r.Cookie("token")
+	return cookie.Value, nil
+}
+
+// authenticates the request, cookie logins must also match the id cookie
+func (svc *Service) authenticate(r *http.Request) (Login, bool) {
+	token, err := GetTokenWithRequest(r)
 	if err != nil {
-		return false
+		return Login{}, false
+	}
+
+	// API keys are only accepted in the Authorization header
+	if isAPIKey(token) {
+		if r.Header.Get("Authorization") == "" {
+			return Login{}, false
+		}
+		return svc.verifyAPIKey(token)
+	}
+
+	login, ok := svc.verifyToken(token)
+	if !ok {
+		return Login{}, false
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		cookie, err := r.Cookie("id")
+		if err != nil {
+			return Login{}, false
+		}
+		id, err := strconv.Atoi(cookie.Value)
+		if err != nil || id != login.UserID {
+			return Login{}, false
+		}
+	}
+	if !svc.checkImpersonator(login) {
+		return Login{}, false
+	}
+	return login, true
+}
+
+func (svc *Service) verifyToken(token string) (Login, bool) {
+	if svc.tokenMode == SignedTokens {
+		claims, err := svc.VerifySignedToken(token)
+		if err != nil {
+			return Login{}, false
+		}
+		userID, err := claims.UserID()
+		if err != nil {
+			return Login{}, false
+		}
+		login := Login{
+			ID:       claims.ID,
+			UserID:   userID,
+			Token:    token,
+			Created:  claims.IssuedAt,
+			LastSeen: claims.IssuedAt,
+			Expires:  claims.ExpiresAt,
+			Remember: claims.Remember,
+		}
+		if claims.Actor != nil {
+			// impersonated tokens are also saved as sessions, so stopping
+			// the impersonation revokes them
+			stored, ok := svc.loginStore.Get(token)
+			if !ok || stored.UserID != userID || !svc.checkSession(stored) {
+				return Login{}, false
+			}
+			return stored, true
+		}
+		return login, true
 	}
-	token := cookie.Value
 
 	//check if token is valid
-	login, ok := loginStore.get(id)
-	if !ok || login.Token != token {
+	login, ok := svc.loginStore.Get(token)
+	if !ok || !svc.checkSession(login) {
+		return Login{}, false
+	}
+	return login, true
+}
+
+// accepts the id/token cookies or an "Authorization: Bearer <token>" header
+func (svc *Service) CheckToken(r *http.Request) bool {
+	_, ok := svc.authenticate(r)
+	return ok
+}
+
+// checks the expiration of the session and slides its idle timeout
+func (svc *Service) checkSession(login Login) bool {
+	now := time.Now()
+	if login.IsExpired(now, svc.sessionConfig.IdleTimeout) {
+		svc.loginStore.Delete(login.UserID, login.ID)
 		return false
 	}
+
+	if now.Sub(time.Unix(login.LastSeen, 0)) >= touchInterval {
+		if err := svc.loginStore.Touch(login.ID, now.Unix()); err != nil {
+			log.Printf("Error updating session last seen: %v", err)
+		}
+	}
 	return true
 }
 
-func GetIdWithRequest(r *http.Request) (int, error) {
+// returns the session that authenticated the request
+func (svc *Service) GetLoginWithRequest(r *http.Request) (Login, error) {
+	login, ok := svc.authenticate(r)
+	if !ok {
+		return Login{}, fmt.Errorf("not logged in")
+	}
+	return login, nil
+}
+
+func (svc *Service) GetIdWithRequest(r *http.Request) (int, error) {
+	// bearer tokens carry no id cookie, the id comes from the token itself
+	if r.Header.Get("Authorization") != "" {
+		login, err := svc.GetLoginWithRequest(r)
+		if err != nil {
+			return -1, err
+		}
+		return login.UserID, nil
+	}
+
 	//get cookies id and token
 	cookie, err := r.Cookie("id")
 	if err != nil {
@@ -149,6 +545,53 @@ func GetIdWithRequest(r *http.Request) (int, error) {
 	return id, nil
 }
 
-func Init() {
-	go checkForExpiredLogins()
+// SESSION_STORE=memory keeps the sessions only in memory, by default they are
+// saved in the database so they survive restarts
+// TOKEN_MODE=signed makes LoginUser issue signed tokens instead of sessions
+// REQUIRE_VERIFIED_EMAIL=True only lets users with a verified email log in
+func (svc *Service) Init() {
+	if svc.domain == "" {
+		svc.domain = os.Getenv("DOMAIN")
+	}
+	if issuer := os.Getenv("OAUTH_ISSUER"); issuer != "" {
+		svc.oauthIssuerURL = issuer
+	}
+	svc.loadSessionConfig()
+	svc.loadThrottleConfig()
+	svc.loadOIDCProviders()
+	svc.keyRotationInterval = durationFromEnv("SIGNING_KEY_ROTATION", svc.keyRotationInterval)
+	svc.passwordResetTimeout = durationFromEnv("PASSWORD_RESET_TIMEOUT", svc.passwordResetTimeout)
+	svc.emailVerificationTimeout = durationFromEnv("EMAIL_VERIFICATION_TIMEOUT", svc.emailVerificationTimeout)
+	svc.verificationResendInterval = durationFromEnv("EMAIL_VERIFICATION_RESEND_INTERVAL", svc.verificationResendInterval)
+	if os.Getenv("REQUIRE_VERIFIED_EMAIL") == "True" {
+		svc.requireVerifiedEmail = true
+	}
+	svc.loginLinkTimeout = durationFromEnv("LOGIN_LINK_TIMEOUT", svc.loginLinkTimeout)
+	svc.impersonationTimeout = durationFromEnv("IMPERSONATION_TIMEOUT", svc.impersonationTimeout)
+	if os.Getenv("NEW_DEVICE_EMAIL") == "True" {
+		svc.newDeviceEmail = true
+	}
+	if permission := os.Getenv("IMPERSONATION_PERMISSION"); permission != "" {
+		svc.impersonationPermission = permission
+	}
+	if os.Getenv("LOGIN_LINK_SAME_BROWSER") == "True" {
+		svc.loginLinkSameBrowser = true
+	}
+	if os.Getenv("TOKEN_MODE") == "signed" {
+		svc.tokenMode = SignedTokens
+	}
+	if secret := os.Getenv("SIGNING_KEY_SECRET"); secret != "" && svc.signingKeys.secret == nil {
+		svc.SetSigningKeySecret(secret)
+	}
+	if err := svc.signingKeys.load(); err != nil {
+		log.Fatal(err)
+	}
+	if !svc.customStore {
+		if os.Getenv("SESSION_STORE") == "memory" {
+			svc.loginStore = NewMemoryStore()
+		} else {
+			svc.loginStore = NewDatabaseStore(svc.store)
+		}
+	}
+	go svc.checkForExpiredLogins()
 }
@@ -0,0 +1,223 @@
+package Login
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConcurrentSessions(t *testing.T) {
+	forEachSessionStore(t, func(t *testing.T, svc *Service, userID int) {
+		phone, _, err := svc.LoginUserSession(testEmail, "password", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		laptop, _, err := svc.LoginUserSession(testUsername, "password", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if phone.ID == laptop.ID || phone.Token == laptop.Token {
+			t.Fatal("both logins got the same session")
+		}
+
+		// a new login does not end the other sessions of the user
+		if !isLoggedIn(svc, phone.Token) || !isLoggedIn(svc, laptop.Token) {
+			t.Fatal("a session ended when the user logged in again")
+		}
+		sessions, err := svc.GetUserSessions(userID)
+		if err != nil || len(sessions) != 2 {
+			t.Fatalf("expected 2 sessions, got %d: %v", len(sessions), err)
+		}
+
+		if err := svc.RevokeSession(userID+1, phone.ID); err == nil {
+			t.Fatal("session revoked by another user")
+		}
+		if err := svc.RevokeSession(userID, phone.ID); err != nil {
+			t.Fatal(err)
+		}
+		if isLoggedIn(svc, phone.Token) || !isLoggedIn(svc, laptop.Token) {
+			t.Fatal("revoking a session did not end only that session")
+		}
+
+		if err := svc.LogoutUser(userID); err != nil {
+			t.Fatal(err)
+		}
+		if isLoggedIn(svc, laptop.Token) {
+			t.Fatal("session kept working after logging out of every device")
+		}
+	})
+}
+
+func TestLoginIsExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		login   Login
+		expired bool
+	}{
+		{"active", Login{Expires: now.Add(time.Hour).Unix(), LastSeen: now.Unix()}, false},
+		{"past absolute timeout", Login{Expires: now.Unix(), LastSeen: now.Unix()}, true},
+		{"idle", Login{Expires: now.Add(time.Hour).Unix(), LastSeen: now.Add(-time.Hour).Unix()}, true},
+		{"idle remember me", Login{Expires: now.Add(time.Hour).Unix(), LastSeen: now.Add(-time.Hour).Unix(), Remember: true}, false},
+	}
+	for _, test := range tests {
+		if expired := test.login.IsExpired(now, 30*time.Minute); expired != test.expired {
+			t.Errorf("%s: expired %v, want %v", test.name, expired, test.expired)
+		}
+	}
+	if (Login{Expires: now.Add(time.Hour).Unix()}).IsExpired(now, 0) {
+		t.Error("idle timeout of 0 expired the session")
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	svc, _ := setupTest(t)
+	t.Setenv("SESSION_ABSOLUTE_TIMEOUT", "2h")
+	t.Setenv("SESSION_IDLE_TIMEOUT", "30m")
+	t.Setenv("SESSION_REMEMBER_TIMEOUT", "240h")
+	svc = New(svc.store, svc.permissions)
+	svc.Init()
+
+	config := svc.GetSessionConfig()
+	if config.AbsoluteTimeout != 2*time.Hour || config.IdleTimeout != 30*time.Minute || config.RememberTimeout != 240*time.Hour {
+		t.Fatalf("env did not change the session config: %+v", config)
+	}
+
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Remember || session.Expires != session.Created+int64((2*time.Hour).Seconds()) {
+		t.Fatalf("session does not use the absolute timeout: %+v", session)
+	}
+
+	remembered, _, err := svc.LoginUserSession(testEmail, "password", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remembered.Remember || remembered.Expires != remembered.Created+int64((240*time.Hour).Seconds()) {
+		t.Fatalf("remember me session does not use the remember timeout: %+v", remembered)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	svc, _ := setupTest(t)
+	config := svc.GetSessionConfig()
+	config.IdleTimeout = 30 * time.Minute
+	svc.SetSessionConfig(config)
+
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remembered, _, err := svc.LoginUserSession(testEmail, "password", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// using the session slides its idle timeout
+	idle := time.Now().Add(-20 * time.Minute).Unix()
+	svc.loginStore.Touch(session.ID, idle)
+	if !isLoggedIn(svc, session.Token) {
+		t.Fatal("session expired before its idle timeout")
+	}
+	touched, _ := svc.loginStore.Get(session.Token)
+	if touched.LastSeen <= idle {
+		t.Fatal("using the session did not update its last seen time")
+	}
+
+	idle = time.Now().Add(-time.Hour).Unix()
+	svc.loginStore.Touch(session.ID, idle)
+	svc.loginStore.Touch(remembered.ID, idle)
+	if isLoggedIn(svc, session.Token) {
+		t.Fatal("idle session kept working")
+	}
+	if _, ok := svc.loginStore.Get(session.Token); ok {
+		t.Fatal("idle session was not removed")
+	}
+	if !isLoggedIn(svc, remembered.Token) {
+		t.Fatal("remember me session ended by the idle timeout")
+	}
+}
+
+func TestGetTokenWithRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		token  string
+		ok     bool
+	}{
+		{"bearer", "Bearer abc", "", "abc", true},
+		{"bearer wins over the cookie", "Bearer abc", "def", "abc", true},
+		{"cookie", "", "def", "def", true},
+		{"other scheme", "Basic abc", "def", "", false},
+		{"empty bearer", "Bearer  ", "def", "", false},
+		{"nothing", "", "", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "token", Value: test.cookie})
+		}
+		token, err := GetTokenWithRequest(r)
+		if (err == nil) != test.ok || token != test.token {
+			t.Errorf("%s: got %q, %v", test.name, token, err)
+		}
+	}
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	svc, userID := setupTest(t)
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bearer tokens carry no id cookie
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+session.Token)
+	if !svc.CheckToken(r) {
+		t.Fatal("bearer token did not authenticate")
+	}
+	if id, err := svc.GetIdWithRequest(r); err != nil || id != userID {
+		t.Fatalf("got user %d: %v", id, err)
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if svc.CheckToken(r) {
+		t.Fatal("wrong bearer token authenticated")
+	}
+
+	// cookie logins must also send the id of their user
+	cookieRequest := func(id int, token string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		if id != 0 {
+			r.AddCookie(&http.Cookie{Name: "id", Value: strconv.Itoa(id)})
+		}
+		return r
+	}
+	if !svc.CheckToken(cookieRequest(userID, session.Token)) {
+		t.Fatal("cookie login did not authenticate")
+	}
+	if svc.CheckToken(cookieRequest(0, session.Token)) || svc.CheckToken(cookieRequest(userID+1, session.Token)) {
+		t.Fatal("cookie login authenticated without the id of its user")
+	}
+
+	// API keys only work in the Authorization header
+	key, _, err := svc.CreateAPIKey(userID, "script", time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.CheckToken(cookieRequest(userID, key)) {
+		t.Fatal("API key authenticated from a cookie")
+	}
+	if !isLoggedIn(svc, key) {
+		t.Fatal("API key did not authenticate in the Authorization header")
+	}
+}
@@ -0,0 +1,129 @@
+package Login
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Mail"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+var ErrInvalidLoginLink = errors.New("invalid or expired login link")
+
+func (svc *Service) SetLoginLinkSameBrowser(same bool) {
+	svc.loginLinkSameBrowser = same
+}
+
+// LOGIN_LINK_URL is the page that receives the token as "?token=" and sends
+// it to /login-link, it defaults to DOMAIN/loginLink.html. The link does not
+// point to the endpoint itself so email scanners opening it do not use it.
+func (svc *Service) loginLinkURL(token string) string {
+	base := os.Getenv("LOGIN_LINK_URL")
+	if base == "" {
+		base = strings.TrimSuffix(svc.domain, "/") + "/loginLink.html"
+	}
+
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+// emails a one time login link to the user and returns the secret the
+// browser has to keep (in a cookie) to use the link. Unknown emails also get
+// a secret so the caller can not find out which emails have an account.
+func (svc *Service) RequestLoginLink(email string) (string, error) {
+	browserSecret, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	usr, err := svc.store.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return browserSecret, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	token, err := generateSecureToken(64)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = svc.store.AddLoginLink(database.LoginLink{
+		UserID:      usr.ID,
+		TokenHash:   hashToken(token),
+		BrowserHash: hashToken(browserSecret),
+		Created:     now.Unix(),
+		Expires:     now.Add(svc.loginLinkTimeout).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nUse the link below to log in, it works once and is valid for %d minutes:\n\n%s\n\nIf you did not ask for this you can ignore this email.",
+		usr.Name, int(svc.loginLinkTimeout.Minutes()), svc.loginLinkURL(token))
+	return browserSecret, Mail.Send(usr.Email, "Your login link", body)
+}
+
+// logs in with a login link, the link can only be used once. Opening it
+// proves the user owns the email, so the email is marked as verified. Users
+// with 2FA still get a TwoFactorRequiredError.
+func (svc *Service) LoginWithLink(token, browserSecret string, remember bool, refresh bool) (Login, string, database.User, error) {
+	link, err := svc.store.GetLoginLinkByHash(hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Login{}, "", database.User{}, ErrInvalidLoginLink
+	}
+	if err != nil {
+		return Login{}, "", database.User{}, err
+	}
+
+	now := time.Now()
+	if link.Used != 0 || now.Unix() >= link.Expires {
+		return Login{}, "", database.User{}, ErrInvalidLoginLink
+	}
+	if svc.loginLinkSameBrowser && subtle.ConstantTimeCompare([]byte(hashToken(browserSecret)), []byte(link.BrowserHash)) != 1 {
+		return Login{}, "", database.User{}, ErrInvalidLoginLink
+	}
+	marked, err := svc.store.MarkLoginLinkUsed(link.ID, now.Unix())
+	if err != nil {
+		return Login{}, "", database.User{}, err
+	}
+	if !marked {
+		return Login{}, "", database.User{}, ErrInvalidLoginLink
+	}
+
+	usr, err := svc.store.GetUser(link.UserID)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+	if usr.PendingVerification {
+		if err := svc.store.SetEmailVerified(usr.ID); err != nil {
+			return Login{}, "", usr, err
+		}
+		usr.PendingVerification = false
+	}
+
+	if err := svc.requireTwoFactor(usr, remember, refresh); err != nil {
+		return Login{}, "", usr, err
+	}
+
+	session, refreshToken, err := svc.finishLogin(usr, remember, refresh)
+	return session, refreshToken, usr, err
+}
+
+func (svc *Service) deleteExpiredLoginLinks(now time.Time) {
+	if err := svc.store.DeleteExpiredLoginLinks(now.Unix()); err != nil {
+		log.Printf("Error deleting expired login links: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package Login
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginLink(t *testing.T) {
+	svc, userID := setupTest(t)
+	mailer := captureMail(t)
+	svc.SetRequireVerifiedEmail(true)
+
+	// unknown emails also get a secret and no email
+	secret, err := svc.RequestLoginLink("nobody@tokenize.test")
+	if err != nil || secret == "" || mailer.count() != 0 {
+		t.Fatalf("unknown email was answered differently: %q %v, %d emails", secret, err, mailer.count())
+	}
+
+	secret, err = svc.RequestLoginLink(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(mailer.mails[0].body, testOrigin+"/loginLink.html?token=") {
+		t.Fatalf("email does not link to the login link page: %s", mailer.mails[0].body)
+	}
+	token := mailer.lastToken(t, testEmail)
+
+	if _, _, _, err := svc.LoginWithLink("wrong", secret, false, false); !errors.Is(err, ErrInvalidLoginLink) {
+		t.Fatalf("wrong link logged in: %v", err)
+	}
+
+	// the link proves the user owns the email
+	session, refreshToken, usr, err := svc.LoginWithLink(token, "", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != userID || usr.PendingVerification || refreshToken == "" || !isLoggedIn(svc, session.Token) {
+		t.Fatalf("link did not log in: %+v %q", usr, refreshToken)
+	}
+	if _, _, _, err := svc.LoginWithLink(token, secret, false, false); !errors.Is(err, ErrInvalidLoginLink) {
+		t.Fatalf("link was used twice: %v", err)
+	}
+}
+
+func TestLoginLinkChecks(t *testing.T) {
+	svc, _ := setupTest(t)
+	mailer := captureMail(t)
+
+	// with the same browser option only the browser that asked can use it
+	svc.SetLoginLinkSameBrowser(true)
+	secret, err := svc.RequestLoginLink(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := mailer.lastToken(t, testEmail)
+	if _, _, _, err := svc.LoginWithLink(token, "other browser", false, false); !errors.Is(err, ErrInvalidLoginLink) {
+		t.Fatalf("link worked in another browser: %v", err)
+	}
+	if _, _, _, err := svc.LoginWithLink(token, secret, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.loginLinkTimeout = -time.Minute
+	secret, err = svc.RequestLoginLink(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.LoginWithLink(mailer.lastToken(t, testEmail), secret, false, false); !errors.Is(err, ErrInvalidLoginLink) {
+		t.Fatalf("expired link logged in: %v", err)
+	}
+}
+
+func TestLoginLinkRequiresTwoFactor(t *testing.T) {
+	svc, userID := setupTest(t)
+	enableTwoFactor(t, svc, userID)
+	mailer := captureMail(t)
+
+	secret, err := svc.RequestLoginLink(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = svc.LoginWithLink(mailer.lastToken(t, testEmail), secret, false, false)
+	var twoFactor *TwoFactorRequiredError
+	if !errors.As(err, &twoFactor) {
+		t.Fatalf("login link skipped 2FA: %v", err)
+	}
+}
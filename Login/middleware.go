@@ -0,0 +1,94 @@
+package Login
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/Maruqes/Tokenize/Logs"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	loginContextKey
+	impersonatorContextKey
+)
+
+// authenticates the request once and loads its user
+func (svc *Service) authenticateUser(r *http.Request) (Login, database.User, bool) {
+	login, ok := svc.authenticate(r)
+	if !ok {
+		return Login{}, database.User{}, false
+	}
+	usr, err := svc.store.GetUserContext(r.Context(), login.UserID)
+	if err != nil {
+		return Login{}, database.User{}, false
+	}
+	return login, usr, true
+}
+
+// WithUser returns a copy of ctx carrying the logged in user and its session
+func WithUser(ctx context.Context, login Login, usr database.User) context.Context {
+	ctx = context.WithValue(ctx, loginContextKey, login)
+	return context.WithValue(ctx, userContextKey, usr)
+}
+
+// adds the user and, for impersonated sessions, the real actor to the context
+// of r. Every request of an impersonated session is written to the logs.
+func (svc *Service) withLogin(r *http.Request, login Login, usr database.User) *http.Request {
+	ctx := WithUser(r.Context(), login, usr)
+	if login.ImpersonatorID != 0 {
+		if admin, err := svc.store.GetUser(login.ImpersonatorID); err == nil {
+			ctx = context.WithValue(ctx, impersonatorContextKey, admin)
+		}
+		Logs.LogMessage(r.Method + " " + r.URL.Path + " as user with id " + strconv.Itoa(usr.ID) + " impersonated by user with id " + strconv.Itoa(login.ImpersonatorID))
+	}
+	return r.WithContext(ctx)
+}
+
+// RequireLogin answers 401 to requests that are not logged in, the others
+// reach next with the user in their context (see CurrentUser)
+func (svc *Service) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login, usr, ok := svc.authenticateUser(r)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, svc.withLogin(r, login, usr))
+	})
+}
+
+// OptionalLogin puts the user in the context when the request is logged in
+// and lets every request reach next
+func (svc *Service) OptionalLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if login, usr, ok := svc.authenticateUser(r); ok {
+			r = svc.withLogin(r, login, usr)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CurrentUser returns the user stored by RequireLogin or OptionalLogin
+func CurrentUser(ctx context.Context) (database.User, bool) {
+	usr, ok := ctx.Value(userContextKey).(database.User)
+	return usr, ok
+}
+
+// CurrentLogin returns the session (or API key login) that authenticated the
+// request, stored by RequireLogin or OptionalLogin
+func CurrentLogin(ctx context.Context) (Login, bool) {
+	login, ok := ctx.Value(loginContextKey).(Login)
+	return login, ok
+}
+
+// CurrentImpersonator returns the admin acting as CurrentUser when the request
+// comes from an impersonated session
+func CurrentImpersonator(ctx context.Context) (database.User, bool) {
+	usr, ok := ctx.Value(impersonatorContextKey).(database.User)
+	return usr, ok
+}
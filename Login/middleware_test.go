@@ -0,0 +1,95 @@
+package Login
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// handler that records the user and session it finds in the context
+type contextRecorder struct {
+	called bool
+	usr    database.User
+	login  Login
+	found  bool
+}
+
+func (c *contextRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.called = true
+	c.usr, c.found = CurrentUser(r.Context())
+	c.login, _ = CurrentLogin(r.Context())
+}
+
+func TestRequireLogin(t *testing.T) {
+	svc, userID := setupTest(t)
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := &contextRecorder{}
+	w := httptest.NewRecorder()
+	svc.RequireLogin(next).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusUnauthorized || next.called {
+		t.Fatalf("request without a login got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+session.Token)
+	w = httptest.NewRecorder()
+	svc.RequireLogin(next).ServeHTTP(w, r)
+	if !next.called || !next.found || next.usr.ID != userID || next.login.ID != session.ID {
+		t.Fatalf("user was not put in the context: %+v %+v", next.usr, next.login)
+	}
+
+	// a deleted session stops working right away
+	if err := svc.RevokeSession(userID, session.ID); err != nil {
+		t.Fatal(err)
+	}
+	next = &contextRecorder{}
+	w = httptest.NewRecorder()
+	svc.RequireLogin(next).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || next.called {
+		t.Fatalf("revoked session got %d", w.Code)
+	}
+}
+
+func TestOptionalLogin(t *testing.T) {
+	svc, userID := setupTest(t)
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := &contextRecorder{}
+	svc.OptionalLogin(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !next.called || next.found {
+		t.Fatal("request without a login did not reach the handler without a user")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+session.Token)
+	next = &contextRecorder{}
+	svc.OptionalLogin(next).ServeHTTP(httptest.NewRecorder(), r)
+	if !next.called || !next.found || next.usr.ID != userID {
+		t.Fatal("logged in request did not get its user")
+	}
+}
+
+func TestWithUser(t *testing.T) {
+	if _, ok := CurrentUser(context.Background()); ok {
+		t.Fatal("empty context has a user")
+	}
+	ctx := WithUser(context.Background(), Login{ID: "session"}, database.User{ID: 3})
+	usr, ok := CurrentUser(ctx)
+	login, loginOK := CurrentLogin(ctx)
+	if !ok || !loginOK || usr.ID != 3 || login.ID != "session" {
+		t.Fatalf("got %+v %+v", usr, login)
+	}
+	if _, ok := CurrentImpersonator(ctx); ok {
+		t.Fatal("context has an impersonator")
+	}
+}
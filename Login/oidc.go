@@ -0,0 +1,629 @@
+package Login
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+var (
+	ErrUnknownOIDCProvider = errors.New("unknown OpenID Connect provider")
+	ErrInvalidOIDCState    = errors.New("invalid or expired OpenID Connect login")
+	// the provider did not verify the email, so it is not linked to an
+	// account and no account is created for it
+	ErrOIDCEmailNotVerified = errors.New("email not verified by the provider")
+	// the account with the email never verified it, whoever created it may
+	// not own the email so the identity is not linked to it
+	ErrOIDCAccountNotVerified = errors.New("the account with this email is not verified")
+)
+
+// OIDCProvider is an OpenID Connect provider configured by discovery, so any
+// provider with /.well-known/openid-configuration works
+type OIDCProvider struct {
+	// short name used in the routes and saved with the linked identities
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// defaults to "openid email profile"
+	Scopes []string
+	// where the provider sends the user back, defaults to DOMAIN/oidc-callback
+	RedirectURL string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcClient struct {
+	sync.Mutex
+	provider   OIDCProvider
+	httpClient *http.Client
+	discovery  *oidcDiscovery
+	keys       map[string]crypto.PublicKey
+	keysLoaded time.Time
+}
+
+type oidcClientSet struct {
+	sync.RWMutex
+	clients map[string]*oidcClient
+}
+
+// how long the user has to finish the login at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// adds or replaces a provider, the discovery document is fetched on first use
+func (svc *Service) RegisterOIDCProvider(provider OIDCProvider) error {
+	if provider.Name == "" || provider.Issuer == "" || provider.ClientID == "" {
+		return fmt.Errorf("OpenID Connect provider needs a name, an issuer and a client ID")
+	}
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{"openid", "email", "profile"}
+	}
+	if provider.RedirectURL == "" {
+		provider.RedirectURL = strings.TrimSuffix(svc.domain, "/") + "/oidc-callback"
+	}
+	provider.Issuer = strings.TrimSuffix(provider.Issuer, "/")
+
+	svc.oidcProviders.Lock()
+	defer svc.oidcProviders.Unlock()
+	svc.oidcProviders.clients[provider.Name] = &oidcClient{provider: provider, httpClient: svc.oidcHTTPClient}
+	return nil
+}
+
+// returns the names of the registered providers
+func (svc *Service) OIDCProviders() []string {
+	svc.oidcProviders.RLock()
+	defer svc.oidcProviders.RUnlock()
+	names := []string{}
+	for name := range svc.oidcProviders.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (svc *Service) getOIDCClient(name string) (*oidcClient, error) {
+	svc.oidcProviders.RLock()
+	defer svc.oidcProviders.RUnlock()
+	client, ok := svc.oidcProviders.clients[name]
+	if !ok {
+		return nil, ErrUnknownOIDCProvider
+	}
+	return client, nil
+}
+
+// OIDC_PROVIDERS is a comma separated list of names, each one configured by
+// OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and the
+// optional OIDC_<NAME>_SCOPES (space separated)
+func (svc *Service) loadOIDCProviders() {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		err := svc.RegisterOIDCProvider(OIDCProvider{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		})
+		if err != nil {
+			log.Fatalf("Invalid OpenID Connect provider %s: %v", name, err)
+		}
+	}
+}
+
+func getJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *oidcClient) discover() (*oidcDiscovery, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := getJSON(c.httpClient, c.provider.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != c.provider.Issuer {
+		return nil, fmt.Errorf("discovery issuer %s does not match %s", discovery.Issuer, c.provider.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete discovery document for %s", c.provider.Issuer)
+	}
+	c.discovery = &discovery
+	return c.discovery, nil
+}
+
+// returns the provider key with this kid, the JWKS is fetched again (at most
+// once per minute) when the kid is unknown so provider key rotation works
+func (c *oidcClient) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(c.keysLoaded) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+
+	var jwks JWKS
+	if err := getJSON(c.httpClient, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	c.keys = make(map[string]crypto.PublicKey)
+	c.keysLoaded = time.Now()
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			continue
+		}
+		c.keys[jwk.Kid] = key
+	}
+
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+func parseJWK(jwk JWK) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// the aud claim can be a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// some providers send email_verified as the string "true"
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      audience     `json:"aud"`
+	ExpiresAt     int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+}
+
+// checks the signature (RS256 or ES256) and the standard claims of an ID token
+func (c *oidcClient) verifyIDToken(token, nonce string) (idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return idTokenClaims{}, fmt.Errorf("malformed ID token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("malformed ID token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return idTokenClaims{}, fmt.Errorf("malformed ID token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("malformed ID token signature")
+	}
+
+	key, err := c.key(header.Kid)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) != nil {
+			return idTokenClaims{}, fmt.Errorf("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return idTokenClaims{}, fmt.Errorf("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return idTokenClaims{}, fmt.Errorf("invalid ID token signature")
+		}
+	default:
+		return idTokenClaims{}, fmt.Errorf("unsupported ID token key")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("malformed ID token payload")
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return idTokenClaims{}, fmt.Errorf("malformed ID token payload")
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != c.provider.Issuer {
+		return claims, fmt.Errorf("invalid ID token issuer")
+	}
+	validAudience := false
+	for _, aud := range claims.Audience {
+		if aud == c.provider.ClientID {
+			validAudience = true
+		}
+	}
+	if !validAudience {
+		return claims, fmt.Errorf("invalid ID token audience")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, fmt.Errorf("ID token expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return claims, fmt.Errorf("invalid ID token nonce")
+	}
+	if claims.Subject == "" {
+		return claims, fmt.Errorf("ID token without subject")
+	}
+	return claims, nil
+}
+
+// exchanges the authorization code for the ID token
+func (c *oidcClient) exchangeCode(code, verifier string) (string, error) {
+	discovery, err := c.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.provider.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.provider.ClientID), url.QueryEscape(c.provider.ClientSecret))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token request failed: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response without ID token")
+	}
+	return body.IDToken, nil
+}
+
+type oidcLogin struct {
+	provider string
+	nonce    string
+	verifier string
+	remember bool
+	expires  time.Time
+}
+
+type oidcLoginStore struct {
+	sync.Mutex
+	logins map[string]oidcLogin
+}
+
+// returns and removes the login, a state can only be used once
+func (s *oidcLoginStore) take(state string) (oidcLogin, bool) {
+	s.Lock()
+	defer s.Unlock()
+	login, ok := s.logins[state]
+	delete(s.logins, state)
+	if !ok || time.Now().After(login.expires) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+func (s *oidcLoginStore) deleteExpired(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for state, login := range s.logins {
+		if now.After(login.expires) {
+			delete(s.logins, state)
+		}
+	}
+}
+
+// BeginOIDCLogin returns the URL of the provider to send the user to and the
+// state, the browser has to send the state back (in a cookie) on the callback
+func (svc *Service) BeginOIDCLogin(providerName string, remember bool) (string, string, error) {
+	client, err := svc.getOIDCClient(providerName)
+	if err != nil {
+		return "", "", err
+	}
+	discovery, err := client.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := generateSecureToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := generateSecureToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := generateSecureToken(64)
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	svc.oidcLogins.Lock()
+	svc.oidcLogins.logins[state] = oidcLogin{
+		provider: providerName,
+		nonce:    nonce,
+		verifier: verifier,
+		remember: remember,
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	svc.oidcLogins.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.provider.ClientID},
+		"redirect_uri":          {client.provider.RedirectURL},
+		"scope":                 {strings.Join(client.provider.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// FinishOIDCLogin handles the callback of the provider and logs in the user
+// of the identity like LoginUser. Unknown identities need an email verified
+// by the provider, they are linked to the verified user with the same email
+// or get a new user.
+func (svc *Service) FinishOIDCLogin(state, browserState, code string) (Login, database.User, error) {
+	if subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return Login{}, database.User{}, ErrInvalidOIDCState
+	}
+	login, ok := svc.oidcLogins.take(state)
+	if !ok {
+		return Login{}, database.User{}, ErrInvalidOIDCState
+	}
+	client, err := svc.getOIDCClient(login.provider)
+	if err != nil {
+		return Login{}, database.User{}, err
+	}
+
+	idToken, err := client.exchangeCode(code, login.verifier)
+	if err != nil {
+		return Login{}, database.User{}, err
+	}
+	claims, err := client.verifyIDToken(idToken, login.nonce)
+	if err != nil {
+		return Login{}, database.User{}, err
+	}
+
+	usr, err := svc.userForIdentity(login.provider, claims)
+	if err != nil {
+		return Login{}, usr, err
+	}
+	if err := svc.checkEmailVerified(usr); err != nil {
+		return Login{}, usr, err
+	}
+	if err := svc.requireTwoFactor(usr, login.remember, false); err != nil {
+		return Login{}, usr, err
+	}
+
+	session, _, err := svc.finishLogin(usr, login.remember, false)
+	return session, usr, err
+}
+
+func (svc *Service) userForIdentity(provider string, claims idTokenClaims) (database.User, error) {
+	identity, err := svc.store.GetExternalIdentity(provider, claims.Subject)
+	if err == nil {
+		return svc.store.GetUser(identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, err
+	}
+
+	if claims.Email == "" {
+		return database.User{}, fmt.Errorf("the provider did not return an email")
+	}
+	if !claims.EmailVerified {
+		return database.User{}, ErrOIDCEmailNotVerified
+	}
+	usr, err := svc.store.GetUserByEmail(claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		usr, err = svc.createOIDCUser(claims)
+		if err != nil {
+			return usr, err
+		}
+		// the provider verified the email of the new user
+		if err := svc.store.SetEmailVerified(usr.ID); err != nil {
+			return usr, err
+		}
+		usr.PendingVerification = false
+	} else if err != nil {
+		return usr, err
+	} else if usr.PendingVerification {
+		// someone else may have signed up with the email to take over the
+		// account once its owner logs in with the provider
+		return usr, ErrOIDCAccountNotVerified
+	}
+
+	_, err = svc.store.AddExternalIdentity(database.ExternalIdentity{
+		UserID:   usr.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		Created:  time.Now().Unix(),
+	})
+	return usr, err
+}
+
+// users created by a provider get a random password, they can set one with
+// the password reset
+func (svc *Service) createOIDCUser(claims idTokenClaims) (database.User, error) {
+	password, err := generateSecureToken(64)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	base := claims.Name
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	name := base
+	for i := 0; i < 5; i++ {
+		canBeAdded, err := svc.store.CheckIfCanUserBeAdded(claims.Email, name)
+		if err != nil {
+			return database.User{}, err
+		}
+		if canBeAdded {
+			break
+		}
+		suffix, err := generateSecureToken(4)
+		if err != nil {
+			return database.User{}, err
+		}
+		name = base + "-" + suffix
+	}
+
+	id, err := svc.store.AddUser("", claims.Email, name, password)
+	if err != nil {
+		return database.User{}, err
+	}
+	return svc.store.GetUser(int(id))
+}
+
+func (svc *Service) ListExternalIdentities(userID int) ([]database.ExternalIdentity, error) {
+	return svc.store.GetUserExternalIdentities(userID)
+}
+
+func (svc *Service) UnlinkExternalIdentity(userID int, id int) error {
+	deleted, err := svc.store.DeleteExternalIdentity(userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("identity %d not found", id)
+	}
+	return nil
+}
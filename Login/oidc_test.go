@@ -0,0 +1,251 @@
+package Login
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, JWKS and a token
+// endpoint that checks PKCE and returns an ID token with the next claims
+type mockIdP struct {
+	sync.Mutex
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// code -> PKCE challenge and nonce of the authorization request
+	codes  map[string][2]string
+	claims map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, codes: make(map[string][2]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{{
+			Kty: "RSA",
+			Kid: "mock",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		idp.Lock()
+		request, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		claims := idp.claims
+		idp.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || clientID != "tokenize" || secret != "secret" || base64.RawURLEncoding.EncodeToString(verifier[:]) != request[0] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		payload := map[string]any{
+			"iss":   idp.server.URL,
+			"aud":   "tokenize",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": request[1],
+		}
+		for k, v := range claims {
+			payload[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, payload)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) sign(t *testing.T, payload map[string]any) string {
+	header, _ := json.Marshal(jwtHeader{Alg: "RS256", Typ: "JWT", Kid: "mock"})
+	body, _ := json.Marshal(payload)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	hash := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// follows the authorization URL like the provider would and returns the
+// state and the code it sends back to the callback
+func (idp *mockIdP) authorize(t *testing.T, authURL string, claims map[string]any) (string, string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "tokenize" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	code, err := generateSecureToken(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Lock()
+	idp.codes[code] = [2]string{query.Get("code_challenge"), query.Get("nonce")}
+	idp.claims = claims
+	idp.Unlock()
+	return query.Get("state"), code
+}
+
+func oidcLoginWith(t *testing.T, svc *Service, idp *mockIdP, claims map[string]any) (Login, database.User, error) {
+	authURL, state, err := svc.BeginOIDCLogin("mock", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnedState, code := idp.authorize(t, authURL, claims)
+	return svc.FinishOIDCLogin(returnedState, state, code)
+}
+
+func setupOIDCTest(t *testing.T) (*Service, *mockIdP, int) {
+	svc, userID := setupTest(t)
+	idp := newMockIdP(t)
+	err := svc.RegisterOIDCProvider(OIDCProvider{
+		Name:         "mock",
+		Issuer:       idp.server.URL,
+		ClientID:     "tokenize",
+		ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc, idp, userID
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	svc, idp, _ := setupOIDCTest(t)
+
+	claims := map[string]any{"sub": "new-1", "email": "new@tokenize.test", "email_verified": true, "name": "New User"}
+	session, usr, err := oidcLoginWith(t, svc, idp, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.Email != "new@tokenize.test" || usr.PendingVerification {
+		t.Fatalf("unexpected user %+v", usr)
+	}
+	if login, ok := svc.verifyToken(session.Token); !ok || login.UserID != usr.ID {
+		t.Fatal("OpenID Connect login did not issue a valid session")
+	}
+
+	// the identity is linked, so the same subject logs in to the same user
+	_, again, err := oidcLoginWith(t, svc, idp, map[string]any{"sub": "new-1", "email": "changed@tokenize.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != usr.ID {
+		t.Fatalf("linked identity logged in user %d, want %d", again.ID, usr.ID)
+	}
+}
+
+func TestOIDCRefusesUnverifiedEmail(t *testing.T) {
+	svc, idp, _ := setupOIDCTest(t)
+
+	_, _, err := oidcLoginWith(t, svc, idp, map[string]any{"sub": "new-1", "email": "new@tokenize.test"})
+	if !errors.Is(err, ErrOIDCEmailNotVerified) {
+		t.Fatalf("user created for an unverified email: %v", err)
+	}
+	if _, err := svc.store.GetUserByEmail("new@tokenize.test"); err == nil {
+		t.Fatal("user created for an unverified email")
+	}
+}
+
+func TestOIDCDoesNotLinkPendingAccount(t *testing.T) {
+	svc, idp, userID := setupOIDCTest(t)
+
+	// the account was created with a password and its email never verified,
+	// so the owner of the email may not be the one that knows the password
+	_, _, err := oidcLoginWith(t, svc, idp, map[string]any{"sub": "existing", "email": testEmail, "email_verified": true})
+	if !errors.Is(err, ErrOIDCAccountNotVerified) {
+		t.Fatalf("identity linked to an unverified account: %v", err)
+	}
+	identities, err := svc.ListExternalIdentities(userID)
+	if err != nil || len(identities) != 0 {
+		t.Fatalf("identity linked to an unverified account: %v %+v", err, identities)
+	}
+	usr, err := svc.store.GetUser(userID)
+	if err != nil || !usr.PendingVerification {
+		t.Fatalf("the provider verified the account: %v %+v", err, usr)
+	}
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	svc, idp, userID := setupOIDCTest(t)
+	if err := svc.store.SetEmailVerified(userID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := oidcLoginWith(t, svc, idp, map[string]any{"sub": "existing", "email": testEmail, "email_verified": false})
+	if !errors.Is(err, ErrOIDCEmailNotVerified) {
+		t.Fatalf("unverified email linked to an existing user: %v", err)
+	}
+
+	_, usr, err := oidcLoginWith(t, svc, idp, map[string]any{"sub": "existing", "email": testEmail, "email_verified": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != userID {
+		t.Fatalf("verified email logged in user %d, want %d", usr.ID, userID)
+	}
+	identities, err := svc.ListExternalIdentities(userID)
+	if err != nil || len(identities) != 1 || identities[0].Subject != "existing" {
+		t.Fatalf("identity not linked: %v %+v", err, identities)
+	}
+}
+
+func TestOIDCStateChecks(t *testing.T) {
+	svc, idp, _ := setupOIDCTest(t)
+	claims := map[string]any{"sub": "state", "email": "state@tokenize.test", "email_verified": true}
+
+	authURL, state, err := svc.BeginOIDCLogin("mock", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnedState, code := idp.authorize(t, authURL, claims)
+	if _, _, err := svc.FinishOIDCLogin(returnedState, "other browser", code); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("callback accepted from another browser: %v", err)
+	}
+	if _, _, err := svc.FinishOIDCLogin(returnedState, state, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.FinishOIDCLogin(returnedState, state, code); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("state used twice: %v", err)
+	}
+
+	if _, _, err := svc.BeginOIDCLogin("unknown", false); !errors.Is(err, ErrUnknownOIDCProvider) {
+		t.Fatalf("unknown provider accepted: %v", err)
+	}
+}
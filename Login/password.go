@@ -0,0 +1,118 @@
+package Login
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Mail"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// PASSWORD_RESET_URL is the page that receives the token as "?token=", it
+// defaults to DOMAIN/resetPassword.html
+func (svc *Service) passwordResetURL(token string) string {
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = strings.TrimSuffix(svc.domain, "/") + "/resetPassword.html"
+	}
+
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+// emails a password reset link to the user, unknown emails are ignored so the
+// caller can not find out which emails have an account
+func (svc *Service) RequestPasswordReset(email string) error {
+	usr, err := svc.store.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := generateSecureToken(64)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = svc.store.AddPasswordReset(database.PasswordReset{
+		UserID:    usr.ID,
+		TokenHash: hashToken(token),
+		Created:   now.Unix(),
+		Expires:   now.Add(svc.passwordResetTimeout).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password, it is valid for %d minutes:\n\n%s\n\nIf you did not ask for this you can ignore this email.",
+		usr.Name, int(svc.passwordResetTimeout.Minutes()), svc.passwordResetURL(token))
+	return Mail.Send(usr.Email, "Reset your password", body)
+}
+
+// changes the password of the owner of the token, the token can only be used
+// once and every session of the user is logged out
+func (svc *Service) ResetPassword(token, newPassword string) (database.User, error) {
+	if newPassword == "" {
+		return database.User{}, fmt.Errorf("password can not be empty")
+	}
+
+	reset, err := svc.store.GetPasswordResetByHash(hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, ErrInvalidResetToken
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+
+	now := time.Now()
+	if reset.Used != 0 || now.Unix() >= reset.Expires {
+		return database.User{}, ErrInvalidResetToken
+	}
+	marked, err := svc.store.MarkPasswordResetUsed(reset.ID, now.Unix())
+	if err != nil {
+		return database.User{}, err
+	}
+	if !marked {
+		return database.User{}, ErrInvalidResetToken
+	}
+
+	usr, err := svc.store.GetUser(reset.UserID)
+	if err != nil {
+		return usr, err
+	}
+	if err := svc.store.SetUserPassword(usr.ID, newPassword); err != nil {
+		return usr, err
+	}
+	return usr, svc.LogoutUser(usr.ID)
+}
+
+// changes the password of a logged in user, pending reset links stop working
+func (svc *Service) ChangePassword(userID int, oldPassword, newPassword string) error {
+	if newPassword == "" {
+		return fmt.Errorf("password can not be empty")
+	}
+	if !svc.store.CheckUserPassword(userID, oldPassword) {
+		return fmt.Errorf("invalid password")
+	}
+	return svc.store.SetUserPassword(userID, newPassword)
+}
+
+func (svc *Service) deleteExpiredPasswordResets(now time.Time) {
+	if err := svc.store.DeleteExpiredPasswordResets(now.Unix()); err != nil {
+		log.Printf("Error deleting expired password resets: %v", err)
+	}
+}
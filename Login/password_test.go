@@ -0,0 +1,142 @@
+package Login
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Mail"
+)
+
+type testMail struct {
+	to, subject, body string
+}
+
+// testMailer keeps the emails instead of sending them
+type testMailer struct {
+	sync.Mutex
+	mails []testMail
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.mails = append(m.mails, testMail{to, subject, body})
+	return nil
+}
+
+func (m *testMailer) count() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.mails)
+}
+
+var linkToken = regexp.MustCompile(`token=([^\s&]+)`)
+
+// returns the token of the link in the last email, which must go to "to"
+func (m *testMailer) lastToken(t *testing.T, to string) string {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.mails) == 0 {
+		t.Fatal("no email was sent")
+	}
+	mail := m.mails[len(m.mails)-1]
+	if mail.to != to {
+		t.Fatalf("email sent to %s, want %s", mail.to, to)
+	}
+	match := linkToken.FindStringSubmatch(mail.body)
+	if match == nil {
+		t.Fatalf("no link in the email: %s", mail.body)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func captureMail(t *testing.T) *testMailer {
+	mailer := &testMailer{}
+	Mail.SetMailer(mailer)
+	t.Cleanup(func() { Mail.SetMailer(&Mail.FileMailer{}) })
+	return mailer
+}
+
+func TestPasswordReset(t *testing.T) {
+	svc, _ := setupTest(t)
+	mailer := captureMail(t)
+
+	// unknown emails look the same as known ones to the caller
+	if err := svc.RequestPasswordReset("nobody@tokenize.test"); err != nil || mailer.count() != 0 {
+		t.Fatalf("unknown email was answered differently: %v, %d emails", err, mailer.count())
+	}
+
+	session, _, err := svc.LoginUserSession(testEmail, "password", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RequestPasswordReset("User@Tokenize.test"); err != nil {
+		t.Fatal(err)
+	}
+	token := mailer.lastToken(t, testEmail)
+
+	if _, err := svc.ResetPassword(token, ""); err == nil {
+		t.Fatal("empty password was accepted")
+	}
+	if _, err := svc.ResetPassword("wrong", "new password"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("wrong token was accepted: %v", err)
+	}
+	if _, err := svc.ResetPassword(token, "new password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the token works once and every session is logged out
+	if _, err := svc.ResetPassword(token, "another password"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("token was used twice: %v", err)
+	}
+	if isLoggedIn(svc, session.Token) {
+		t.Fatal("session kept working after the password was reset")
+	}
+	if _, _, err := svc.LoginUserSession(testEmail, "password", false); err == nil {
+		t.Fatal("old password kept working")
+	}
+	if _, _, err := svc.LoginUserSession(testEmail, "new password", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordResetExpires(t *testing.T) {
+	svc, _ := setupTest(t)
+	mailer := captureMail(t)
+
+	svc.passwordResetTimeout = -time.Minute
+	if err := svc.RequestPasswordReset(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ResetPassword(mailer.lastToken(t, testEmail), "new password"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expired token was accepted: %v", err)
+	}
+}
+
+func TestChangePasswordInvalidatesResets(t *testing.T) {
+	svc, userID := setupTest(t)
+	mailer := captureMail(t)
+
+	if err := svc.RequestPasswordReset(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	token := mailer.lastToken(t, testEmail)
+
+	if err := svc.ChangePassword(userID, "wrong", "new password"); err == nil {
+		t.Fatal("password changed without the old one")
+	}
+	if err := svc.ChangePassword(userID, "password", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.ResetPassword(token, "another password"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("reset link kept working after the password changed: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package Login
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	functions "github.com/Maruqes/Tokenize/Functions"
+	"github.com/Maruqes/Tokenize/Logs"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// returned when an already rotated refresh token is used again, the whole
+// family of that token is revoked because one of its tokens was stolen
+var ErrRefreshTokenReused = errors.New("refresh token reused, token family revoked")
+
+// returned when the user of a refresh token was prohibited, the family of
+// the token is revoked
+var ErrUserProhibited = errors.New("user is prohibited")
+
+// LoginUserWithRefresh checks the credentials and returns a short lived access
+// session (AccessTimeout) together with a long lived refresh token. Users with
+// 2FA get a TwoFactorRequiredError instead.
+func (svc *Service) LoginUserWithRefresh(identifier, password string) (Login, string, database.User, error) {
+	return svc.LoginUserWithRefreshContext(context.Background(), identifier, password)
+}
+
+func (svc *Service) LoginUserWithRefreshContext(ctx context.Context, identifier, password string) (Login, string, database.User, error) {
+	return svc.LoginUserWithRefreshFromIPContext(ctx, identifier, password, "")
+}
+
+// same as LoginUserWithRefresh but the failed attempts are also counted for
+// the client IP, see ClientIP
+func (svc *Service) LoginUserWithRefreshFromIP(identifier, password, ip string) (Login, string, database.User, error) {
+	return svc.LoginUserWithRefreshFromIPContext(context.Background(), identifier, password, ip)
+}
+
+func (svc *Service) LoginUserWithRefreshFromIPContext(ctx context.Context, identifier, password, ip string) (Login, string, database.User, error) {
+	usr, err := svc.checkCredentials(ctx, identifier, password, ip)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+
+	if err := svc.requireTwoFactor(usr, false, true); err != nil {
+		return Login{}, "", usr, err
+	}
+
+	session, refreshToken, err := svc.finishLogin(usr, false, true)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+	return session, refreshToken, usr, nil
+}
+
+// sessionID is the access session issued with the token, it is logged out
+// when the family is revoked
+func (svc *Service) issueRefreshToken(userID int, familyID string, sessionID string) (string, error) {
+	token, err := generateSecureToken(64)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = svc.store.AddRefreshToken(database.RefreshToken{
+		ID:        functions.GenerateUUID(),
+		FamilyID:  familyID,
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		Created:   now.Unix(),
+		Expires:   now.Add(svc.sessionConfig.RefreshTimeout).Unix(),
+		SessionID: sessionID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access session and a new
+// refresh token of the same family, the used refresh token stops working. The
+// user is checked again like on login, prohibited users lose the family and
+// users that must verify their email have to do it first.
+func (svc *Service) RefreshSession(refreshToken string) (Login, string, database.User, error) {
+	stored, err := svc.store.GetRefreshTokenByHash(hashToken(refreshToken))
+	if err != nil {
+		return Login{}, "", database.User{}, ErrInvalidRefreshToken
+	}
+	if stored.Revoked || time.Now().Unix() >= stored.Expires {
+		return Login{}, "", database.User{}, ErrInvalidRefreshToken
+	}
+	if stored.Used != 0 {
+		return Login{}, "", database.User{}, svc.refreshTokenReused(stored)
+	}
+
+	usr, err := svc.store.GetUser(stored.UserID)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+	if usr.IsProhibited {
+		if err := svc.revokeRefreshFamily(stored); err != nil {
+			return Login{}, "", usr, err
+		}
+		return Login{}, "", usr, ErrUserProhibited
+	}
+	if err := svc.checkEmailVerified(usr); err != nil {
+		return Login{}, "", usr, err
+	}
+
+	marked, err := svc.store.MarkRefreshTokenUsed(stored.ID, time.Now().Unix())
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+	if !marked {
+		return Login{}, "", database.User{}, svc.refreshTokenReused(stored)
+	}
+
+	session, err := svc.issueLogin(usr, svc.sessionConfig.AccessTimeout, false)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+
+	newRefreshToken, err := svc.issueRefreshToken(usr.ID, stored.FamilyID, session.ID)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+	return session, newRefreshToken, usr, nil
+}
+
+// a rotated token was used again so one of the tokens of the family was
+// stolen, the whole family and its access sessions are revoked
+func (svc *Service) refreshTokenReused(stored database.RefreshToken) error {
+	if err := svc.revokeRefreshFamily(stored); err != nil {
+		return err
+	}
+	Logs.LogMessage("Refresh token reused, revoked token family " + stored.FamilyID + " of user " + strconv.Itoa(stored.UserID))
+	return ErrRefreshTokenReused
+}
+
+// revokes the refresh tokens of the family and logs out the access sessions
+// issued with them, signed tokens can not be revoked and stay valid until
+// they expire
+func (svc *Service) revokeRefreshFamily(stored database.RefreshToken) error {
+	if err := svc.store.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+		return err
+	}
+	if svc.tokenMode == SignedTokens {
+		return nil
+	}
+
+	sessionIDs, err := svc.store.GetRefreshTokenFamilySessions(stored.FamilyID)
+	if err != nil {
+		return err
+	}
+	for _, sessionID := range sessionIDs {
+		if _, err := svc.loginStore.Delete(stored.UserID, sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokes the family of the refresh token, used when logging out
+func (svc *Service) RevokeRefreshToken(refreshToken string) error {
+	stored, err := svc.store.GetRefreshTokenByHash(hashToken(refreshToken))
+	if err != nil {
+		return ErrInvalidRefreshToken
+	}
+	return svc.revokeRefreshFamily(stored)
+}
@@ -0,0 +1,109 @@
+package Login
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRefreshSession(t *testing.T) {
+	svc, userID := setupTest(t)
+
+	session, refreshToken, _, err := svc.LoginUserWithRefresh(testEmail, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshToken == "" || session.Remember {
+		t.Fatalf("expected an access session and a refresh token, got %+v %q", session, refreshToken)
+	}
+
+	newSession, newRefreshToken, usr, err := svc.RefreshSession(refreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != userID || newSession.UserID != userID || newRefreshToken == refreshToken {
+		t.Fatalf("refresh did not rotate the token: %+v %+v", usr, newSession)
+	}
+
+	if _, _, _, err := svc.RefreshSession("unknown"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("unknown refresh token was accepted: %v", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	svc, _ := setupTest(t)
+
+	first, refreshToken, _, err := svc.LoginUserWithRefresh(testEmail, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, newRefreshToken, _, err := svc.RefreshSession(refreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another login of the same user is a different family
+	other, otherRefreshToken, _, err := svc.LoginUserWithRefresh(testEmail, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rotated token was stolen and used again
+	if _, _, _, err := svc.RefreshSession(refreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected the reuse to be detected, got %v", err)
+	}
+	if _, _, _, err := svc.RefreshSession(newRefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("the newest token of the family kept working: %v", err)
+	}
+	for _, session := range []Login{first, second} {
+		if _, ok := svc.loginStore.Get(session.Token); ok {
+			t.Fatal("access session of the revoked family kept working")
+		}
+	}
+
+	if _, ok := svc.loginStore.Get(other.Token); !ok {
+		t.Fatal("access session of another family was revoked")
+	}
+	if _, _, _, err := svc.RefreshSession(otherRefreshToken); err != nil {
+		t.Fatalf("refresh token of another family was revoked: %v", err)
+	}
+}
+
+func TestRefreshChecksUser(t *testing.T) {
+	svc, userID := setupTest(t)
+
+	session, refreshToken, _, err := svc.LoginUserWithRefresh(testEmail, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user must verify the email first, the token keeps working after that
+	svc.SetRequireVerifiedEmail(true)
+	if _, _, _, err := svc.RefreshSession(refreshToken); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("unverified user refreshed the session: %v", err)
+	}
+	if err := svc.store.SetEmailVerified(userID); err != nil {
+		t.Fatal(err)
+	}
+	_, refreshToken, _, err = svc.RefreshSession(refreshToken)
+	if err != nil {
+		t.Fatalf("refresh failed after the email was verified: %v", err)
+	}
+
+	if err := svc.store.ProhibitUser(userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.RefreshSession(refreshToken); !errors.Is(err, ErrUserProhibited) {
+		t.Fatalf("prohibited user refreshed the session: %v", err)
+	}
+	if _, ok := svc.loginStore.Get(session.Token); ok {
+		t.Fatal("access session of a prohibited user kept working")
+	}
+
+	// the family stays revoked once the user is allowed again
+	if err := svc.store.UnprohibitUser(userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.RefreshSession(refreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("revoked family kept working: %v", err)
+	}
+}
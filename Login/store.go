@@ -0,0 +1,219 @@
+package Login
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	functions "github.com/Maruqes/Tokenize/Functions"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// SessionStore is where the sessions created by LoginUser live, the default
+// one is the sqlite "sessions" table so logins survive restarts
+type SessionStore interface {
+	Add(login Login) (Login, error)
+	Get(token string) (Login, bool)
+	List(userID int) ([]Login, error)
+	Delete(userID int, sessionID string) (bool, error)
+	DeleteAll(userID int) error
+	// updates the last time the session was used
+	Touch(sessionID string, lastSeen int64) error
+	// saves the client IP and user agent that logged in
+	SetClient(sessionID, ip, userAgent string) error
+	// removes every session that expired at the unix time now, non "remember me"
+	// sessions last seen before idleBefore are removed too (0 skips that check)
+	DeleteExpired(now int64, idleBefore int64) error
+}
+
+// LoginStore keeps every active session in memory keyed by its token
+type LoginStore struct {
+	sync.RWMutex
+	logins map[string]Login
+}
+
+func NewMemoryStore() *LoginStore {
+	return &LoginStore{
+		logins: make(map[string]Login),
+	}
+}
+
+func (s *LoginStore) Add(login Login) (Login, error) {
+	s.Lock()
+	defer s.Unlock()
+	login.ID = functions.GenerateUUID()
+	s.logins[login.Token] = login
+	return login, nil
+}
+
+func (s *LoginStore) Get(token string) (Login, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	login, ok := s.logins[token]
+	return login, ok
+}
+
+func (s *LoginStore) List(userID int) ([]Login, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var logins []Login
+	for _, login := range s.logins {
+		if login.UserID == userID {
+			logins = append(logins, login)
+		}
+	}
+	return logins, nil
+}
+
+func (s *LoginStore) Delete(userID int, sessionID string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	for token, login := range s.logins {
+		if login.UserID == userID && login.ID == sessionID {
+			delete(s.logins, token)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *LoginStore) DeleteAll(userID int) error {
+	s.Lock()
+	defer s.Unlock()
+	for token, login := range s.logins {
+		if login.UserID == userID {
+			delete(s.logins, token)
+		}
+	}
+	return nil
+}
+
+func (s *LoginStore) Touch(sessionID string, lastSeen int64) error {
+	s.Lock()
+	defer s.Unlock()
+	for token, login := range s.logins {
+		if login.ID == sessionID {
+			login.LastSeen = lastSeen
+			s.logins[token] = login
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *LoginStore) SetClient(sessionID, ip, userAgent string) error {
+	s.Lock()
+	defer s.Unlock()
+	for token, login := range s.logins {
+		if login.ID == sessionID {
+			login.IP = ip
+			login.UserAgent = userAgent
+			s.logins[token] = login
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *LoginStore) DeleteExpired(now int64, idleBefore int64) error {
+	s.Lock()
+	defer s.Unlock()
+	for token, login := range s.logins {
+		if login.Expires <= now || (!login.Remember && login.LastSeen < idleBefore) {
+			delete(s.logins, token)
+		}
+	}
+	return nil
+}
+
+// DatabaseStore keeps the sessions in the sqlite database, only a hash of the
+// token is saved so a leaked database can not be used to log in
+type DatabaseStore struct {
+	store database.SessionStore
+}
+
+func NewDatabaseStore(store database.SessionStore) *DatabaseStore {
+	return &DatabaseStore{store: store}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionToLogin(session database.Session) Login {
+	return Login{
+		ID:       session.ID,
+		UserID:   session.UserID,
+		Created:  session.Created,
+		LastSeen: session.LastSeen,
+		Expires:  session.Expires,
+		Remember: session.Remember,
+
+		ImpersonatorID:        session.ImpersonatorID,
+		ImpersonatorSessionID: session.ImpersonatorSessionID,
+		IP:                    session.IP,
+		UserAgent:             session.UserAgent,
+	}
+}
+
+func (s *DatabaseStore) Add(login Login) (Login, error) {
+	login.ID = functions.GenerateUUID()
+	err := s.store.AddSession(database.Session{
+		ID:        login.ID,
+		UserID:    login.UserID,
+		TokenHash: hashToken(login.Token),
+		Created:   login.Created,
+		LastSeen:  login.LastSeen,
+		Expires:   login.Expires,
+		Remember:  login.Remember,
+
+		ImpersonatorID:        login.ImpersonatorID,
+		ImpersonatorSessionID: login.ImpersonatorSessionID,
+		IP:                    login.IP,
+		UserAgent:             login.UserAgent,
+	})
+	return login, err
+}
+
+func (s *DatabaseStore) Get(token string) (Login, bool) {
+	session, err := s.store.GetSessionByTokenHash(hashToken(token))
+	if err != nil {
+		return Login{}, false
+	}
+	login := sessionToLogin(session)
+	login.Token = token
+	return login, true
+}
+
+func (s *DatabaseStore) List(userID int) ([]Login, error) {
+	sessions, err := s.store.GetUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	var logins []Login
+	for _, session := range sessions {
+		logins = append(logins, sessionToLogin(session))
+	}
+	return logins, nil
+}
+
+func (s *DatabaseStore) Delete(userID int, sessionID string) (bool, error) {
+	return s.store.DeleteSession(userID, sessionID)
+}
+
+func (s *DatabaseStore) DeleteAll(userID int) error {
+	return s.store.DeleteUserSessions(userID)
+}
+
+func (s *DatabaseStore) Touch(sessionID string, lastSeen int64) error {
+	return s.store.TouchSession(sessionID, lastSeen)
+}
+
+func (s *DatabaseStore) SetClient(sessionID, ip, userAgent string) error {
+	return s.store.SetSessionClient(sessionID, ip, userAgent)
+}
+
+func (s *DatabaseStore) DeleteExpired(now int64, idleBefore int64) error {
+	return s.store.DeleteExpiredSessions(now, idleBefore)
+}
@@ -0,0 +1,54 @@
+package Login
+
+import (
+	"testing"
+)
+
+// runs the test with the memory store and with the database store
+func forEachSessionStore(t *testing.T, test func(t *testing.T, svc *Service, userID int)) {
+	t.Run("memory", func(t *testing.T) {
+		svc, userID := setupTest(t)
+		test(t, svc, userID)
+	})
+	t.Run("database", func(t *testing.T) {
+		svc, userID := setupTest(t)
+		svc.SetSessionStore(NewDatabaseStore(svc.store))
+		test(t, svc, userID)
+	})
+}
+
+func TestDatabaseStoreSurvivesRestart(t *testing.T) {
+	svc, userID := setupTest(t)
+	t.Setenv("SESSION_STORE", "")
+	svc = New(svc.store, svc.permissions)
+	svc.Init()
+
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the hash of the token is saved
+	if _, err := svc.store.GetSessionByTokenHash(session.Token); err == nil {
+		t.Fatal("the token was saved as it is")
+	}
+	stored, err := svc.store.GetSessionByTokenHash(hashToken(session.Token))
+	if err != nil || stored.UserID != userID || stored.ID != session.ID {
+		t.Fatalf("session was not saved: %+v %v", stored, err)
+	}
+
+	restarted := New(svc.store, svc.permissions)
+	restarted.Init()
+	if !isLoggedIn(restarted, session.Token) {
+		t.Fatal("session did not survive a restart")
+	}
+
+	// expired sessions are removed from the database
+	store := NewDatabaseStore(svc.store)
+	if err := store.DeleteExpired(session.Expires, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get(session.Token); ok {
+		t.Fatal("expired session was kept")
+	}
+}
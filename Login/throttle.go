@@ -0,0 +1,144 @@
+package Login
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Logs"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// LoginLockedError is returned while an email or client IP is locked after
+// too many failed logins
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type loginThrottle struct {
+	sync.Mutex
+	failures map[string]loginFailures
+}
+
+// failures are counted per account, so the email and the username of a user
+// share them. Identifiers without an account are counted by their own.
+func (svc *Service) accountThrottleKey(identifier string, usr database.User, lookupErr error) string {
+	if lookupErr == nil {
+		return "user:" + strconv.Itoa(usr.ID)
+	}
+	if strings.Contains(identifier, "@") {
+		return "email:" + svc.store.EmailKey(identifier)
+	}
+	return "name:" + strings.ToLower(strings.TrimSpace(identifier))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// returns a LoginLockedError if any of the keys is locked
+func (t *loginThrottle) check(now time.Time, keys ...string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		failures, ok := t.failures[key]
+		if ok && now.Before(failures.lockedUntil) {
+			retryAfter = max(retryAfter, failures.lockedUntil.Sub(now))
+		}
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// counts a failed login, once the key reaches its limit it is locked and every
+// failure after that doubles the lockout
+func (t *loginThrottle) fail(key string, limit int, config ThrottleConfig, now time.Time) {
+	if limit <= 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	failures := t.failures[key]
+	if now.Sub(failures.lastFailure) >= config.ResetAfter {
+		failures = loginFailures{}
+	}
+	failures.count++
+	failures.lastFailure = now
+
+	if failures.count >= limit {
+		lockout := config.Lockout
+		for i := limit; i < failures.count && lockout < config.MaxLockout; i++ {
+			lockout *= 2
+		}
+		lockout = min(lockout, config.MaxLockout)
+		failures.lockedUntil = now.Add(lockout)
+		Logs.LogMessage(fmt.Sprintf("Login locked for %s after %d failed attempts, for %s", key, failures.count, lockout))
+	}
+	t.failures[key] = failures
+}
+
+func (t *loginThrottle) reset(key string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.failures, key)
+}
+
+func (t *loginThrottle) deleteExpired(resetAfter time.Duration, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for key, failures := range t.failures {
+		if now.After(failures.lockedUntil) && now.Sub(failures.lastFailure) >= resetAfter {
+			delete(t.failures, key)
+		}
+	}
+}
+
+// UnlockLogin removes the lockout and the failed attempts of an account, by
+// its email or username
+func (svc *Service) UnlockLogin(identifier string) {
+	usr, err := svc.store.GetUserByLogin(identifier)
+	svc.loginThrottles.reset(svc.accountThrottleKey(identifier, usr, err))
+}
+
+// UnlockIP removes the lockout and the failed attempts of a client IP
+func (svc *Service) UnlockIP(ip string) {
+	svc.loginThrottles.reset(ipThrottleKey(ip))
+}
+
+// returns the IP of the client, with TRUST_PROXY=True it is the last address
+// of X-Forwarded-For (the one added by the proxy in front of Tokenize)
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "True" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
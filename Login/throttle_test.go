@@ -0,0 +1,133 @@
+package Login
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+func TestLoginThrottleLockout(t *testing.T) {
+	config := ThrottleConfig{Lockout: time.Minute, MaxLockout: 5 * time.Minute, ResetAfter: time.Hour}
+	throttle := &loginThrottle{failures: make(map[string]loginFailures)}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		throttle.fail("key", 3, config, now)
+	}
+	if err := throttle.check(now, "key"); err != nil {
+		t.Fatalf("locked before the limit: %v", err)
+	}
+
+	// every failure after the limit doubles the lockout, up to MaxLockout
+	for _, lockout := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		throttle.fail("key", 3, config, now)
+		var locked *LoginLockedError
+		if err := throttle.check(now, "other", "key"); !errors.As(err, &locked) || locked.RetryAfter != lockout {
+			t.Fatalf("expected a lockout of %s, got %v", lockout, err)
+		}
+	}
+	if err := throttle.check(now.Add(6*time.Minute), "key"); err != nil {
+		t.Fatalf("still locked after the lockout: %v", err)
+	}
+
+	// failures are forgotten after ResetAfter without new ones
+	throttle.fail("key", 3, config, now.Add(2*time.Hour))
+	if err := throttle.check(now.Add(2*time.Hour), "key"); err != nil {
+		t.Fatalf("old failures were counted: %v", err)
+	}
+	throttle.deleteExpired(config.ResetAfter, now.Add(4*time.Hour))
+	if len(throttle.failures) != 0 {
+		t.Fatal("expired failures were kept")
+	}
+
+	throttle.fail("disabled", 0, config, now)
+	if len(throttle.failures) != 0 {
+		t.Fatal("a limit of 0 counted the failure")
+	}
+}
+
+func TestAccountThrottleKey(t *testing.T) {
+	svc, _ := setupTest(t)
+	usr := database.User{ID: 7}
+	if svc.accountThrottleKey("a@b.test", usr, nil) != svc.accountThrottleKey("name", usr, nil) {
+		t.Fatal("email and username of a user do not share their failures")
+	}
+	lookupErr := errors.New("not found")
+	if svc.accountThrottleKey("Nobody@Tokenize.test", usr, lookupErr) != svc.accountThrottleKey("nobody@tokenize.test", usr, lookupErr) {
+		t.Fatal("unknown emails are not compared by their key")
+	}
+	if svc.accountThrottleKey(" Nobody ", usr, lookupErr) != svc.accountThrottleKey("nobody", usr, lookupErr) {
+		t.Fatal("unknown usernames are not compared ignoring case")
+	}
+}
+
+func TestLoginLocksAccount(t *testing.T) {
+	svc, _ := setupTest(t)
+	svc.SetThrottleConfig(ThrottleConfig{MaxFailures: 3, MaxIPFailures: 100, Lockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour})
+
+	// the email and the username count together
+	for _, identifier := range []string{testEmail, testUsername, "USER@tokenize.test"} {
+		if _, _, err := svc.LoginUserSession(identifier, "wrong", false); err == nil {
+			t.Fatal("wrong password logged in")
+		}
+	}
+	var locked *LoginLockedError
+	if _, _, err := svc.LoginUserSession(testUsername, "password", false); !errors.As(err, &locked) {
+		t.Fatalf("locked account logged in: %v", err)
+	}
+
+	svc.UnlockLogin(testEmail)
+	if _, _, err := svc.LoginUserSession(testUsername, "password", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginLocksIP(t *testing.T) {
+	svc, _ := setupTest(t)
+	svc.SetThrottleConfig(ThrottleConfig{MaxFailures: 100, MaxIPFailures: 3, Lockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour})
+
+	// guessing many accounts from one IP locks the IP
+	for _, identifier := range []string{"a@tokenize.test", "b@tokenize.test"} {
+		if _, _, err := svc.LoginUserSessionFromIP(identifier, "wrong", false, "10.0.0.1"); err == nil {
+			t.Fatal("unknown user logged in")
+		}
+	}
+
+	// logging in to an own account does not give the IP more guesses
+	if _, _, err := svc.LoginUserSessionFromIP(testUsername, "password", false, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.LoginUserSessionFromIP("c@tokenize.test", "wrong", false, "10.0.0.1"); err == nil {
+		t.Fatal("unknown user logged in")
+	}
+
+	var locked *LoginLockedError
+	if _, _, err := svc.LoginUserSessionFromIP(testUsername, "password", false, "10.0.0.1"); !errors.As(err, &locked) {
+		t.Fatalf("locked IP logged in: %v", err)
+	}
+	if _, _, err := svc.LoginUserSessionFromIP(testUsername, "password", false, "10.0.0.2"); err != nil {
+		t.Fatalf("another IP was locked: %v", err)
+	}
+
+	svc.UnlockIP("10.0.0.1")
+	if _, _, err := svc.LoginUserSessionFromIP(testUsername, "password", false, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	if ip := ClientIP(r); ip != "192.0.2.1" {
+		t.Fatalf("X-Forwarded-For was trusted without a proxy: %s", ip)
+	}
+	t.Setenv("TRUST_PROXY", "True")
+	if ip := ClientIP(r); ip != "198.51.100.7" {
+		t.Fatalf("expected the address added by the proxy, got %s", ip)
+	}
+}
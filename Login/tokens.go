@@ -0,0 +1,196 @@
+package Login
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	functions "github.com/Maruqes/Tokenize/Functions"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+type TokenMode int
+
+const (
+	// sessions are saved in the SessionStore and checked on every request
+	SessionTokens TokenMode = iota
+	// LoginUser issues signed tokens that any service can verify with the JWKS
+	SignedTokens
+)
+
+func (svc *Service) SetTokenMode(mode TokenMode) {
+	svc.tokenMode = mode
+}
+
+func (svc *Service) GetTokenMode() TokenMode {
+	return svc.tokenMode
+}
+
+// Claims are carried by the signed tokens issued in SignedTokens mode
+type Claims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	// empty in login tokens, the other tokens signed with the same keys
+	// (like email verification links) always have one
+	Audience  string `json:"aud,omitempty"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Remember  bool   `json:"remember,omitempty"`
+	// the user acting as the subject in an impersonated session
+	Actor *Actor `json:"act,omitempty"`
+
+	Active     bool `json:"active"`
+	Prohibited bool `json:"prohibited"`
+	// the permission strings of the user, the ones HasPermission checks
+	Permissions []string `json:"permissions"`
+}
+
+// Actor is the "act" claim of RFC 8693
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+func (c Claims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+func (svc *Service) signJWT(claims any) (string, error) {
+	key, err := svc.signingKeys.current()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Typ: "JWT", Kid: key.id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// checks the signature and decodes the payload into claims, the caller checks
+// the expiration since every kind of token keeps it in its own claims
+func (svc *Service) verifyJWT(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("malformed token header")
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported token algorithm %s", header.Alg)
+	}
+
+	key, ok := svc.signingKeys.find(header.Kid)
+	if !ok {
+		return fmt.Errorf("unknown signing key %s", header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		return fmt.Errorf("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token payload")
+	}
+	return json.Unmarshal(payload, claims)
+}
+
+// impersonatorID is 0 unless the token is for an impersonated session
+func (svc *Service) issueSignedToken(usr database.User, lifetime time.Duration, remember bool, impersonatorID int) (Login, error) {
+	perms, err := svc.permissions.GetUserPermissions(usr.ID)
+	if err != nil {
+		return Login{}, err
+	}
+	names := []string{}
+	for _, perm := range perms {
+		names = append(names, perm.Permission)
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Issuer:      svc.domain,
+		Subject:     strconv.Itoa(usr.ID),
+		ID:          functions.GenerateUUID(),
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   now.Add(lifetime).Unix(),
+		Remember:    remember,
+		Active:      usr.IsActive,
+		Prohibited:  usr.IsProhibited,
+		Permissions: names,
+	}
+	if impersonatorID != 0 {
+		claims.Actor = &Actor{Subject: strconv.Itoa(impersonatorID)}
+	}
+	token, err := svc.signJWT(claims)
+	if err != nil {
+		return Login{}, err
+	}
+
+	return Login{
+		ID:       claims.ID,
+		UserID:   usr.ID,
+		Token:    token,
+		Created:  claims.IssuedAt,
+		LastSeen: claims.IssuedAt,
+		Expires:  claims.ExpiresAt,
+		Remember: remember,
+
+		ImpersonatorID: impersonatorID,
+	}, nil
+}
+
+// VerifySignedToken checks a token issued in SignedTokens mode and returns its claims
+func (svc *Service) VerifySignedToken(token string) (Claims, error) {
+	var claims Claims
+	if err := svc.verifyJWT(token, &claims); err != nil {
+		return Claims{}, err
+	}
+	if claims.Issuer != svc.domain {
+		return Claims{}, fmt.Errorf("invalid token issuer")
+	}
+	if claims.Audience != "" {
+		return Claims{}, fmt.Errorf("not a login token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, fmt.Errorf("token expired")
+	}
+	return claims, nil
+}
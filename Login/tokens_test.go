@@ -0,0 +1,241 @@
+package Login
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tokenKid(t *testing.T, token string) string {
+	headerJSON, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header.Kid
+}
+
+// checks the token like another service would, with the JWKS
+func verifyWithJWKS(t *testing.T, jwks JWKS, token string) bool {
+	parts := strings.Split(token, ".")
+	kid := tokenKid(t, token)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kid != kid {
+			continue
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
+
+func TestSignedTokens(t *testing.T) {
+	svc, userID := setupTest(t)
+	svc.SetTokenMode(SignedTokens)
+
+	session, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := svc.VerifySignedToken(session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != strconv.Itoa(userID) || claims.Issuer != testOrigin || claims.ExpiresAt != session.Expires {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+	if !isLoggedIn(svc, session.Token) {
+		t.Fatal("signed token did not log in")
+	}
+	if !verifyWithJWKS(t, svc.GetJWKS(), session.Token) {
+		t.Fatal("token can not be checked with the JWKS")
+	}
+
+	parts := strings.Split(session.Token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	forged := strings.Replace(string(payload), `"sub":"`+claims.Subject+`"`, `"sub":"`+strconv.Itoa(userID+1)+`"`, 1)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + parts[2]
+	if _, err := svc.VerifySignedToken(tampered); err == nil {
+		t.Fatal("tampered token was accepted")
+	}
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	if _, err := svc.VerifySignedToken(none + "." + parts[1] + "."); err == nil {
+		t.Fatal("unsigned token was accepted")
+	}
+
+	claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expired, err := svc.signJWT(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.VerifySignedToken(expired); err == nil {
+		t.Fatal("expired token was accepted")
+	}
+
+	// the issuer is the domain of the service, not of the process
+	other := New(svc.store, svc.permissions)
+	other.SetDomain("https://other.tokenize.test")
+	other.Init()
+	if _, err := other.VerifySignedToken(session.Token); err == nil {
+		t.Fatal("token of another domain was accepted")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	svc, _ := setupTest(t)
+	svc.SetTokenMode(SignedTokens)
+
+	before, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	after, _, err := svc.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenKid(t, before.Token) == tokenKid(t, after.Token) {
+		t.Fatal("the new key did not sign the new token")
+	}
+
+	// the retired key keeps verifying the tokens it signed
+	jwks := svc.GetJWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != tokenKid(t, after.Token) {
+		t.Fatalf("expected the new and the retired key, got %+v", jwks.Keys)
+	}
+	for _, session := range []Login{before, after} {
+		if _, err := svc.VerifySignedToken(session.Token); err != nil {
+			t.Fatal(err)
+		}
+		if !verifyWithJWKS(t, jwks, session.Token) {
+			t.Fatal("token can not be checked with the JWKS")
+		}
+	}
+
+	// the keys are shared with other instances through the database
+	other := New(svc.store, svc.permissions)
+	other.Init()
+	if _, err := other.VerifySignedToken(after.Token); err != nil {
+		t.Fatalf("another instance did not accept the token: %v", err)
+	}
+
+	// once every token of the retired key expired the key is deleted
+	if err := svc.deleteOldSigningKeys(time.Now().Add(svc.sessionConfig.RememberTimeout + time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.VerifySignedToken(before.Token); err == nil {
+		t.Fatal("token of a deleted key was accepted")
+	}
+	if _, err := svc.VerifySignedToken(after.Token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSigningKeyRotationAcrossInstances(t *testing.T) {
+	svc, _ := setupTest(t)
+	svc.SetTokenMode(SignedTokens)
+	other := New(svc.store, svc.permissions)
+	other.Init()
+	other.SetTokenMode(SignedTokens)
+
+	// both instances find the key due, only the first one rotates it
+	later := time.Now().Add(svc.keyRotationInterval + time.Hour)
+	if err := svc.rotateSigningKeyIfDue(later); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.rotateSigningKeyIfDue(later); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := svc.store.GetSigningKeys()
+	if err != nil || len(keys) != 2 || keys[1].Retired == 0 {
+		t.Fatalf("expected one active and one retired key, got %d: %v", len(keys), err)
+	}
+
+	// the other instance signs with the new key and publishes it
+	session, _, err := other.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenKid(t, session.Token) != keys[0].ID {
+		t.Fatal("the other instance did not sign with the new key")
+	}
+	if !verifyWithJWKS(t, other.GetJWKS(), session.Token) || !verifyWithJWKS(t, svc.GetJWKS(), session.Token) {
+		t.Fatal("the new key is missing from the JWKS")
+	}
+
+	// keys added by another instance are published once the keys are reloaded
+	if err := svc.RotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	other.signingKeys.lastReload = time.Time{}
+	if jwks := other.GetJWKS(); len(jwks.Keys) != 3 {
+		t.Fatalf("the JWKS has %d keys, want 3", len(jwks.Keys))
+	}
+}
+
+func TestSigningKeySecret(t *testing.T) {
+	svc, _ := setupTest(t)
+	svc.SetTokenMode(SignedTokens)
+
+	// the key saved in plain PEM before the secret was set is encrypted
+	other := New(svc.store, svc.permissions)
+	other.SetSigningKeySecret("secret")
+	other.Init()
+	other.SetTokenMode(SignedTokens)
+	if err := other.RotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := svc.store.GetSigningKeys()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d: %v", len(keys), err)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key.PrivateKey, "-----BEGIN "+encryptedKeyType+"-----") {
+			t.Fatalf("key %s is not encrypted", key.ID)
+		}
+	}
+
+	session, _, err := other.LoginUserSession(testEmail, "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := New(svc.store, svc.permissions)
+	same.SetSigningKeySecret("secret")
+	same.Init()
+	if _, err := same.VerifySignedToken(session.Token); err != nil {
+		t.Fatalf("an instance with the same secret did not accept the token: %v", err)
+	}
+
+	for _, secret := range []string{"", "wrong"} {
+		keySet := &keySet{store: svc.store}
+		if secret != "" {
+			hash := sha256.Sum256([]byte(secret))
+			keySet.secret = hash[:]
+		}
+		if err := keySet.reload(); err == nil {
+			t.Fatalf("keys were read with the secret %q", secret)
+		}
+	}
+
+	// an encrypted key only decrypts under its own ID
+	if _, err := other.signingKeys.decodePrivateKey(keys[1].ID, keys[0].PrivateKey); err == nil {
+		t.Fatal("a key was decrypted under another ID")
+	}
+}
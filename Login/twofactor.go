@@ -0,0 +1,320 @@
+package Login
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// RFC 6238 defaults, every authenticator app supports them
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes of the previous and next period are accepted for clock drift
+	totpSkew = 1
+
+	recoveryCodesCount = 10
+
+	pendingLoginTimeout     = 5 * time.Minute
+	pendingLoginMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var ErrInvalidTwoFactorCode = errors.New("invalid two factor code")
+
+// TwoFactorRequiredError is returned by the login functions when the password
+// was right but the user has 2FA enabled, the login finishes by sending the
+// PendingToken and a code to VerifyTwoFactorLogin
+type TwoFactorRequiredError struct {
+	PendingToken string
+	// "totp" and/or "passkey", the second factors the user can use
+	Methods []string
+}
+
+func (e *TwoFactorRequiredError) Error() string {
+	return "two factor authentication required"
+}
+
+type pendingLogin struct {
+	userID   int
+	remember bool
+	refresh  bool
+	expires  time.Time
+	attempts int
+}
+
+type pendingLoginStore struct {
+	sync.Mutex
+	logins map[string]pendingLogin
+}
+
+func (s *pendingLoginStore) get(token string) (pendingLogin, bool) {
+	s.Lock()
+	defer s.Unlock()
+	pending, ok := s.logins[token]
+	if !ok || time.Now().After(pending.expires) {
+		return pendingLogin{}, false
+	}
+	return pending, true
+}
+
+func (s *pendingLoginStore) delete(token string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.logins, token)
+}
+
+func (s *pendingLoginStore) deleteExpired(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for token, pending := range s.logins {
+		if now.After(pending.expires) {
+			delete(s.logins, token)
+		}
+	}
+}
+
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func (svc *Service) IsTwoFactorEnabled(userID int) bool {
+	totp, err := svc.store.GetTOTP(userID)
+	return err == nil && totp.Enabled
+}
+
+// EnrollTwoFactor creates a new TOTP secret and returns the otpauth URI for
+// authenticator apps, 2FA is only enabled after ConfirmTwoFactor
+func (svc *Service) EnrollTwoFactor(userID int) (string, error) {
+	usr, err := svc.store.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if svc.IsTwoFactorEnabled(userID) {
+		return "", fmt.Errorf("two factor authentication is already enabled")
+	}
+
+	secretBytes := make([]byte, 20)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", err
+	}
+	secret := totpEncoding.EncodeToString(secretBytes)
+
+	if err := svc.store.SetTOTPSecret(userID, secret); err != nil {
+		return "", err
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Tokenize"
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + usr.Email,
+		RawQuery: query.Encode(),
+	}
+	return uri.String(), nil
+}
+
+// ConfirmTwoFactor enables 2FA if the code matches the enrolled secret and
+// returns the one time recovery codes, they are only shown this time
+func (svc *Service) ConfirmTwoFactor(userID int, code string) ([]string, error) {
+	totp, err := svc.store.GetTOTP(userID)
+	if err != nil {
+		return nil, fmt.Errorf("two factor authentication is not enrolled")
+	}
+	if totp.Enabled {
+		return nil, fmt.Errorf("two factor authentication is already enabled")
+	}
+
+	ok, err := svc.checkTOTP(totp, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, err := svc.newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.store.EnableTOTP(userID); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor turns 2FA off, the user must prove they still have it
+func (svc *Service) DisableTwoFactor(userID int, code string) error {
+	ok, err := svc.checkTwoFactorCode(userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	return svc.store.DeleteTOTP(userID)
+}
+
+func (svc *Service) newRecoveryCodes(userID int) ([]string, error) {
+	var codes []string
+	var hashes []string
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := generateSecureToken(10)
+		if err != nil {
+			return nil, err
+		}
+		code = strings.ToLower(code[:5] + "-" + code[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	if err := svc.store.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (svc *Service) checkTOTP(totp database.TOTP, code string) (bool, error) {
+	secret, err := totpEncoding.DecodeString(totp.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for skew := int64(-totpSkew); skew <= totpSkew; skew++ {
+		step := current + skew
+		if !hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			continue
+		}
+		// the same code can not be used twice
+		return svc.store.SetTOTPLastStep(totp.UserID, step)
+	}
+	return false, nil
+}
+
+// accepts a TOTP code or one of the recovery codes
+func (svc *Service) checkTwoFactorCode(userID int, code string) (bool, error) {
+	totp, err := svc.store.GetTOTP(userID)
+	if err != nil || !totp.Enabled {
+		return false, fmt.Errorf("two factor authentication is not enabled")
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return svc.checkTOTP(totp, code)
+	}
+	return svc.store.UseRecoveryCode(userID, hashToken(strings.ToLower(code)))
+}
+
+// returns a TwoFactorRequiredError if the user has 2FA enabled. Passkeys are
+// a login of their own, they are only accepted instead of the TOTP code of
+// users that turned 2FA on, since those also have recovery codes for when
+// the passkey is lost
+func (svc *Service) requireTwoFactor(usr database.User, remember bool, refresh bool) error {
+	if !svc.IsTwoFactorEnabled(usr.ID) {
+		return nil
+	}
+	methods := []string{"totp"}
+	if svc.HasPasskeys(usr.ID) {
+		methods = append(methods, "passkey")
+	}
+
+	token, err := generateSecureToken(64)
+	if err != nil {
+		return err
+	}
+
+	svc.pendingLogins.Lock()
+	svc.pendingLogins.logins[token] = pendingLogin{
+		userID:   usr.ID,
+		remember: remember,
+		refresh:  refresh,
+		expires:  time.Now().Add(pendingLoginTimeout),
+	}
+	svc.pendingLogins.Unlock()
+
+	return &TwoFactorRequiredError{PendingToken: token, Methods: methods}
+}
+
+// VerifyTwoFactorLogin finishes a login that returned a TwoFactorRequiredError,
+// the refresh token is only returned if the login asked for one
+func (svc *Service) VerifyTwoFactorLogin(pendingToken string, code string) (Login, string, database.User, error) {
+	svc.pendingLogins.Lock()
+	pending, ok := svc.pendingLogins.logins[pendingToken]
+	if ok {
+		pending.attempts++
+		if time.Now().After(pending.expires) || pending.attempts > pendingLoginMaxAttempts {
+			delete(svc.pendingLogins.logins, pendingToken)
+			ok = false
+		} else {
+			svc.pendingLogins.logins[pendingToken] = pending
+		}
+	}
+	svc.pendingLogins.Unlock()
+
+	if !ok {
+		return Login{}, "", database.User{}, fmt.Errorf("login expired, login again")
+	}
+
+	// wrong codes count as failed logins of the account, so new pending
+	// logins with the right password do not give more guesses
+	accountKey := svc.accountThrottleKey("", database.User{ID: pending.userID}, nil)
+	if err := svc.loginThrottles.check(time.Now(), accountKey); err != nil {
+		return Login{}, "", database.User{}, err
+	}
+
+	valid, err := svc.checkTwoFactorCode(pending.userID, code)
+	if err != nil {
+		return Login{}, "", database.User{}, err
+	}
+	if !valid {
+		svc.loginThrottles.fail(accountKey, svc.throttleConfig.MaxFailures, svc.throttleConfig, time.Now())
+		return Login{}, "", database.User{}, ErrInvalidTwoFactorCode
+	}
+
+	svc.pendingLogins.delete(pendingToken)
+
+	usr, err := svc.store.GetUser(pending.userID)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+
+	session, refreshToken, err := svc.finishLogin(usr, pending.remember, pending.refresh)
+	return session, refreshToken, usr, err
+}
+
+// removes 2FA from the user without a code, for admins helping a user that
+// lost their authenticator and recovery codes
+func (svc *Service) ResetTwoFactor(userID int) error {
+	return svc.store.DeleteTOTP(userID)
+}
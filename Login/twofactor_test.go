@@ -0,0 +1,186 @@
+package Login
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 SHA1 test vectors, the last 6 digits of the 8 digit codes
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		if code := totpCode(secret, test.time/totpPeriod); code != test.code {
+			t.Errorf("code at %d: got %s, want %s", test.time, code, test.code)
+		}
+	}
+}
+
+// enables 2FA for the user and returns the secret and the recovery codes, the
+// code of the previous period is used so the current one is still unused
+func enableTwoFactor(t *testing.T, svc *Service, userID int) ([]byte, []string) {
+	uri, err := svc.EnrollTwoFactor(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totpEncoding.DecodeString(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := svc.ConfirmTwoFactor(userID, totpCode(secret, currentTOTPStep()-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodesCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodesCount, len(codes))
+	}
+	return secret, codes
+}
+
+func currentTOTPStep() int64 {
+	return time.Now().Unix() / totpPeriod
+}
+
+func pendingTwoFactorLogin(t *testing.T, svc *Service) string {
+	_, _, err := svc.LoginUserSession(testEmail, "password", false)
+	var twoFactor *TwoFactorRequiredError
+	if !errors.As(err, &twoFactor) {
+		t.Fatalf("expected a second factor to be required, got %v", err)
+	}
+	if len(twoFactor.Methods) != 1 || twoFactor.Methods[0] != "totp" {
+		t.Fatalf("expected only totp, got %v", twoFactor.Methods)
+	}
+	return twoFactor.PendingToken
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	svc, userID := setupTest(t)
+	secret, _ := enableTwoFactor(t, svc, userID)
+
+	pending := pendingTwoFactorLogin(t, svc)
+	code := totpCode(secret, currentTOTPStep())
+	session, _, usr, err := svc.VerifyTwoFactorLogin(pending, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != userID || session.UserID != userID {
+		t.Fatalf("logged in the wrong user: %d %d", usr.ID, session.UserID)
+	}
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, code); err == nil {
+		t.Fatal("pending login was used twice")
+	}
+
+	// the same code can not log in again, even with a new pending login
+	pending = pendingTwoFactorLogin(t, svc)
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("code was replayed: %v", err)
+	}
+
+	// the next period is accepted for clock drift, older ones are not
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, totpCode(secret, currentTOTPStep()-2)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("code outside the skew was accepted: %v", err)
+	}
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, totpCode(secret, currentTOTPStep()+1)); err != nil {
+		t.Fatalf("code of the next period was refused: %v", err)
+	}
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	svc, userID := setupTest(t)
+	_, codes := enableTwoFactor(t, svc, userID)
+
+	pending := pendingTwoFactorLogin(t, svc)
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, " "+codes[0]+" "); err != nil {
+		t.Fatalf("recovery code was refused: %v", err)
+	}
+
+	pending = pendingTwoFactorLogin(t, svc)
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, codes[0]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("recovery code was used twice: %v", err)
+	}
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, codes[1]); err != nil {
+		t.Fatalf("second recovery code was refused: %v", err)
+	}
+}
+
+func TestTwoFactorAttemptLimit(t *testing.T) {
+	svc, userID := setupTest(t)
+	secret, _ := enableTwoFactor(t, svc, userID)
+	config := svc.GetThrottleConfig()
+	config.MaxFailures = 100
+	svc.SetThrottleConfig(config)
+
+	pending := pendingTwoFactorLogin(t, svc)
+	for i := 0; i < pendingLoginMaxAttempts; i++ {
+		if _, _, _, err := svc.VerifyTwoFactorLogin(pending, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, totpCode(secret, currentTOTPStep())); err == nil {
+		t.Fatal("pending login kept working after too many attempts")
+	}
+}
+
+func TestTwoFactorFailuresLockAccount(t *testing.T) {
+	svc, userID := setupTest(t)
+	secret, _ := enableTwoFactor(t, svc, userID)
+	config := svc.GetThrottleConfig()
+	config.MaxFailures = 3
+	svc.SetThrottleConfig(config)
+
+	// the right password does not forget the failed attempts
+	if _, _, err := svc.LoginUserSession(testEmail, "wrong", false); err == nil {
+		t.Fatal("wrong password logged in")
+	}
+
+	// new pending logins do not give more guesses of the code
+	var pending string
+	for i := 0; i < 2; i++ {
+		pending = pendingTwoFactorLogin(t, svc)
+		if _, _, _, err := svc.VerifyTwoFactorLogin(pending, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+
+	var locked *LoginLockedError
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, totpCode(secret, currentTOTPStep())); !errors.As(err, &locked) {
+		t.Fatalf("expected the code to be refused while the account is locked, got %v", err)
+	}
+	if _, _, err := svc.LoginUserSession(testEmail, "password", false); !errors.As(err, &locked) {
+		t.Fatalf("expected the account to be locked, got %v", err)
+	}
+
+	svc.UnlockLogin(testEmail)
+	pending = pendingTwoFactorLogin(t, svc)
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.VerifyTwoFactorLogin(pending, totpCode(secret, currentTOTPStep())); err != nil {
+		t.Fatal(err)
+	}
+
+	// a finished login forgets the failures
+	svc.loginThrottles.Lock()
+	_, ok := svc.loginThrottles.failures[svc.accountThrottleKey("", database.User{ID: userID}, nil)]
+	svc.loginThrottles.Unlock()
+	if ok {
+		t.Fatal("failures were kept after the login finished")
+	}
+}
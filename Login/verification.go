@@ -0,0 +1,164 @@
+package Login
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maruqes/Tokenize/Mail"
+	"github.com/Maruqes/Tokenize/database"
+)
+
+var (
+	ErrEmailNotVerified      = errors.New("email not verified")
+	ErrInvalidVerifyToken    = errors.New("invalid or expired verification link")
+	ErrVerificationThrottled = errors.New("verification email sent recently, try again later")
+)
+
+const emailVerificationAudience = "verify-email"
+
+func (svc *Service) SetRequireVerifiedEmail(require bool) {
+	svc.requireVerifiedEmail = require
+}
+
+type emailVerificationClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	Subject   string `json:"sub"`
+	Email     string `json:"email"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type verificationThrottle struct {
+	sync.Mutex
+	sent map[string]time.Time
+}
+
+// returns false if an email was sent to the address of this email key less
+// than interval ago, otherwise it records the new send
+func (t *verificationThrottle) allow(email string, interval time.Duration, now time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+	if last, ok := t.sent[email]; ok && now.Sub(last) < interval {
+		return false
+	}
+	t.sent[email] = now
+	return true
+}
+
+func (t *verificationThrottle) deleteExpired(interval time.Duration, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for email, last := range t.sent {
+		if now.Sub(last) >= interval {
+			delete(t.sent, email)
+		}
+	}
+}
+
+// EMAIL_VERIFICATION_URL receives the token as "?token=", it defaults to the
+// /verify-email endpoint of DOMAIN
+func (svc *Service) emailVerificationURL(token string) string {
+	base := os.Getenv("EMAIL_VERIFICATION_URL")
+	if base == "" {
+		base = strings.TrimSuffix(svc.domain, "/") + "/verify-email"
+	}
+
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+// emails the signed verification link to a user that is still pending
+func (svc *Service) SendVerificationEmail(usr database.User) error {
+	if !usr.PendingVerification {
+		return nil
+	}
+	svc.verificationEmails.allow(svc.store.EmailKey(usr.Email), svc.verificationResendInterval, time.Now())
+
+	now := time.Now()
+	token, err := svc.signJWT(emailVerificationClaims{
+		Issuer:    svc.domain,
+		Audience:  emailVerificationAudience,
+		Subject:   strconv.Itoa(usr.ID),
+		Email:     usr.Email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(svc.emailVerificationTimeout).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nOpen the link below to confirm your email address:\n\n%s\n\nIf you did not create an account you can ignore this email.",
+		usr.Name, svc.emailVerificationURL(token))
+	return Mail.Send(usr.Email, "Confirm your email", body)
+}
+
+// sends the verification email again, unknown or already verified emails are
+// ignored so the caller can not find out which emails have an account
+func (svc *Service) ResendVerificationEmail(email string) error {
+	if !svc.verificationEmails.allow(svc.store.EmailKey(email), svc.verificationResendInterval, time.Now()) {
+		return ErrVerificationThrottled
+	}
+
+	usr, err := svc.store.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return svc.SendVerificationEmail(usr)
+}
+
+// checks the signed link and marks the email of the user as verified, the
+// link only works for the email it was sent to
+func (svc *Service) VerifyEmail(token string) (database.User, error) {
+	var claims emailVerificationClaims
+	if err := svc.verifyJWT(token, &claims); err != nil {
+		return database.User{}, ErrInvalidVerifyToken
+	}
+	if claims.Issuer != svc.domain || claims.Audience != emailVerificationAudience {
+		return database.User{}, ErrInvalidVerifyToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return database.User{}, ErrInvalidVerifyToken
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return database.User{}, ErrInvalidVerifyToken
+	}
+	usr, err := svc.store.GetUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return usr, ErrInvalidVerifyToken
+	}
+	if err != nil {
+		return usr, err
+	}
+	if usr.Email != claims.Email {
+		return usr, ErrInvalidVerifyToken
+	}
+
+	if err := svc.store.SetEmailVerified(usr.ID); err != nil {
+		return usr, err
+	}
+	usr.PendingVerification = false
+	return usr, nil
+}
+
+func (svc *Service) checkEmailVerified(usr database.User) error {
+	if svc.requireVerifiedEmail && usr.PendingVerification {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
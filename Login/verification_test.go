@@ -0,0 +1,137 @@
+package Login
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailVerification(t *testing.T) {
+	svc, userID := setupTest(t)
+	mailer := captureMail(t)
+	svc.SetRequireVerifiedEmail(true)
+
+	if _, _, err := svc.LoginUserSession(testEmail, "password", false); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("unverified user logged in: %v", err)
+	}
+
+	usr, err := svc.store.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SendVerificationEmail(usr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(mailer.mails[0].body, testOrigin+"/verify-email?token=") {
+		t.Fatalf("email does not link to /verify-email: %s", mailer.mails[0].body)
+	}
+	token := mailer.lastToken(t, testEmail)
+
+	// a login token is signed by the same keys but is not a verification link
+	svc.SetTokenMode(SignedTokens)
+	login, err := svc.issueLogin(usr, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.VerifyEmail(login.Token); !errors.Is(err, ErrInvalidVerifyToken) {
+		t.Fatalf("login token verified the email: %v", err)
+	}
+	svc.SetTokenMode(SessionTokens)
+
+	verified, err := svc.VerifyEmail(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.PendingVerification {
+		t.Fatal("user is still pending")
+	}
+	if _, _, err := svc.LoginUserSession(testEmail, "password", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// verified users get no more emails
+	usr.PendingVerification = false
+	if err := svc.SendVerificationEmail(usr); err != nil || mailer.count() != 1 {
+		t.Fatalf("verified user got another email: %v", err)
+	}
+}
+
+func TestEmailVerificationLinkChecks(t *testing.T) {
+	svc, userID := setupTest(t)
+
+	now := time.Now()
+	claims := emailVerificationClaims{
+		Issuer:    svc.domain,
+		Audience:  emailVerificationAudience,
+		Subject:   strconv.Itoa(userID),
+		Email:     testEmail,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	sign := func(claims emailVerificationClaims) string {
+		token, err := svc.signJWT(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// the link only works for the email it was sent to
+	otherEmail := claims
+	otherEmail.Email = "old@tokenize.test"
+	expired := claims
+	expired.ExpiresAt = now.Add(-time.Minute).Unix()
+	otherIssuer := claims
+	otherIssuer.Issuer = "https://evil.test"
+
+	for name, token := range map[string]string{
+		"other email":  sign(otherEmail),
+		"expired":      sign(expired),
+		"other issuer": sign(otherIssuer),
+		"malformed":    "not a token",
+	} {
+		if _, err := svc.VerifyEmail(token); !errors.Is(err, ErrInvalidVerifyToken) {
+			t.Errorf("%s: link was accepted: %v", name, err)
+		}
+	}
+	if _, err := svc.VerifyEmail(sign(claims)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResendVerificationThrottle(t *testing.T) {
+	svc, userID := setupTest(t)
+	mailer := captureMail(t)
+
+	usr, err := svc.store.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SendVerificationEmail(usr); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ResendVerificationEmail("USER@tokenize.test"); !errors.Is(err, ErrVerificationThrottled) {
+		t.Fatalf("email was sent again right away: %v", err)
+	}
+
+	// unknown emails are throttled the same way, without an email
+	if err := svc.ResendVerificationEmail("nobody@tokenize.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ResendVerificationEmail("nobody@tokenize.test"); !errors.Is(err, ErrVerificationThrottled) {
+		t.Fatalf("unknown email was not throttled: %v", err)
+	}
+	if mailer.count() != 1 {
+		t.Fatalf("expected 1 email, got %d", mailer.count())
+	}
+
+	svc.verificationEmails.deleteExpired(0, time.Now())
+	if err := svc.ResendVerificationEmail(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if mailer.count() != 2 {
+		t.Fatalf("expected the email to be sent again, got %d emails", mailer.count())
+	}
+}
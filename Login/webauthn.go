@@ -0,0 +1,641 @@
+package Login
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maruqes/Tokenize/database"
+)
+
+// WebAuthn (passkeys) registration and login ceremonies. The options and
+// responses use the JSON format of the WebAuthn level 3 spec, so browsers can
+// use PublicKeyCredential.parseCreationOptionsFromJSON and credential.toJSON().
+// Attestation is not requested ("none"), any authenticator is accepted.
+
+const webAuthnTimeout = 5 * time.Minute
+
+// COSE algorithms
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type PublicKeyCredentialCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// PasskeyRegistrationResponse is the JSON of the credential returned by
+// navigator.credentials.create()
+type PasskeyRegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// PasskeyLoginResponse is the JSON of the credential returned by
+// navigator.credentials.get()
+type PasskeyLoginResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type webAuthnChallenge struct {
+	ceremony string // "webauthn.create" or "webauthn.get"
+	// user registering the passkey, 0 for logins
+	userID int
+	// set when the passkey is the second factor of a password login
+	pendingToken     string
+	userVerification bool
+	expires          time.Time
+}
+
+type webAuthnChallengeStore struct {
+	sync.Mutex
+	challenges map[string]webAuthnChallenge
+}
+
+func (s *webAuthnChallengeStore) add(challenge webAuthnChallenge) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+
+	challenge.expires = time.Now().Add(webAuthnTimeout)
+	s.Lock()
+	s.challenges[encoded] = challenge
+	s.Unlock()
+	return encoded, nil
+}
+
+// challenges can only be used once
+func (s *webAuthnChallengeStore) take(encoded string) (webAuthnChallenge, bool) {
+	s.Lock()
+	defer s.Unlock()
+	challenge, ok := s.challenges[encoded]
+	delete(s.challenges, encoded)
+	if !ok || time.Now().After(challenge.expires) {
+		return webAuthnChallenge{}, false
+	}
+	return challenge, true
+}
+
+func (s *webAuthnChallengeStore) deleteExpired(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for encoded, challenge := range s.challenges {
+		if now.After(challenge.expires) {
+			delete(s.challenges, encoded)
+		}
+	}
+}
+
+// WEBAUTHN_RP_ID defaults to the host of DOMAIN and WEBAUTHN_ORIGINS (comma
+// separated) defaults to DOMAIN
+func (svc *Service) webAuthnRelyingParty() (string, string, []string) {
+	domain := strings.TrimSuffix(svc.domain, "/")
+
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		if parsed, err := url.Parse(domain); err == nil {
+			rpID = parsed.Hostname()
+		}
+	}
+
+	rpName := os.Getenv("WEBAUTHN_RP_NAME")
+	if rpName == "" {
+		rpName = "Tokenize"
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{domain}
+	}
+	return rpID, rpName, origins
+}
+
+// browsers send base64url without padding, some libraries add it
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (svc *Service) passkeyDescriptors(userID int) ([]CredentialDescriptor, error) {
+	passkeys, err := svc.store.GetUserPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	descriptors := []CredentialDescriptor{}
+	for _, passkey := range passkeys {
+		descriptors = append(descriptors, CredentialDescriptor{Type: "public-key", ID: passkey.CredentialID})
+	}
+	return descriptors, nil
+}
+
+func (svc *Service) HasPasskeys(userID int) bool {
+	passkeys, err := svc.store.GetUserPasskeys(userID)
+	return err == nil && len(passkeys) > 0
+}
+
+func (svc *Service) ListPasskeys(userID int) ([]database.Passkey, error) {
+	return svc.store.GetUserPasskeys(userID)
+}
+
+func (svc *Service) DeletePasskey(userID int, passkeyID int) error {
+	deleted, err := svc.store.DeletePasskey(userID, passkeyID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("passkey %d not found", passkeyID)
+	}
+	return nil
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create()
+func (svc *Service) BeginPasskeyRegistration(userID int) (PublicKeyCredentialCreationOptions, error) {
+	var options PublicKeyCredentialCreationOptions
+
+	usr, err := svc.store.GetUser(userID)
+	if err != nil {
+		return options, err
+	}
+	exclude, err := svc.passkeyDescriptors(userID)
+	if err != nil {
+		return options, err
+	}
+
+	challenge, err := svc.webAuthnChallenges.add(webAuthnChallenge{
+		ceremony: "webauthn.create",
+		userID:   userID,
+	})
+	if err != nil {
+		return options, err
+	}
+
+	rpID, rpName, _ := svc.webAuthnRelyingParty()
+	options.Challenge = challenge
+	options.RP.ID = rpID
+	options.RP.Name = rpName
+	options.User.ID = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(usr.ID)))
+	options.User.Name = usr.Email
+	options.User.DisplayName = usr.Name
+	for _, alg := range []int{coseES256, coseEdDSA, coseRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{Type: "public-key", Alg: alg})
+	}
+	options.Timeout = webAuthnTimeout.Milliseconds()
+	options.ExcludeCredentials = exclude
+	// discoverable credentials are what allows the passwordless login
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	options.Attestation = "none"
+	return options, nil
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (svc *Service) verifyClientData(raw []byte, ceremony string) (webAuthnChallenge, error) {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return webAuthnChallenge{}, fmt.Errorf("invalid client data")
+	}
+	if data.Type != ceremony {
+		return webAuthnChallenge{}, fmt.Errorf("invalid client data type %s", data.Type)
+	}
+
+	_, _, origins := svc.webAuthnRelyingParty()
+	if !slices.Contains(origins, data.Origin) {
+		return webAuthnChallenge{}, fmt.Errorf("invalid origin %s", data.Origin)
+	}
+
+	challenge, ok := svc.webAuthnChallenges.take(data.Challenge)
+	if !ok || challenge.ceremony != ceremony {
+		return webAuthnChallenge{}, fmt.Errorf("unknown or expired challenge")
+	}
+	return challenge, nil
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var authData authenticatorData
+	if len(data) < 37 {
+		return authData, fmt.Errorf("authenticator data too short")
+	}
+	authData.rpIDHash = data[:32]
+	authData.flags = data[32]
+	authData.signCount = binary.BigEndian.Uint32(data[33:37])
+
+	if authData.flags&flagAttestedData != 0 {
+		// aaguid (16) and the credential ID length (2)
+		rest := data[37:]
+		if len(rest) < 18 {
+			return authData, fmt.Errorf("attested credential data too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return authData, fmt.Errorf("credential ID too short")
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, used, err := cborDecode(rest)
+		if err != nil {
+			return authData, fmt.Errorf("invalid credential public key: %v", err)
+		}
+		authData.publicKey = rest[:used]
+	}
+	return authData, nil
+}
+
+func (svc *Service) checkAuthenticatorData(authData authenticatorData, userVerification bool) error {
+	rpID, _, _ := svc.webAuthnRelyingParty()
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("invalid relying party")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return fmt.Errorf("user not present")
+	}
+	if userVerification && authData.flags&flagUserVerified == 0 {
+		return fmt.Errorf("user not verified")
+	}
+	return nil
+}
+
+func coseInt(key map[any]any, label int64) (int64, bool) {
+	value, ok := key[label].(int64)
+	return value, ok
+}
+
+func coseBytes(key map[any]any, label int64) ([]byte, bool) {
+	value, ok := key[label].([]byte)
+	return value, ok
+}
+
+// parses a COSE_Key (RFC 9053) into a go public key
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := cborDecode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("public key is not a cose key")
+	}
+
+	kty, _ := coseInt(key, 1)
+	alg, _ := coseInt(key, 3)
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := coseInt(key, -1)
+		x, okX := coseBytes(key, -2)
+		y, okY := coseBytes(key, -3)
+		if crv != 1 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("invalid P-256 key")
+		}
+		// uncompressed point, ecdh checks it is on the curve
+		point := make([]byte, 0, 65)
+		point = append(append(append(point, 4), x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, 0, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return pub, alg, nil
+	case kty == 1 && alg == coseEdDSA:
+		crv, _ := coseInt(key, -1)
+		x, okX := coseBytes(key, -2)
+		if crv != 6 || !okX || len(x) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseRS256:
+		n, okN := coseBytes(key, -1)
+		e, okE := coseBytes(key, -2)
+		if !okN || !okE || len(e) > 4 {
+			return nil, 0, fmt.Errorf("invalid RSA key")
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, 0, fmt.Errorf("RSA key too small")
+		}
+		return pub, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+func verifyPasskeySignature(coseKey []byte, signed []byte, signature []byte) error {
+	pub, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	switch alg {
+	case coseES256:
+		hash := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), hash[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case coseEdDSA:
+		if !ed25519.Verify(pub.(ed25519.PublicKey), signed, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case coseRS256:
+		hash := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, hash[:], signature); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	return nil
+}
+
+// FinishPasskeyRegistration checks the credential created by the browser and
+// saves it as a passkey of the user
+func (svc *Service) FinishPasskeyRegistration(userID int, name string, response PasskeyRegistrationResponse) (database.Passkey, error) {
+	if response.Type != "public-key" {
+		return database.Passkey{}, fmt.Errorf("invalid credential type")
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+
+	clientDataJSON, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return database.Passkey{}, fmt.Errorf("invalid client data")
+	}
+	challenge, err := svc.verifyClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return database.Passkey{}, err
+	}
+	if challenge.userID != userID {
+		return database.Passkey{}, fmt.Errorf("challenge belongs to another user")
+	}
+
+	attestationObject, err := decodeBase64URL(response.Response.AttestationObject)
+	if err != nil {
+		return database.Passkey{}, fmt.Errorf("invalid attestation object")
+	}
+	decoded, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return database.Passkey{}, fmt.Errorf("invalid attestation object: %v", err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return database.Passkey{}, fmt.Errorf("invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return database.Passkey{}, fmt.Errorf("attestation object without authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return database.Passkey{}, err
+	}
+	if err := svc.checkAuthenticatorData(authData, challenge.userVerification); err != nil {
+		return database.Passkey{}, err
+	}
+	if authData.credentialID == nil {
+		return database.Passkey{}, fmt.Errorf("no credential in authenticator data")
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(authData.credentialID)
+	if rawID := strings.TrimRight(response.RawID, "="); rawID != "" && rawID != credentialID {
+		return database.Passkey{}, fmt.Errorf("credential ID does not match")
+	}
+	if _, _, err := parseCOSEKey(authData.publicKey); err != nil {
+		return database.Passkey{}, err
+	}
+	if _, err := svc.store.GetPasskeyByCredentialID(credentialID); err == nil {
+		return database.Passkey{}, fmt.Errorf("passkey already registered")
+	}
+
+	passkey := database.Passkey{
+		UserID:       userID,
+		Name:         name,
+		CredentialID: credentialID,
+		PublicKey:    authData.publicKey,
+		SignCount:    authData.signCount,
+		Created:      time.Now().Unix(),
+	}
+	id, err := svc.store.AddPasskey(passkey)
+	if err != nil {
+		return database.Passkey{}, err
+	}
+	passkey.ID = int(id)
+	return passkey, nil
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get(). With
+// an empty pendingToken it starts a passwordless login with any discoverable
+// passkey, otherwise the passkey is the second factor of that password login
+// of a user with 2FA enabled.
+func (svc *Service) BeginPasskeyLogin(pendingToken string) (PublicKeyCredentialRequestOptions, error) {
+	var options PublicKeyCredentialRequestOptions
+	rpID, _, _ := svc.webAuthnRelyingParty()
+
+	challenge := webAuthnChallenge{
+		ceremony:         "webauthn.get",
+		pendingToken:     pendingToken,
+		userVerification: pendingToken == "",
+	}
+	options.AllowCredentials = []CredentialDescriptor{}
+	options.UserVerification = "required"
+
+	if pendingToken != "" {
+		pending, ok := svc.pendingLogins.get(pendingToken)
+		if !ok {
+			return options, fmt.Errorf("login expired, login again")
+		}
+		allow, err := svc.passkeyDescriptors(pending.userID)
+		if err != nil {
+			return options, err
+		}
+		if len(allow) == 0 {
+			return options, fmt.Errorf("user has no passkeys")
+		}
+		options.AllowCredentials = allow
+		options.UserVerification = "preferred"
+	}
+
+	encoded, err := svc.webAuthnChallenges.add(challenge)
+	if err != nil {
+		return options, err
+	}
+	options.Challenge = encoded
+	options.Timeout = webAuthnTimeout.Milliseconds()
+	options.RPID = rpID
+	return options, nil
+}
+
+// FinishPasskeyLogin checks the assertion of the browser and issues the session
+// like LoginUser, remember and refresh are only used by passwordless logins
+// since a second factor login keeps the options of its password step
+func (svc *Service) FinishPasskeyLogin(response PasskeyLoginResponse, remember bool, refresh bool) (Login, string, database.User, error) {
+	if response.Type != "public-key" {
+		return Login{}, "", database.User{}, fmt.Errorf("invalid credential type")
+	}
+
+	clientDataJSON, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return Login{}, "", database.User{}, fmt.Errorf("invalid client data")
+	}
+	challenge, err := svc.verifyClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		return Login{}, "", database.User{}, err
+	}
+
+	passkey, err := svc.store.GetPasskeyByCredentialID(strings.TrimRight(response.RawID, "="))
+	if err != nil {
+		return Login{}, "", database.User{}, fmt.Errorf("unknown passkey")
+	}
+
+	rawAuthData, err := decodeBase64URL(response.Response.AuthenticatorData)
+	if err != nil {
+		return Login{}, "", database.User{}, fmt.Errorf("invalid authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Login{}, "", database.User{}, err
+	}
+	if err := svc.checkAuthenticatorData(authData, challenge.userVerification); err != nil {
+		return Login{}, "", database.User{}, err
+	}
+
+	signature, err := decodeBase64URL(response.Response.Signature)
+	if err != nil {
+		return Login{}, "", database.User{}, fmt.Errorf("invalid signature")
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyPasskeySignature(passkey.PublicKey, signed, signature); err != nil {
+		return Login{}, "", database.User{}, err
+	}
+
+	// a counter that does not grow means the authenticator may have been cloned
+	if (authData.signCount != 0 || passkey.SignCount != 0) && authData.signCount <= passkey.SignCount {
+		return Login{}, "", database.User{}, fmt.Errorf("passkey sign count did not increase")
+	}
+
+	if challenge.pendingToken != "" {
+		pending, ok := svc.pendingLogins.get(challenge.pendingToken)
+		if !ok || pending.userID != passkey.UserID {
+			return Login{}, "", database.User{}, fmt.Errorf("login expired, login again")
+		}
+		svc.pendingLogins.delete(challenge.pendingToken)
+		remember = pending.remember
+		refresh = pending.refresh
+	}
+
+	if err := svc.store.UpdatePasskeySignCount(passkey.ID, authData.signCount, time.Now().Unix()); err != nil {
+		return Login{}, "", database.User{}, err
+	}
+
+	usr, err := svc.store.GetUser(passkey.UserID)
+	if err != nil {
+		return Login{}, "", usr, err
+	}
+	if err := svc.checkEmailVerified(usr); err != nil {
+		return Login{}, "", usr, err
+	}
+
+	session, refreshToken, err := svc.finishLogin(usr, remember, refresh)
+	return session, refreshToken, usr, err
+}
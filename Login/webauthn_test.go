@@ -0,0 +1,320 @@
+package Login
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// cbor encoding for the software authenticator, maps keep the given key order
+
+type cborPair struct {
+	key   any
+	value any
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	}
+	b := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	return b
+}
+
+func cborEncode(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []cborPair:
+		out := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, cborEncode(pair.key)...)
+			out = append(out, cborEncode(pair.value)...)
+		}
+		return out
+	}
+	panic("unsupported cbor value")
+}
+
+// softAuthenticator is a P-256 platform authenticator that lives in memory
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	origin       string
+	userVerified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID, origin: testOrigin, userVerified: true}
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	return data
+}
+
+func (a *softAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(flagUserPresent)
+	if a.userVerified {
+		flags |= flagUserVerified
+	}
+	if attested {
+		flags |= flagAttestedData
+	}
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, cborEncode([]cborPair{
+			{1, 2},
+			{3, coseES256},
+			{-1, 1},
+			{-2, a.key.X.FillBytes(make([]byte, 32))},
+			{-3, a.key.Y.FillBytes(make([]byte, 32))},
+		})...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) create(options PublicKeyCredentialCreationOptions) PasskeyRegistrationResponse {
+	attestationObject := cborEncode([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(options.RP.ID, true)},
+	})
+
+	var response PasskeyRegistrationResponse
+	response.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	response.RawID = response.ID
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.Challenge))
+	response.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(attestationObject)
+	return response
+}
+
+func (a *softAuthenticator) get(t *testing.T, options PublicKeyCredentialRequestOptions) PasskeyLoginResponse {
+	a.signCount++
+	authData := a.authData(options.RPID, false)
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response PasskeyLoginResponse
+	response.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	response.RawID = response.ID
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	response.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	response.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	return response
+}
+
+func registerPasskey(t *testing.T, svc *Service, userID int, authenticator *softAuthenticator) {
+	options, err := svc.BeginPasskeyRegistration(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.FinishPasskeyRegistration(userID, "laptop", authenticator.create(options)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasskeyPasswordlessLogin(t *testing.T) {
+	svc, userID := setupTest(t)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, svc, userID, authenticator)
+
+	options, err := svc.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := authenticator.get(t, options)
+	session, _, usr, err := svc.FinishPasskeyLogin(assertion, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != userID || session.UserID != userID || session.Token == "" {
+		t.Fatalf("login returned the wrong session %+v", session)
+	}
+
+	// the challenge can only be used once
+	if _, _, _, err := svc.FinishPasskeyLogin(assertion, false, false); err == nil {
+		t.Fatal("replayed assertion was accepted")
+	}
+}
+
+func TestPasskeyPasswordlessLoginRequiresUserVerification(t *testing.T) {
+	svc, userID := setupTest(t)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, svc, userID, authenticator)
+
+	authenticator.userVerified = false
+	options, err := svc.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.FinishPasskeyLogin(authenticator.get(t, options), false, false); err == nil {
+		t.Fatal("login without user verification was accepted")
+	}
+}
+
+func TestPasskeyIsNotRequiredSecondFactor(t *testing.T) {
+	svc, userID := setupTest(t)
+	registerPasskey(t, svc, userID, newSoftAuthenticator(t))
+
+	// without 2FA there are no recovery codes, so losing the passkey must not
+	// lock the user out of the password login
+	if _, _, err := svc.LoginUserSession(testEmail, "password", false); err != nil {
+		t.Fatalf("passkey was required as a second factor: %v", err)
+	}
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	svc, userID := setupTest(t)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, svc, userID, authenticator)
+	enableTwoFactor(t, svc, userID)
+
+	_, _, err := svc.LoginUserSession(testEmail, "password", true)
+	var twoFactor *TwoFactorRequiredError
+	if !errors.As(err, &twoFactor) {
+		t.Fatalf("expected a second factor to be required, got %v", err)
+	}
+	if len(twoFactor.Methods) != 2 || twoFactor.Methods[0] != "totp" || twoFactor.Methods[1] != "passkey" {
+		t.Fatalf("expected totp and passkey, got %v", twoFactor.Methods)
+	}
+
+	options, err := svc.BeginPasskeyLogin(twoFactor.PendingToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options.AllowCredentials) != 1 {
+		t.Fatalf("expected the registered passkey to be allowed, got %v", options.AllowCredentials)
+	}
+
+	session, _, _, err := svc.FinishPasskeyLogin(authenticator.get(t, options), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.Remember {
+		t.Fatal("second factor login lost the remember me option of the password step")
+	}
+
+	if _, err := svc.BeginPasskeyLogin(twoFactor.PendingToken); err == nil {
+		t.Fatal("pending login was used twice")
+	}
+}
+
+func TestPasskeyRejectsWrongOrigin(t *testing.T) {
+	svc, userID := setupTest(t)
+	authenticator := newSoftAuthenticator(t)
+	authenticator.origin = "https://evil.test"
+
+	options, err := svc.BeginPasskeyRegistration(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.FinishPasskeyRegistration(userID, "laptop", authenticator.create(options)); err == nil {
+		t.Fatal("registration from another origin was accepted")
+	}
+}
+
+func TestPasskeyRejectsCloneSignCount(t *testing.T) {
+	svc, userID := setupTest(t)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, svc, userID, authenticator)
+
+	options, err := svc.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.FinishPasskeyLogin(authenticator.get(t, options), false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a clone of the authenticator still has the old counter
+	authenticator.signCount = 0
+	options, err = svc.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := svc.FinishPasskeyLogin(authenticator.get(t, options), false, false); err == nil {
+		t.Fatal("sign count that did not increase was accepted")
+	}
+}
+
+func FuzzParseAuthenticatorData(f *testing.F) {
+	svc := New(nil, nil)
+	svc.SetDomain(testOrigin)
+	rpID, _, _ := svc.webAuthnRelyingParty()
+	authenticator := &softAuthenticator{credentialID: make([]byte, 16), userVerified: true}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	authenticator.key = key
+	f.Add(authenticator.authData(rpID, true))
+	f.Add(authenticator.authData(rpID, false))
+	f.Add(append(authenticator.authData(rpID, true), 0xa0))
+	truncated := authenticator.authData(rpID, true)
+	f.Add(truncated[:60])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		authData, err := parseAuthenticatorData(data)
+		if err != nil {
+			return
+		}
+		if len(authData.rpIDHash) != 32 {
+			t.Fatalf("relying party hash of %d bytes", len(authData.rpIDHash))
+		}
+		if len(authData.credentialID)+len(authData.publicKey) > len(data) {
+			t.Fatal("parsed more data than there is")
+		}
+		if authData.flags&flagAttestedData != 0 && len(authData.publicKey) == 0 {
+			t.Fatal("attested data without a public key")
+		}
+		svc.checkAuthenticatorData(authData, true)
+		parseCOSEKey(authData.publicKey)
+	})
+}
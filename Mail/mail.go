@@ -0,0 +1,111 @@
+package Mail
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends the emails of Tokenize (password resets, verifications...)
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer = &FileMailer{}
+
+// use your own Mailer, call it before Initialize
+func SetMailer(m Mailer) {
+	mailer = m
+	customMailer = true
+}
+
+var customMailer = false
+
+func Send(to, subject, body string) error {
+	return mailer.Send(to, subject, body)
+}
+
+// FileMailer is the development transport, it appends every email to Path or
+// prints it to the log if Path is empty
+type FileMailer struct {
+	sync.Mutex
+	Path string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	message := fmt.Sprintf("%s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format("2006-01-02 15:04:05"), to, subject, body)
+	if m.Path == "" {
+		log.Print("Mail: " + message)
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(message)
+	return err
+}
+
+// SMTPMailer sends the emails with a SMTP server using PLAIN auth
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+
+	message := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n"
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(message))
+}
+
+// MAIL_TRANSPORT=smtp uses SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD
+// and MAIL_FROM, anything else writes the emails to MAIL_DEV_FILE (or the log)
+func Init() {
+	if customMailer {
+		return
+	}
+
+	if os.Getenv("MAIL_TRANSPORT") == "smtp" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		if os.Getenv("SMTP_HOST") == "" || os.Getenv("MAIL_FROM") == "" {
+			log.Fatal("Missing env variable: SMTP_HOST or MAIL_FROM")
+		}
+		mailer = &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		return
+	}
+
+	mailer = &FileMailer{Path: os.Getenv("MAIL_DEV_FILE")}
+}
@@ -6,89 +6,122 @@ import (
 	"github.com/Maruqes/Tokenize/database"
 )
 
+// Store is what the permission functions need from the database
+type Store interface {
+	database.PermissionStore
+	CheckIfUserIDExists(id int) (bool, error)
+	GetAPIKey(id int) (database.APIKey, error)
+	GetAPIKeyPermissions(apiKeyID int) ([]database.Permission, error)
+}
+
+// Service manages the permissions saved in its store
+type Service struct {
+	store Store
+}
+
+func New(store Store) *Service {
+	return &Service{store: store}
+}
+
 // only all:all perms can do this
-func CreatePermission(name, permission string) error {
-	permission_type, err := database.GetPermissionWithName(name)
+func (svc *Service) CreatePermission(name, permission string) error {
+	permission_type, err := svc.store.GetPermissionWithName(name)
 	if permission_type.ID != -1 || err != nil {
 		return fmt.Errorf("permission %s already exists", name)
 	}
 
-	permission_type, err = database.GetPermissionWithPermission(permission)
+	permission_type, err = svc.store.GetPermissionWithPermission(permission)
 	if permission_type.ID != -1 || err != nil {
 		return fmt.Errorf("permission %s already exists", permission)
 	}
 	fmt.Println("Creating permission")
-	err = database.CreateNewPermission(name, permission)
+	err = svc.store.CreateNewPermission(name, permission)
 	if err != nil {
 		return fmt.Errorf("error creating permission %s", name)
 	}
 	return nil
 }
 
-func DeletePermission(id int) error {
-	exist := database.CheckPermissionID(id)
+func (svc *Service) DeletePermission(id int) error {
+	exist := svc.store.CheckPermissionID(id)
 	if !exist {
 		return fmt.Errorf("permission %d does not exist", id)
 	}
 
-	err := database.DeletePermissionWithID(id)
+	err := svc.store.DeletePermissionWithID(id)
 	if err != nil {
 		return fmt.Errorf("error deleting permission %d", id)
 	}
 	return nil
 }
 
-func GetPermissions() ([]database.Permission, error) {
-	return database.GetPermissions()
+func (svc *Service) GetPermissions() ([]database.Permission, error) {
+	return svc.store.GetPermissions()
 }
 
-func AddUserPermission(userID, permissionID int) error {
-	exist_id, err := database.CheckIfUserIDExists(userID)
+func (svc *Service) AddUserPermission(userID, permissionID int) error {
+	exist_id, err := svc.store.CheckIfUserIDExists(userID)
 	if err != nil || !exist_id {
 		return fmt.Errorf("user %d does not exist", userID)
 	}
 
-	exist_perm := database.CheckPermissionID(permissionID)
+	exist_perm := svc.store.CheckPermissionID(permissionID)
 	if !exist_perm {
 		return fmt.Errorf("permission %d does not exist", permissionID)
 	}
 
-	exist := database.CheckUserPermission(userID, permissionID)
+	exist := svc.store.CheckUserPermission(userID, permissionID)
 	if exist {
 		return fmt.Errorf("user %d already has permission %d", userID, permissionID)
 	}
 
-	database.AddUserPermission(userID, permissionID)
+	svc.store.AddUserPermission(userID, permissionID)
 	return nil
 }
 
-func RemoveUserPermission(userID, permissionID int) error {
-	exist_id, err := database.CheckIfUserIDExists(userID)
+func (svc *Service) RemoveUserPermission(userID, permissionID int) error {
+	exist_id, err := svc.store.CheckIfUserIDExists(userID)
 	if err != nil || !exist_id {
 		return fmt.Errorf("user %d does not exist", userID)
 	}
 
-	exist_perm := database.CheckPermissionID(permissionID)
+	exist_perm := svc.store.CheckPermissionID(permissionID)
 	if !exist_perm {
 		return fmt.Errorf("permission %d does not exist", permissionID)
 	}
 
-	database.RemoveUserPermission(userID, permissionID)
+	svc.store.RemoveUserPermission(userID, permissionID)
 	return nil
 }
 
 // only the own user or all:all perms can do this
-func GetUserPermissions(userID int) ([]database.Permission, error) {
-	exist_id, err := database.CheckIfUserIDExists(userID)
+func (svc *Service) GetUserPermissions(userID int) ([]database.Permission, error) {
+	exist_id, err := svc.store.CheckIfUserIDExists(userID)
 	if err != nil || !exist_id {
 		return []database.Permission{}, fmt.Errorf("user %d does not exist", userID)
 	}
 
-	return database.GetUserPermissions(userID)
+	return svc.store.GetUserPermissions(userID)
+}
+
+// Subject is who a permission is checked for, Login.Login.Subject() returns
+// the one of a request
+type Subject struct {
+	UserID int
+	// set when the request was authenticated with an API key, the permission
+	// must then also be in the scope of the key
+	APIKeyID int
+}
+
+func (svc *Service) HasPermission(subject Subject, requiredPermission string) bool {
+	if subject.APIKeyID != 0 {
+		return svc.hasAPIKeyPermission(subject.UserID, subject.APIKeyID, requiredPermission)
+	}
+	return svc.userHasPermission(subject.UserID, requiredPermission)
 }
 
-func HasPermission(userID int, requiredPermission string) bool {
-	userPermissions, err := database.GetUserPermissions(userID)
+func (svc *Service) userHasPermission(userID int, requiredPermission string) bool {
+	userPermissions, err := svc.store.GetUserPermissions(userID)
 	if err != nil {
 		return false
 	}
@@ -101,6 +134,31 @@ func HasPermission(userID int, requiredPermission string) bool {
 	return false
 }
 
-func GetAllUsersPermissions() ([]database.Permission, error) {
-	return database.GetAllUsersPermissions()
+// the owner of the key must still have the permission and the key must have
+// been created with it in its scope
+func (svc *Service) hasAPIKeyPermission(userID int, apiKeyID int, requiredPermission string) bool {
+	key, err := svc.store.GetAPIKey(apiKeyID)
+	if err != nil || key.Revoked || key.UserID != userID {
+		return false
+	}
+
+	if !svc.userHasPermission(key.UserID, requiredPermission) {
+		return false
+	}
+
+	keyPermissions, err := svc.store.GetAPIKeyPermissions(apiKeyID)
+	if err != nil {
+		return false
+	}
+
+	for _, perm := range keyPermissions {
+		if perm.Permission == requiredPermission {
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *Service) GetAllUsersPermissions() ([]database.Permission, error) {
+	return svc.store.GetAllUsersPermissions()
 }
@@ -1,6 +1,7 @@
 package StripeFunctions
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
@@ -14,10 +15,32 @@ import (
 	"github.com/stripe/stripe-go/v81/subscriptionschedule"
 )
 
+// Service creates the Stripe customers, subscriptions and payments of the
+// users of its store
+type Service struct {
+	store database.BillingStore
+	// when true users with an unverified email can not become Stripe
+	// customers, so every function that needs a customer refuses them
+	requireVerifiedEmail bool
+}
+
+func New(store database.BillingStore) *Service {
+	return &Service{store: store}
+}
+
+func (svc *Service) SetRequireVerifiedEmail(require bool) {
+	svc.requireVerifiedEmail = require
+}
+
 func CheckIfEmailIsBeingUsedInStripe(email string) bool {
+	return CheckIfEmailIsBeingUsedInStripeContext(context.Background(), email)
+}
+
+func CheckIfEmailIsBeingUsedInStripeContext(ctx context.Context, email string) bool {
 	params := &stripe.CustomerListParams{
 		Email: stripe.String(email),
 	}
+	params.Context = ctx
 	i := customer.List(params)
 	for i.Next() {
 		fmt.Println(i.Customer().Email)
@@ -29,7 +52,12 @@ func CheckIfEmailIsBeingUsedInStripe(email string) bool {
 }
 
 func CheckIfIDBeingUsedInStripe(id string) bool {
+	return CheckIfIDBeingUsedInStripeContext(context.Background(), id)
+}
+
+func CheckIfIDBeingUsedInStripeContext(ctx context.Context, id string) bool {
 	params := &stripe.CustomerListParams{}
+	params.Context = ctx
 	i := customer.List(params)
 	for i.Next() {
 		if i.Customer().Metadata["tokenize_id"] == id {
@@ -41,7 +69,13 @@ func CheckIfIDBeingUsedInStripe(id string) bool {
 }
 
 func GetCustomer(id string) (*stripe.Customer, error) {
-	customer, err := customer.Get(id, nil)
+	return GetCustomerContext(context.Background(), id)
+}
+
+func GetCustomerContext(ctx context.Context, id string) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	customer, err := customer.Get(id, params)
 	if err != nil {
 		log.Printf("Error getting customer: %v", err)
 		return nil, err
@@ -51,12 +85,21 @@ func GetCustomer(id string) (*stripe.Customer, error) {
 }
 
 // if custumer already exists in stripe it does not create a new one and uses the existing one
-func HandleCreatingCustomer(usr database.User) (*stripe.Customer, error) {
+func (svc *Service) HandleCreatingCustomer(usr database.User) (*stripe.Customer, error) {
+	return svc.HandleCreatingCustomerContext(context.Background(), usr)
+}
+
+// same as HandleCreatingCustomer but the Stripe calls and the database update
+// stop when ctx is done
+func (svc *Service) HandleCreatingCustomerContext(ctx context.Context, usr database.User) (*stripe.Customer, error) {
 
 	if usr.Email == "" {
 		fmt.Println("user email is empty")
 		return nil, fmt.Errorf("user email is empty")
 	}
+	if svc.requireVerifiedEmail && usr.PendingVerification {
+		return nil, fmt.Errorf("user email is not verified")
+	}
 	customer_id := strconv.Itoa(usr.ID)
 
 	// Criar ou atualizar cliente
@@ -68,27 +111,42 @@ func HandleCreatingCustomer(usr database.User) (*stripe.Customer, error) {
 			"username":    usr.Name,
 		},
 	}
+	customerParams.Context = ctx
 
-	customer_exists, err := customer.Get(usr.StripeID, nil)
+	getParams := &stripe.CustomerParams{}
+	getParams.Context = ctx
+	customer_exists, err := customer.Get(usr.StripeID, getParams)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		log.Printf("customer.Get problem assuming it does not exists")
 
-		if CheckIfEmailIsBeingUsedInStripe(usr.Email) {
+		if CheckIfEmailIsBeingUsedInStripeContext(ctx, usr.Email) {
 			log.Printf("email already in use")
 			return nil, fmt.Errorf("email already in use")
 		}
 
-		if CheckIfIDBeingUsedInStripe(customer_id) {
+		if CheckIfIDBeingUsedInStripeContext(ctx, customer_id) {
 			log.Printf("%s", "id already in use by "+customer_id)
 			return nil, fmt.Errorf("id already in use BIG PROBLEM")
 		}
 
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
 		finalCustomer, err = customer.New(customerParams)
 		if err != nil {
 			log.Printf("customer.New: %v", err)
 			return nil, err
 		}
-		database.SetUserStripeID(usr.ID, finalCustomer.ID)
+		// the customer exists in Stripe now, so its ID is saved even if the
+		// request that created it is gone
+		if err := svc.store.SetUserStripeIDContext(context.WithoutCancel(ctx), usr.ID, finalCustomer.ID); err != nil {
+			log.Printf("Error saving the Stripe customer %s of user %d: %v", finalCustomer.ID, usr.ID, err)
+			return nil, err
+		}
 
 	} else {
 		finalCustomer = customer_exists
@@ -99,6 +157,7 @@ func HandleCreatingCustomer(usr database.User) (*stripe.Customer, error) {
 					"username":    usr.Name,
 				},
 			}
+			customerParams.Context = ctx
 			_, err := customer.Update(finalCustomer.ID, customerParams)
 			if err != nil {
 				log.Printf("Error updating customer metadata: %v", err)
@@ -110,8 +169,12 @@ func HandleCreatingCustomer(usr database.User) (*stripe.Customer, error) {
 	return finalCustomer, nil
 }
 
-func GetEndDateUserStripe(userId int) (database.Date, error) {
-	user, err := database.GetUser(userId)
+func (svc *Service) GetEndDateUserStripe(userId int) (database.Date, error) {
+	return svc.GetEndDateUserStripeContext(context.Background(), userId)
+}
+
+func (svc *Service) GetEndDateUserStripeContext(ctx context.Context, userId int) (database.Date, error) {
+	user, err := svc.store.GetUserContext(ctx, userId)
 	if err != nil {
 		return database.Date{}, err
 	}
@@ -124,6 +187,7 @@ func GetEndDateUserStripe(userId int) (database.Date, error) {
 		Customer: stripe.String(user.StripeID),
 		Status:   stripe.String("all"), // Include all statuses to catch trials
 	}
+	params.Context = ctx
 
 	var lastEnd int64
 	lastEnd = 0
@@ -145,6 +209,9 @@ func GetEndDateUserStripe(userId int) (database.Date, error) {
 		}
 	}
 
+	if ctx.Err() != nil {
+		return database.Date{}, ctx.Err()
+	}
 	if lastEnd == 0 {
 		return database.Date{}, fmt.Errorf("no end date available or no stripe id")
 	}
@@ -178,13 +245,14 @@ func (s Subscription) String() string {
 		s.Schedule)
 }
 
-func getNormalSubs(user database.User, wg *sync.WaitGroup, res *[]Subscription) {
+func getNormalSubs(ctx context.Context, user database.User, wg *sync.WaitGroup, res *[]Subscription) {
 	defer wg.Done()
 	// Fetch active subscriptions
 	params := &stripe.SubscriptionListParams{
 		Customer: stripe.String(user.StripeID),
 		Status:   stripe.String("all"),
 	}
+	params.Context = ctx
 
 	i := subscription.List(params)
 	for i.Next() {
@@ -211,12 +279,13 @@ func getNormalSubs(user database.User, wg *sync.WaitGroup, res *[]Subscription)
 	}
 }
 
-func getScheduledSubs(user database.User, wg *sync.WaitGroup, res *[]Subscription) {
+func getScheduledSubs(ctx context.Context, user database.User, wg *sync.WaitGroup, res *[]Subscription) {
 	defer wg.Done()
 	// Fetch active subscriptions
 	scheduleParams := &stripe.SubscriptionScheduleListParams{
 		Customer: stripe.String(user.StripeID),
 	}
+	scheduleParams.Context = ctx
 
 	scheduleList := subscriptionschedule.List(scheduleParams)
 	for scheduleList.Next() {
@@ -246,27 +315,41 @@ func getScheduledSubs(user database.User, wg *sync.WaitGroup, res *[]Subscriptio
 	}
 }
 
-func GetAllSubscriptions(userID int) ([]Subscription, error) {
+func (svc *Service) GetAllSubscriptions(userID int) ([]Subscription, error) {
+	return svc.GetAllSubscriptionsContext(context.Background(), userID)
+}
+
+// same as GetAllSubscriptions but the lookups stop when ctx is done, a
+// cancelled ctx returns its error instead of a partial list
+func (svc *Service) GetAllSubscriptionsContext(ctx context.Context, userID int) ([]Subscription, error) {
 	var wg sync.WaitGroup
-	var res []Subscription
+	// every goroutine appends to its own slice, they are joined after Wait
+	var normal, scheduled []Subscription
 
-	user, err := database.GetUser(userID)
+	user, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, fmt.Errorf("error getting user")
 	}
 
 	wg.Add(2)
 
-	go getNormalSubs(user, &wg, &res)
-	go getScheduledSubs(user, &wg, &res)
+	go getNormalSubs(ctx, user, &wg, &normal)
+	go getScheduledSubs(ctx, user, &wg, &scheduled)
 
 	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return append(normal, scheduled...), nil
+}
 
-	return res, nil
+func (svc *Service) GetUserIdWithStripeID(stripeID string) (int, error) {
+	return svc.GetUserIdWithStripeIDContext(context.Background(), stripeID)
 }
 
-func GetUserIdWithStripeID(stripeID string) (int, error) {
-	user, err := database.GetUserByStripeID(stripeID)
+func (svc *Service) GetUserIdWithStripeIDContext(ctx context.Context, stripeID string) (int, error) {
+	user, err := svc.store.GetUserByStripeIDContext(ctx, stripeID)
 	if err != nil {
 		return -1, err
 	}
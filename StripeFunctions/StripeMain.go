@@ -1,9 +1,9 @@
 package StripeFunctions
 
 import (
+	"context"
 	"time"
 
-	"github.com/Maruqes/Tokenize/database"
 	"github.com/stripe/stripe-go/v81"
 	"github.com/stripe/stripe-go/v81/checkout/session"
 	"github.com/stripe/stripe-go/v81/paymentintent"
@@ -12,15 +12,20 @@ import (
 	"github.com/stripe/stripe-go/v81/subscriptionschedule"
 )
 
-func CreateSubscription(userID int, trial_duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.Subscription, error) {
+func (svc *Service) CreateSubscription(userID int, trial_duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.Subscription, error) {
+	return svc.CreateSubscriptionContext(context.Background(), userID, trial_duration, PriceID, extraMetadata)
+}
+
+// same as CreateSubscription but the database and Stripe calls stop when ctx is done
+func (svc *Service) CreateSubscriptionContext(ctx context.Context, userID int, trial_duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.Subscription, error) {
 	trialEnd := time.Now().Add(trial_duration).Unix()
 
-	usrDB, err := database.GetUser(userID)
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	usrStripe, err := HandleCreatingCustomer(usrDB)
+	usrStripe, err := svc.HandleCreatingCustomerContext(ctx, usrDB)
 	if err != nil {
 		return nil, err
 	}
@@ -44,6 +49,7 @@ func CreateSubscription(userID int, trial_duration time.Duration, PriceID string
 		Metadata: metadata,
 	}
 
+	params.Context = ctx
 	sub, err := subscription.New(params)
 	if err != nil {
 		return nil, err
@@ -52,15 +58,19 @@ func CreateSubscription(userID int, trial_duration time.Duration, PriceID string
 }
 
 // callback only calls when the start time is reached
-func CreateScheduledSubscription(userID int, start time.Time, trial_duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.SubscriptionSchedule, error) {
+func (svc *Service) CreateScheduledSubscription(userID int, start time.Time, trial_duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.SubscriptionSchedule, error) {
+	return svc.CreateScheduledSubscriptionContext(context.Background(), userID, start, trial_duration, PriceID, extraMetadata)
+}
+
+func (svc *Service) CreateScheduledSubscriptionContext(ctx context.Context, userID int, start time.Time, trial_duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.SubscriptionSchedule, error) {
 	trialEnd := start.Add(trial_duration).Unix()
 
-	usrDB, err := database.GetUser(userID)
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	usrStripe, err := HandleCreatingCustomer(usrDB)
+	usrStripe, err := svc.HandleCreatingCustomerContext(ctx, usrDB)
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +99,7 @@ func CreateScheduledSubscription(userID int, start time.Time, trial_duration tim
 		Metadata: metadata,
 	}
 
+	params.Context = ctx
 	schedule, err := subscriptionschedule.New(params)
 	if err != nil {
 		return nil, err
@@ -96,15 +107,19 @@ func CreateScheduledSubscription(userID int, start time.Time, trial_duration tim
 	return schedule, nil
 }
 
-func CreateFreeTrial(userID int, start time.Time, duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.Subscription, error) {
+func (svc *Service) CreateFreeTrial(userID int, start time.Time, duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.Subscription, error) {
+	return svc.CreateFreeTrialContext(context.Background(), userID, start, duration, PriceID, extraMetadata)
+}
+
+func (svc *Service) CreateFreeTrialContext(ctx context.Context, userID int, start time.Time, duration time.Duration, PriceID string, extraMetadata map[string]string) (*stripe.Subscription, error) {
 	trialEnd := start.Add(duration).Unix()
 
-	usrDB, err := database.GetUser(userID)
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	usrStripe, err := HandleCreatingCustomer(usrDB)
+	usrStripe, err := svc.HandleCreatingCustomerContext(ctx, usrDB)
 	if err != nil {
 		return nil, err
 	}
@@ -130,6 +145,7 @@ func CreateFreeTrial(userID int, start time.Time, duration time.Duration, PriceI
 		Metadata: metadata,
 	}
 
+	params.Context = ctx
 	sub, err := subscription.New(params)
 	if err != nil {
 		return nil, err
@@ -137,13 +153,17 @@ func CreateFreeTrial(userID int, start time.Time, duration time.Duration, PriceI
 	return sub, nil
 }
 
-func CreatePayment(userID int, amount float64, extraMetadata map[string]string) (*stripe.PaymentIntent, error) {
-	usrDB, err := database.GetUser(userID)
+func (svc *Service) CreatePayment(userID int, amount float64, extraMetadata map[string]string) (*stripe.PaymentIntent, error) {
+	return svc.CreatePaymentContext(context.Background(), userID, amount, extraMetadata)
+}
+
+func (svc *Service) CreatePaymentContext(ctx context.Context, userID int, amount float64, extraMetadata map[string]string) (*stripe.PaymentIntent, error) {
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	usrStripe, err := HandleCreatingCustomer(usrDB)
+	usrStripe, err := svc.HandleCreatingCustomerContext(ctx, usrDB)
 	if err != nil {
 		return nil, err
 	}
@@ -165,6 +185,7 @@ func CreatePayment(userID int, amount float64, extraMetadata map[string]string)
 		Metadata: metadata,
 	}
 
+	params.Context = ctx
 	pi, err := paymentintent.New(params)
 	if err != nil {
 		return nil, err
@@ -172,14 +193,19 @@ func CreatePayment(userID int, amount float64, extraMetadata map[string]string)
 	return pi, nil
 }
 
-func CreatePaymentPage(userID int, amount float64, imageURL, description string,
+func (svc *Service) CreatePaymentPage(userID int, amount float64, imageURL, description string,
 	extraMetadata map[string]string, success_url string, cancel_url string) (*stripe.CheckoutSession, error) {
-	usrDB, err := database.GetUser(userID)
+	return svc.CreatePaymentPageContext(context.Background(), userID, amount, imageURL, description, extraMetadata, success_url, cancel_url)
+}
+
+func (svc *Service) CreatePaymentPageContext(ctx context.Context, userID int, amount float64, imageURL, description string,
+	extraMetadata map[string]string, success_url string, cancel_url string) (*stripe.CheckoutSession, error) {
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	usrStripe, err := HandleCreatingCustomer(usrDB)
+	usrStripe, err := svc.HandleCreatingCustomerContext(ctx, usrDB)
 	if err != nil {
 		return nil, err
 	}
@@ -220,6 +246,7 @@ func CreatePaymentPage(userID int, amount float64, imageURL, description string,
 		},
 	}
 
+	params.Context = ctx
 	sess, err := session.New(params)
 	if err != nil {
 		return nil, err
@@ -227,14 +254,19 @@ func CreatePaymentPage(userID int, amount float64, imageURL, description string,
 	return sess, nil
 }
 
-func CreateSubscriptionPage(userID int, priceID string, extraMetadata map[string]string,
+func (svc *Service) CreateSubscriptionPage(userID int, priceID string, extraMetadata map[string]string,
+	success_url string, cancel_url string) (*stripe.CheckoutSession, error) {
+	return svc.CreateSubscriptionPageContext(context.Background(), userID, priceID, extraMetadata, success_url, cancel_url)
+}
+
+func (svc *Service) CreateSubscriptionPageContext(ctx context.Context, userID int, priceID string, extraMetadata map[string]string,
 	success_url string, cancel_url string) (*stripe.CheckoutSession, error) {
-	usrDB, err := database.GetUser(userID)
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	usrStripe, err := HandleCreatingCustomer(usrDB)
+	usrStripe, err := svc.HandleCreatingCustomerContext(ctx, usrDB)
 	if err != nil {
 		return nil, err
 	}
@@ -265,6 +297,7 @@ func CreateSubscriptionPage(userID int, priceID string, extraMetadata map[string
 		},
 	}
 
+	params.Context = ctx
 	sess, err := session.New(params)
 	if err != nil {
 		return nil, err
@@ -272,8 +305,12 @@ func CreateSubscriptionPage(userID int, priceID string, extraMetadata map[string
 	return sess, nil
 }
 
-func CheckUserPaymentMethod(userID int) (bool, error) {
-	usrDB, err := database.GetUser(userID)
+func (svc *Service) CheckUserPaymentMethod(userID int) (bool, error) {
+	return svc.CheckUserPaymentMethodContext(context.Background(), userID)
+}
+
+func (svc *Service) CheckUserPaymentMethodContext(ctx context.Context, userID int) (bool, error) {
+	usrDB, err := svc.store.GetUserContext(ctx, userID)
 	if err != nil {
 		return false, err
 	}
@@ -286,6 +323,7 @@ func CheckUserPaymentMethod(userID int) (bool, error) {
 		Type:     stripe.String("card"),
 	}
 
+	params.Context = ctx
 	i := paymentmethod.List(params)
 	for i.Next() {
 		pm := i.PaymentMethod()
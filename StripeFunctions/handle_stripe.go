@@ -31,7 +31,7 @@ func CallCallBack(event stripe.Event) {
 // 		return
 // 	}
 
-// 	user, err := database.GetUserByStripeID(subscription.Customer.ID)
+// 	user, err := store.GetUserByStripeID(subscription.Customer.ID)
 // 	if err != nil {
 // 		fmt.Println(err)
 // 		return
@@ -42,7 +42,7 @@ func CallCallBack(event stripe.Event) {
 // 		return
 // 	}
 
-// 	err = database.DeactivateUser(user.ID)
+// 	err = store.DeactivateUser(user.ID)
 // 	if err != nil {
 // 		fmt.Println(err)
 // 		return
@@ -64,7 +64,7 @@ func CallCallBack(event stripe.Event) {
 // 		return
 // 	}
 
-// 	user, err := database.GetUserByStripeID(invoice.Customer.ID)
+// 	user, err := store.GetUserByStripeID(invoice.Customer.ID)
 // 	if err != nil {
 // 		fmt.Println(err)
 // 		return
@@ -75,7 +75,7 @@ func CallCallBack(event stripe.Event) {
 // 		return
 // 	}
 
-// 	err = database.ActivateUser(user.ID)
+// 	err = store.ActivateUser(user.ID)
 // 	if err != nil {
 // 		fmt.Println(err)
 // 		return
@@ -1,20 +1,29 @@
 package Tokenize
 
 import (
+	"cmp"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Maruqes/Tokenize/CSRF"
 	functions "github.com/Maruqes/Tokenize/Functions"
 	"github.com/Maruqes/Tokenize/Login"
 	"github.com/Maruqes/Tokenize/Logs"
+	"github.com/Maruqes/Tokenize/Mail"
+	"github.com/Maruqes/Tokenize/Permissions"
 	"github.com/Maruqes/Tokenize/StripeFunctions"
+	"github.com/Maruqes/Tokenize/UserFuncs"
 	"github.com/Maruqes/Tokenize/database"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -26,41 +35,25 @@ import (
 
 //falta joia (codigo desconto)
 
-var domain = os.Getenv("DOMAIN")
-
-func createPortalSession(w http.ResponseWriter, r *http.Request) {
-
-	login := Login.CheckToken(r)
-	if !login {
-		http.Error(w, "Not logged in", http.StatusUnauthorized)
-		return
-	}
-
-	//get id
-	customer_id_cookie, err := r.Cookie("id")
-	if err != nil {
-		http.Error(w, "Error getting id", http.StatusInternalServerError)
+func (srv *Server) createPortalSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	customer_id := customer_id_cookie.Value
 
-	//get customer
-	customerIDInt, err := strconv.Atoi(customer_id)
-	if err != nil {
-		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
-		return
-	}
-	usr, err := database.GetUser(customerIDInt)
-	if err != nil {
-		http.Error(w, "Error getting customer", http.StatusInternalServerError)
+	usr, ok := Login.CurrentUser(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
 	}
+	customer_id := strconv.Itoa(usr.ID)
 
 	// Authenticate your user.
 	params := &stripe.BillingPortalSessionParams{
 		Customer:  stripe.String(usr.StripeID),
-		ReturnURL: stripe.String(domain),
+		ReturnURL: stripe.String(srv.domain),
 	}
+	params.Context = r.Context()
 	ps, err := portalsession.New(params)
 	if err != nil {
 		log.Printf("Error creating portal session: %v", err)
@@ -104,14 +97,13 @@ func handleWebhook(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func createUser(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) createUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	login := Login.CheckToken(r)
-	if login {
+	if _, loggedIn := Login.CurrentUser(r.Context()); loggedIn {
 		http.Error(w, "Already logged in, cant create an account", http.StatusUnauthorized)
 		return
 	}
@@ -143,8 +135,7 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//enviar email de confirmacao
-	id, err := database.AddUser("", credentials.Email, credentials.Username, credentials.Password)
+	id, err := srv.store.AddUserContext(r.Context(), "", credentials.Email, credentials.Username, credentials.Password)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Failed to create user check the credentials with err: "+err.Error(), http.StatusInternalServerError)
@@ -152,19 +143,33 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	}
 	Logs.LogMessage("User created with id/name " + strconv.Itoa(int(id)) + "/" + credentials.Username)
 
+	usr, err := srv.store.GetUserContext(r.Context(), int(id))
+	if err == nil {
+		err = srv.Login.SendVerificationEmail(usr)
+	}
+	if err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf(`{"id": %d}`, id)))
 }
 
-func loginUsr(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) loginUsr(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
 	var credentials struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		// either of them, the email field also accepts a username
+		Email      string `json:"email"`
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		RememberMe bool   `json:"remember_me"`
+		Refresh    bool   `json:"refresh"`
+		// clients that can not use cookies get the token in the response
+		ReturnToken bool `json:"return_token"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&credentials)
@@ -173,209 +178,1655 @@ func loginUsr(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Received credentials: %s / %s", credentials.Email, credentials.Password)
+	identifier := strings.TrimSpace(credentials.Email)
+	if identifier == "" {
+		identifier = strings.TrimSpace(credentials.Username)
+	}
+
+	log.Printf("Received login for: %s", identifier)
 
-	Logs.LogMessage("Login attempt with email " + credentials.Email)
+	Logs.LogMessage("Login attempt with email/username " + identifier)
 
-	if credentials.Email == "" || credentials.Password == "" {
+	if identifier == "" || credentials.Password == "" {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	isValidEmailTest := functions.IsValidEmail(credentials.Email)
-	if !isValidEmailTest {
+	if strings.Contains(identifier, "@") && !functions.IsValidEmail(identifier) {
 		http.Error(w, "Invalid email", http.StatusBadRequest)
 		return
 	}
 
-	token, usr, err := Login.LoginUser(credentials.Email, credentials.Password)
-	if err != nil || token == "" {
-		http.Error(w, "Failed to login", http.StatusInternalServerError)
+	var session Login.Login
+	var refreshToken string
+	var usr database.User
+	if credentials.Refresh {
+		session, refreshToken, usr, err = srv.Login.LoginUserWithRefreshFromIPContext(r.Context(), identifier, credentials.Password, Login.ClientIP(r))
+	} else {
+		session, usr, err = srv.Login.LoginUserSessionFromIPContext(r.Context(), identifier, credentials.Password, credentials.RememberMe, Login.ClientIP(r))
+	}
+
+	var locked *Login.LoginLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())+1))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
 		return
 	}
 
-	// Set cookies with expiration in 5 days
-	http.SetCookie(w, &http.Cookie{
-		Name:     "id",
-		Value:    strconv.Itoa(usr.ID),
-		Secure:   true,
-		HttpOnly: true,
-		Expires:  time.Now().Add(5 * 24 * time.Hour),
-	})
+	if errors.Is(err, Login.ErrEmailNotVerified) {
+		http.Error(w, "Email not verified", http.StatusForbidden)
+		return
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-		Expires:  time.Now().Add(5 * 24 * time.Hour),
-	})
+	var twoFactor *Login.TwoFactorRequiredError
+	if errors.As(err, &twoFactor) {
+		Logs.LogMessage("Login waiting for two factor code for user with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+		writeJSON(w, map[string]any{
+			"two_factor_required": true,
+			"pending_token":       twoFactor.PendingToken,
+			"methods":             twoFactor.Methods,
+		})
+		return
+	}
+	if err != nil || session.Token == "" {
+		http.Error(w, "Failed to login", http.StatusInternalServerError)
+		return
+	}
 
 	Logs.LogMessage("User logged in with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	srv.writeLoginResponse(w, r, session, refreshToken, credentials.ReturnToken)
+}
 
+// sets the session cookies, the token is also returned as JSON when the client
+// asked for it or when there is a refresh token
+func (srv *Server) writeLoginResponse(w http.ResponseWriter, r *http.Request, session Login.Login, refreshToken string, returnToken bool) {
+	srv.recordSessionClient(r, session)
+	setSessionCookies(w, session)
+
+	if refreshToken != "" {
+		writeJSON(w, map[string]any{
+			"id":            session.UserID,
+			"token":         session.Token,
+			"expires":       session.Expires,
+			"refresh_token": refreshToken,
+		})
+		return
+	}
+	if returnToken {
+		writeJSON(w, map[string]any{
+			"id":      session.UserID,
+			"token":   session.Token,
+			"expires": session.Expires,
+		})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func logoutUsr(w http.ResponseWriter, r *http.Request) {
+// saves the IP and user agent of a new session, a failure does not fail the login
+func (srv *Server) recordSessionClient(r *http.Request, session Login.Login) {
+	if err := srv.Login.RecordSessionClient(session, Login.ClientIP(r), r.UserAgent()); err != nil {
+		log.Printf("Error saving session client: %v", err)
+	}
+}
 
-	login_Q := Login.CheckToken(r)
-	if !login_Q {
-		http.Error(w, "Not logged in", http.StatusUnauthorized)
+func writeJSON(w http.ResponseWriter, v any) {
+	jsonResponse, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// exchanges a refresh token for a new access token and a new refresh token
+func (srv *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	id, err := r.Cookie("id")
-	if err != nil {
-		http.Error(w, "Error getting id", http.StatusInternalServerError)
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	idInt, err := strconv.Atoi(id.Value)
+	session, newRefreshToken, usr, err := srv.Login.RefreshSession(body.RefreshToken)
+	if errors.Is(err, Login.ErrUserProhibited) {
+		http.Error(w, "User is prohibited", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, Login.ErrEmailNotVerified) {
+		http.Error(w, "Email not verified", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
 	}
 
-	Login.LogoutUser(idInt)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "id",
-		Value:    "",
-		MaxAge:   -1,
-		Secure:   true,
-		HttpOnly: true,
-	})
+	Logs.LogMessage("Refresh token used by user with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	srv.writeLoginResponse(w, r, session, newRefreshToken, true)
+}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		MaxAge:   -1,
-		Secure:   true,
-		HttpOnly: true,
-	})
+// second step of the login for users with 2FA, takes the pending token returned
+// by /login-user and a TOTP or recovery code
+func (srv *Server) verifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-	Logs.LogMessage("User logged out with id " + strconv.Itoa(idInt))
+	var body struct {
+		PendingToken string `json:"pending_token"`
+		Code         string `json:"code"`
+		ReturnToken  bool   `json:"return_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.PendingToken == "" || body.Code == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	session, refreshToken, usr, err := srv.Login.VerifyTwoFactorLogin(body.PendingToken, body.Code)
+	if err != nil {
+		Logs.LogMessage("Failed two factor login for user with id " + strconv.Itoa(usr.ID))
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	Logs.LogMessage("User logged in with two factor with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	srv.writeLoginResponse(w, r, session, refreshToken, body.ReturnToken)
 }
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// starts the 2FA enrollment, returns the otpauth URI for the authenticator app
+func (srv *Server) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	uri, err := srv.Login.EnrollTwoFactor(session.UserID)
+	if err != nil {
+		http.Error(w, "Failed to enroll two factor: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, map[string]string{"otpauth_uri": uri})
 }
 
-var PRECO_SUB uint64
-var lastTimePrecoSub time.Time
+// enables 2FA with the first code of the app and returns the recovery codes
+func (srv *Server) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-func getPrecoSub(w http.ResponseWriter, r *http.Request) {
-	if time.Since(lastTimePrecoSub) > 10*time.Minute {
-		priceStripe, err := price.Get(os.Getenv("SUBSCRIPTION_PRICE_ID"), nil)
-		if err != nil {
-			http.Error(w, "Failed to get price", http.StatusInternalServerError)
-			return
-		}
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
 
-		PRECO_SUB = uint64(priceStripe.UnitAmount)
-		lastTimePrecoSub = time.Now()
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Code == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
 	}
 
-	amount := float64(PRECO_SUB) / 100
-	response := map[string]float64{"preco": amount}
-	jsonResponse, err := json.Marshal(response)
+	codes, err := srv.Login.ConfirmTwoFactor(session.UserID, body.Code)
 	if err != nil {
-		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		http.Error(w, "Failed to confirm two factor: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonResponse)
 
+	Logs.LogMessage("Two factor enabled for user with id " + strconv.Itoa(session.UserID))
+	writeJSON(w, map[string][]string{"recovery_codes": codes})
 }
 
-var initialized bool = false
-
-func Initialize() *sql.DB {
-	functions.CheckAllEnv()
-	fmt.Println("Init")
+func (srv *Server) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-	db := database.Init()
-	database.CreateTable()
-	database.CreatePermissionsTable()
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
 
-	Logs.InitLogs()
-	Login.Init()
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Code == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-	stripe.Key = os.Getenv("SECRET_KEY")
+	err = srv.Login.DisableTwoFactor(session.UserID, body.Code)
+	if err != nil {
+		http.Error(w, "Failed to disable two factor", http.StatusBadRequest)
+		return
+	}
 
-	initialized = true
-	return db
+	Logs.LogMessage("Two factor disabled for user with id " + strconv.Itoa(session.UserID))
+	w.WriteHeader(http.StatusOK)
 }
 
+// emails a one time login link, the response sets a cookie that binds the
+// link to this browser when LOGIN_LINK_SAME_BROWSER=True
+func (srv *Server) requestLoginLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-func test(w http.ResponseWriter, r *http.Request) {
-	PriceID := os.Getenv("SUBSCRIPTION_PRICE_ID")
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Email == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-	// StripeFunctions.CreateSubscription(1, time.Hour*24*30, PriceID, testeEvent, map[string]string{"extra": "testeCreateSubscription"})
+	// always answers OK so the response does not tell if the email exists
+	browserSecret, err := srv.Login.RequestLoginLink(body.Email)
+	if err != nil {
+		log.Printf("Error requesting login link: %v", err)
+	}
+	if browserSecret != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "login_link",
+			Value:    browserSecret,
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	// StripeFunctions.CreateScheduledSubscription(2, time.Now().AddDate(0, 6, 0), time.Hour*24*30*6, PriceID, testeEvent, map[string]string{"extra": "testeCreateScheduledSubscription"})
+// answers like /login-user
+func (srv *Server) loginWithLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-	// StripeFunctions.CreateFreeTrial(3, time.Now().AddDate(0, 0, 0), time.Hour*24*30*6, PriceID, testeEvent, map[string]string{"extra": "CreateFreeTrial"})
+	var body struct {
+		Token       string `json:"token"`
+		RememberMe  bool   `json:"remember_me"`
+		Refresh     bool   `json:"refresh"`
+		ReturnToken bool   `json:"return_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Token == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-	// StripeFunctions.CreatePayment(4, 49.99, testeEvent, map[string]string{"extra": "CreatePayment"})
+	var browserSecret string
+	if cookie, err := r.Cookie("login_link"); err == nil {
+		browserSecret = cookie.Value
+	}
 
-	payment2, err := StripeFunctions.CreateSubscriptionPage(1, PriceID, map[string]string{"extra": "testzaomeudeus"},
-		domain+"/success", domain+"/cancel")
+	session, refreshToken, usr, err := srv.Login.LoginWithLink(body.Token, browserSecret, body.RememberMe, body.Refresh)
+	var twoFactor *Login.TwoFactorRequiredError
+	if errors.As(err, &twoFactor) {
+		Logs.LogMessage("Login link waiting for two factor code for user with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+		writeJSON(w, map[string]any{
+			"two_factor_required": true,
+			"pending_token":       twoFactor.PendingToken,
+			"methods":             twoFactor.Methods,
+		})
+		return
+	}
+	if errors.Is(err, Login.ErrInvalidLoginLink) {
+		http.Error(w, "Invalid or expired link", http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
+		http.Error(w, "Failed to login", http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, payment2.URL, http.StatusSeeOther)
 
-	// payment, err := StripeFunctions.CreatePaymentPage(6, 49.99, testeEvent, "https://picsum.photos/200/300", "desc", map[string]string{"extra": "testzaomeudeus"},
-	// 	domain+"/success", domain+"/cancel")
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	http.Error(w, "Failed to create payment", http.StatusInternalServerError)
-	// 	return
-	// }
-	// // redirect to payment page
-	// http.Redirect(w, r, payment.URL, http.StatusSeeOther)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login_link",
+		Value:    "",
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	Logs.LogMessage("User logged in with login link with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	srv.writeLoginResponse(w, r, session, refreshToken, body.ReturnToken)
 }
 
-// set port like "4242"
-func InitListen(port string) {
-	if !initialized {
-		Initialize()
+// opened from the link of the verification email, also accepts POST with
+// {"token": "..."} for frontends that show their own page
+func (srv *Server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var token string
+	switch r.Method {
+	case "GET":
+		token = r.URL.Query().Get("token")
+	case "POST":
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		token = body.Token
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if token == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
 	}
 
-	port_int, err := strconv.Atoi(port)
+	usr, err := srv.Login.VerifyEmail(token)
+	if errors.Is(err, Login.ErrInvalidVerifyToken) {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Fatal("Invalid port")
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
 	}
-	if port_int <= 0 || port_int > 65535 {
-		log.Fatal("Invalid port")
+
+	Logs.LogMessage("Email verified for user with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Email verified"))
+}
+
+func (srv *Server) resendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
 	}
 
-	// PriceID := os.Getenv("SUBSCRIPTION_PRICE_ID")
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Email == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-	http.HandleFunc("/create-portal-session", createPortalSession) //para checkar info da subscricao
-	http.HandleFunc("/webhook", handleWebhook)
+	err = srv.Login.ResendVerificationEmail(body.Email)
+	if errors.Is(err, Login.ErrVerificationThrottled) {
+		http.Error(w, "Verification email sent recently, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Error resending verification email: %v", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	//auth
-	http.HandleFunc("/create-user", createUser)
-	http.HandleFunc("/login-user", loginUsr)
-	http.HandleFunc("/logout-user", logoutUsr)
+func (srv *Server) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
 
-	http.HandleFunc("/health", healthCheck)
-	http.HandleFunc("/getPrecoSub", getPrecoSub)
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Email == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-	if os.Getenv("DEV") == "True" {
-		http.Handle("/", http.FileServer(http.Dir("public"))) //for testing
-		http.HandleFunc("/test", test)
+	// always answers OK so the response does not tell if the email exists
+	err = srv.Login.RequestPasswordReset(body.Email)
+	if err != nil {
+		log.Printf("Error requesting password reset: %v", err)
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	addr := "0.0.0.0:" + port
-	log.Printf("Listening on %s", addr)
+func (srv *Server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Token == "" || body.Password == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	usr, err := srv.Login.ResetPassword(body.Token, body.Password)
+	if errors.Is(err, Login.ErrInvalidResetToken) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	Logs.LogMessage("Password reset for user with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (srv *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.NewPassword == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = srv.Login.ChangePassword(session.UserID, body.OldPassword, body.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to change password", http.StatusBadRequest)
+		return
+	}
+
+	Logs.LogMessage("Password changed for user with id " + strconv.Itoa(session.UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// "remember me" sessions get persistent cookies that expire with the session,
+// the others only live until the browser is closed
+func setSessionCookies(w http.ResponseWriter, session Login.Login) {
+	var expires time.Time
+	if session.Remember {
+		expires = time.Unix(session.Expires, 0)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "id",
+		Value:    strconv.Itoa(session.UserID),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  expires,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    session.Token,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  expires,
+	})
+}
+
+func (srv *Server) logoutUsr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := Login.CurrentLogin(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	idInt := session.UserID
+
+	err := srv.Login.LogoutSession(idInt, session.Token)
+	if err != nil {
+		http.Error(w, "Failed to logout", http.StatusInternalServerError)
+		return
+	}
+
+	// clients using refresh tokens send it so it stops working too
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if json.NewDecoder(r.Body).Decode(&body) == nil && body.RefreshToken != "" {
+		srv.Login.RevokeRefreshToken(body.RefreshToken)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "id",
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	Logs.LogMessage("User logged out with id " + strconv.Itoa(idInt))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type sessionResponse struct {
+	ID           string `json:"id"`
+	IP           string `json:"ip"`
+	UserAgent    string `json:"user_agent"`
+	Created      int64  `json:"created"`
+	LastSeen     int64  `json:"last_seen"`
+	Expires      int64  `json:"expires"`
+	Remember     bool   `json:"remember"`
+	Current      bool   `json:"current"`
+	Impersonated bool   `json:"impersonated"`
+}
+
+// the devices where the user is logged in, newest first
+func (srv *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := srv.Login.GetUserSessions(session.UserID)
+	if err != nil {
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	slices.SortFunc(sessions, func(a, b Login.Login) int {
+		return cmp.Compare(b.Created, a.Created)
+	})
+
+	response := []sessionResponse{}
+	for _, other := range sessions {
+		response = append(response, sessionResponse{
+			ID:           other.ID,
+			IP:           other.IP,
+			UserAgent:    other.UserAgent,
+			Created:      other.Created,
+			LastSeen:     other.LastSeen,
+			Expires:      other.Expires,
+			Remember:     other.Remember,
+			Current:      other.ID == session.ID,
+			Impersonated: other.ImpersonatorID != 0,
+		})
+	}
+	writeJSON(w, response)
+}
+
+// {"id": "..."} logs out one of the user's sessions
+func (srv *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.ID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = srv.Login.RevokeSession(session.UserID, body.ID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	Logs.LogMessage("Session " + body.ID + " revoked by user with id " + strconv.Itoa(session.UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (srv *Server) beginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	options, err := srv.Login.BeginPasskeyRegistration(session.UserID)
+	if err != nil {
+		http.Error(w, "Failed to start passkey registration", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, options)
+}
+
+func (srv *Server) finishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name       string                            `json:"name"`
+		Credential Login.PasskeyRegistrationResponse `json:"credential"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	passkey, err := srv.Login.FinishPasskeyRegistration(session.UserID, body.Name, body.Credential)
+	if err != nil {
+		http.Error(w, "Failed to register passkey: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	Logs.LogMessage("Passkey " + strconv.Itoa(passkey.ID) + " registered for user with id " + strconv.Itoa(session.UserID))
+	writeJSON(w, map[string]any{"id": passkey.ID, "name": passkey.Name})
+}
+
+// without a pending_token starts a passwordless login, with the pending_token
+// of /login-user the passkey is used as the second factor
+func (srv *Server) beginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		PendingToken string `json:"pending_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	options, err := srv.Login.BeginPasskeyLogin(body.PendingToken)
+	if err != nil {
+		http.Error(w, "Failed to start passkey login: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, options)
+}
+
+func (srv *Server) finishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Credential  Login.PasskeyLoginResponse `json:"credential"`
+		RememberMe  bool                       `json:"remember_me"`
+		Refresh     bool                       `json:"refresh"`
+		ReturnToken bool                       `json:"return_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	session, refreshToken, usr, err := srv.Login.FinishPasskeyLogin(body.Credential, body.RememberMe, body.Refresh)
+	if err != nil {
+		Logs.LogMessage("Failed passkey login: " + err.Error())
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	Logs.LogMessage("User logged in with passkey with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	srv.writeLoginResponse(w, r, session, refreshToken, body.ReturnToken)
+}
+
+func (srv *Server) listPasskeys(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	passkeys, err := srv.Login.ListPasskeys(session.UserID)
+	if err != nil {
+		http.Error(w, "Failed to list passkeys", http.StatusInternalServerError)
+		return
+	}
+
+	response := []map[string]any{}
+	for _, passkey := range passkeys {
+		response = append(response, map[string]any{
+			"id":        passkey.ID,
+			"name":      passkey.Name,
+			"created":   passkey.Created,
+			"last_used": passkey.LastUsed,
+		})
+	}
+	writeJSON(w, response)
+}
+
+func (srv *Server) deletePasskey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = srv.Login.DeletePasskey(session.UserID, body.ID)
+	if err != nil {
+		http.Error(w, "Failed to delete passkey", http.StatusNotFound)
+		return
+	}
+
+	Logs.LogMessage("Passkey " + strconv.Itoa(body.ID) + " deleted by user with id " + strconv.Itoa(session.UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// redirects to the OpenID Connect provider, ?provider=<name>&remember_me=true
+func (srv *Server) beginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider := r.URL.Query().Get("provider")
+	remember := r.URL.Query().Get("remember_me") == "true"
+
+	authURL, state, err := srv.Login.BeginOIDCLogin(provider, remember)
+	if errors.Is(err, Login.ErrUnknownOIDCProvider) {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting OpenID Connect login: %v", err)
+		http.Error(w, "Failed to start login", http.StatusBadGateway)
+		return
+	}
+
+	// binds the login to this browser, SameSite Lax so it is sent when the
+	// provider redirects back
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// the provider sends the user back here, on success it sets the same cookies
+// as /login-user and redirects to OIDC_LOGIN_REDIRECT (default "/")
+func (srv *Server) finishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		http.Error(w, "Login failed at the provider: "+query.Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	var browserState string
+	if cookie, err := r.Cookie("oidc_state"); err == nil {
+		browserState = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    "",
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+
+	redirect := os.Getenv("OIDC_LOGIN_REDIRECT")
+	if redirect == "" {
+		redirect = "/"
+	}
+
+	session, usr, err := srv.Login.FinishOIDCLogin(query.Get("state"), browserState, query.Get("code"))
+	var twoFactor *Login.TwoFactorRequiredError
+	if errors.As(err, &twoFactor) {
+		Logs.LogMessage("OpenID Connect login waiting for two factor code for user with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+		values := url.Values{
+			"two_factor_required": {"true"},
+			"pending_token":       {twoFactor.PendingToken},
+			"methods":             {strings.Join(twoFactor.Methods, ",")},
+		}
+		http.Redirect(w, r, redirect+"?"+values.Encode(), http.StatusFound)
+		return
+	}
+	if errors.Is(err, Login.ErrOIDCEmailNotVerified) {
+		http.Error(w, "The provider did not verify this email", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, Login.ErrOIDCAccountNotVerified) {
+		http.Error(w, "This email already has an account, verify it or log in with it to link the provider", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, Login.ErrEmailNotVerified) {
+		http.Error(w, "Email not verified", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error finishing OpenID Connect login: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	Logs.LogMessage("User logged in with OpenID Connect with id/name " + strconv.Itoa(usr.ID) + "/" + usr.Name)
+	srv.recordSessionClient(r, session)
+	setSessionCookies(w, session)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (srv *Server) listIdentities(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	identities, err := srv.Login.ListExternalIdentities(session.UserID)
+	if err != nil {
+		http.Error(w, "Failed to list identities", http.StatusInternalServerError)
+		return
+	}
+
+	response := []map[string]any{}
+	for _, identity := range identities {
+		response = append(response, map[string]any{
+			"id":       identity.ID,
+			"provider": identity.Provider,
+			"email":    identity.Email,
+			"created":  identity.Created,
+		})
+	}
+	writeJSON(w, response)
+}
+
+func (srv *Server) unlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = srv.Login.UnlinkExternalIdentity(session.UserID, body.ID)
+	if err != nil {
+		http.Error(w, "Failed to unlink identity", http.StatusNotFound)
+		return
+	}
+
+	Logs.LogMessage("External identity " + strconv.Itoa(body.ID) + " unlinked by user with id " + strconv.Itoa(session.UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+type apiKeyResponse struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Prefix      string   `json:"prefix"`
+	Created     int64    `json:"created"`
+	Expires     int64    `json:"expires"`
+	LastUsed    int64    `json:"last_used"`
+	Permissions []string `json:"permissions"`
+	Key         string   `json:"key,omitempty"`
+}
+
+func (srv *Server) newAPIKeyResponse(key database.APIKey) (apiKeyResponse, error) {
+	perms, err := srv.store.GetAPIKeyPermissions(key.ID)
+	if err != nil {
+		return apiKeyResponse{}, err
+	}
+	permissions := []string{}
+	for _, perm := range perms {
+		permissions = append(permissions, perm.Permission)
+	}
+	return apiKeyResponse{
+		ID:          key.ID,
+		Name:        key.Name,
+		Prefix:      key.Prefix,
+		Created:     key.Created,
+		Expires:     key.Expires,
+		LastUsed:    key.LastUsed,
+		Permissions: permissions,
+	}, nil
+}
+
+// API keys and 2FA can only be managed with a normal login, not with an API key,
+// the route must be wrapped in Login.RequireLogin
+func getSessionLogin(w http.ResponseWriter, r *http.Request) (Login.Login, bool) {
+	session, ok := Login.CurrentLogin(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return Login.Login{}, false
+	}
+	if session.APIKeyID != 0 {
+		http.Error(w, "Not allowed with an API key", http.StatusForbidden)
+		return Login.Login{}, false
+	}
+	return session, true
+}
+
+func (srv *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+		// unix time, 0 never expires
+		Expires     int64 `json:"expires"`
+		Permissions []int `json:"permissions"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Name == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var expires time.Time
+	if body.Expires != 0 {
+		expires = time.Unix(body.Expires, 0)
+	}
+
+	key, apiKey, err := srv.Login.CreateAPIKey(session.UserID, body.Name, expires, body.Permissions)
+	if err != nil {
+		http.Error(w, "Failed to create api key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := srv.newAPIKeyResponse(apiKey)
+	if err != nil {
+		http.Error(w, "Failed to get api key permissions", http.StatusInternalServerError)
+		return
+	}
+	response.Key = key
+
+	Logs.LogMessage("API key " + strconv.Itoa(apiKey.ID) + " created for user with id " + strconv.Itoa(session.UserID))
+	writeJSON(w, response)
+}
+
+func (srv *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := srv.Login.ListAPIKeys(session.UserID)
+	if err != nil {
+		http.Error(w, "Failed to list api keys", http.StatusInternalServerError)
+		return
+	}
+
+	response := []apiKeyResponse{}
+	for _, key := range keys {
+		keyResponse, err := srv.newAPIKeyResponse(key)
+		if err != nil {
+			http.Error(w, "Failed to get api key permissions", http.StatusInternalServerError)
+			return
+		}
+		response = append(response, keyResponse)
+	}
+	writeJSON(w, response)
+}
+
+func (srv *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = srv.Login.RevokeAPIKey(session.UserID, body.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke api key", http.StatusNotFound)
+		return
+	}
+
+	Logs.LogMessage("API key " + strconv.Itoa(body.ID) + " revoked by user with id " + strconv.Itoa(session.UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// {"user_id": 1} logs the admin in as that user, the ID of the admin's own
+// session is kept in the impersonator_session cookie until /stop-impersonation
+func (srv *Server) startImpersonation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		UserID      int  `json:"user_id"`
+		ReturnToken bool `json:"return_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	impersonated, _, err := srv.Login.StartImpersonation(session, body.UserID)
+	if errors.Is(err, Login.ErrImpersonationNotAllowed) {
+		http.Error(w, "Not allowed to impersonate this user", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to impersonate", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "impersonator_session",
+			Value:    session.ID,
+			Expires:  time.Unix(impersonated.Expires, 0),
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	srv.writeLoginResponse(w, r, impersonated, "", body.ReturnToken)
+}
+
+// ends the impersonated session and logs the admin back in when the
+// impersonator_session cookie names the session it was started from
+func (srv *Server) stopImpersonation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, ok := Login.CurrentLogin(r.Context())
+	if !ok {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	var impersonatorSession string
+	if cookie, err := r.Cookie("impersonator_session"); err == nil {
+		impersonatorSession = cookie.Value
+	}
+
+	admin, err := srv.Login.StopImpersonation(session, impersonatorSession)
+	if errors.Is(err, Login.ErrNotImpersonating) {
+		http.Error(w, "Not impersonating", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to stop impersonating", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "impersonator_session",
+		Value:    "",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	if admin.Token == "" {
+		http.SetCookie(w, &http.Cookie{Name: "id", Value: "", MaxAge: -1, Secure: true, HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "token", Value: "", MaxAge: -1, Secure: true, HttpOnly: true})
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	setSessionCookies(w, admin)
+	w.WriteHeader(http.StatusOK)
+}
+
+// public keys to verify the signed tokens, other services can cache this
+func (srv *Server) getOIDCConfiguration(w http.ResponseWriter, r *http.Request) {
+	jsonResponse, err := json.Marshal(srv.Login.GetOIDCConfiguration())
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(jsonResponse)
+}
+
+// start of the authorization code flow, users that are not logged in are sent
+// to OAUTH_LOGIN_URL and the ones that have to consent to OAUTH_CONSENT_URL
+func (srv *Server) oauthAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, redirectable, err := srv.Login.ParseAuthorizeRequest(r.URL.Query())
+	var oauthErr *Login.OAuthError
+	if err != nil && (!redirectable || !errors.As(err, &oauthErr)) {
+		http.Error(w, "Invalid authorization request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Redirect(w, r, req.ErrorRedirect(oauthErr), http.StatusFound)
+		return
+	}
+
+	session, ok := Login.CurrentLogin(r.Context())
+	if !ok || session.APIKeyID != 0 {
+		loginURL := os.Getenv("OAUTH_LOGIN_URL")
+		if loginURL == "" {
+			loginURL = "/login.html"
+		}
+		http.Redirect(w, r, loginURL+"?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+
+	redirect, consentID, err := srv.Login.Authorize(session, req)
+	if err != nil {
+		http.Error(w, "Failed to authorize", http.StatusInternalServerError)
+		return
+	}
+	if consentID != "" {
+		consentURL := os.Getenv("OAUTH_CONSENT_URL")
+		if consentURL == "" {
+			consentURL = "/consent.html"
+		}
+		http.Redirect(w, r, consentURL+"?consent_id="+url.QueryEscape(consentID), http.StatusFound)
+		return
+	}
+
+	Logs.LogMessage("OAuth authorization for client " + req.ClientID + " by user with id " + strconv.Itoa(session.UserID))
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// GET returns what the user is asked to allow, POST answers it with
+// {"consent_id", "approve"} and returns the URL to send the browser to
+func (srv *Server) oauthConsent(w http.ResponseWriter, r *http.Request) {
+	session, ok := getSessionLogin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		req, err := srv.Login.GetConsentRequest(session.UserID, r.URL.Query().Get("consent_id"))
+		if err != nil {
+			http.Error(w, "Invalid or expired consent request", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"client_id":   req.ClientID,
+			"client_name": req.ClientName,
+			"scopes":      req.Scopes,
+		})
+	case "POST":
+		var body struct {
+			ConsentID string `json:"consent_id"`
+			Approve   bool   `json:"approve"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.ConsentID == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		redirect, err := srv.Login.FinishConsent(session.UserID, body.ConsentID, body.Approve)
+		if err != nil {
+			http.Error(w, "Invalid or expired consent request", http.StatusBadRequest)
+			return
+		}
+		if body.Approve {
+			Logs.LogMessage("OAuth consent given by user with id " + strconv.Itoa(session.UserID))
+		}
+		writeJSON(w, map[string]string{"redirect": redirect})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// errors of the token and userinfo endpoints use the OAuth2 JSON format
+func writeOAuthError(w http.ResponseWriter, err error) {
+	var oauthErr *Login.OAuthError
+	if !errors.As(err, &oauthErr) {
+		log.Printf("OAuth error: %v", err)
+		oauthErr = &Login.OAuthError{Code: "server_error", Description: "internal error"}
+	}
+
+	status := http.StatusBadRequest
+	switch oauthErr.Code {
+	case "invalid_client", "invalid_token":
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Bearer error="`+oauthErr.Code+`"`)
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+
+	jsonResponse, _ := json.Marshal(map[string]string{"error": oauthErr.Code, "error_description": oauthErr.Description})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// browser apps (public clients) call the token and userinfo endpoints from
+// other origins, these endpoints do not use cookies
+func allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+func (srv *Server) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if allowCORS(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &Login.OAuthError{Code: "invalid_request", Description: "invalid form"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, &Login.OAuthError{Code: "unsupported_grant_type", Description: "only authorization_code is supported"})
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	response, err := srv.Login.ExchangeAuthorizationCode(clientID, clientSecret, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, response)
+}
+
+func (srv *Server) oauthUserinfo(w http.ResponseWriter, r *http.Request) {
+	if allowCORS(w, r) {
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		writeOAuthError(w, &Login.OAuthError{Code: "invalid_token", Description: "missing bearer token"})
+		return
+	}
+	claims, err := srv.Login.GetUserInfo(strings.TrimSpace(token))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, claims)
+}
+
+// returns the CSRF token frontends send in the X-CSRF-Token header (or the
+// csrf_token form field) of every POST
+func getCSRFToken(w http.ResponseWriter, r *http.Request) {
+	token, err := CSRF.Token(w, r)
+	if err != nil {
+		http.Error(w, "Failed to create CSRF token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, map[string]string{"csrf_token": token})
+}
+
+func (srv *Server) getJWKS(w http.ResponseWriter, r *http.Request) {
+	jsonResponse, err := json.Marshal(srv.Login.GetJWKS())
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(jsonResponse)
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+var PRECO_SUB uint64
+var lastTimePrecoSub time.Time
+
+func getPrecoSub(w http.ResponseWriter, r *http.Request) {
+	if time.Since(lastTimePrecoSub) > 10*time.Minute {
+		params := &stripe.PriceParams{}
+		params.Context = r.Context()
+		priceStripe, err := price.Get(os.Getenv("SUBSCRIPTION_PRICE_ID"), params)
+		if err != nil {
+			http.Error(w, "Failed to get price", http.StatusInternalServerError)
+			return
+		}
+
+		PRECO_SUB = uint64(priceStripe.UnitAmount)
+		lastTimePrecoSub = time.Now()
+	}
+
+	amount := float64(PRECO_SUB) / 100
+	response := map[string]float64{"preco": amount}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+
+}
+
+// Server is one Tokenize instance, its handlers and the services of every
+// package are built from the same store
+type Server struct {
+	// where everything is saved, DATABASE_URL (a sqlite file "users.db" by
+	// default) unless Initialize gets one
+	store database.Store
+	// the origin of the app from DOMAIN, like "https://example.com"
+	domain string
+	// the routes of this server, see Handler
+	mux *http.ServeMux
+
+	Login       *Login.Service
+	Permissions *Permissions.Service
+	Users       *UserFuncs.Service
+	Stripe      *StripeFunctions.Service
+	CSRF        *CSRF.Service
+}
+
+// Initialize runs the migrations on store and builds the services from it, a
+// nil store opens DATABASE_URL
+func Initialize(store database.Store) *Server {
+	functions.CheckAllEnv()
+	fmt.Println("Init")
+
+	config := database.LoadConfig()
+	if store == nil {
+		s, err := database.OpenConfig(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = s
+	} else if config.EmailProviderRules {
+		store.SetEmailProviderRules(true)
+	}
+	if os.Getenv("SKIP_MIGRATIONS") == "True" {
+		current, latest, err := store.SchemaVersion()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if current != latest {
+			log.Printf("The database schema is at version %d but this build uses version %d, run the migrations", current, latest)
+		}
+	} else if err := store.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &Server{store: store, domain: os.Getenv("DOMAIN")}
+	srv.Permissions = Permissions.New(store)
+	srv.Login = Login.New(store, srv.Permissions)
+	srv.Login.SetDomain(srv.domain)
+	srv.Users = UserFuncs.New(store, srv.Login)
+	srv.Stripe = StripeFunctions.New(store)
+	srv.CSRF = CSRF.New(srv.domain)
+
+	Logs.InitLogs()
+	Mail.Init()
+	srv.CSRF.Init()
+	srv.Login.Init()
+	srv.Stripe.SetRequireVerifiedEmail(os.Getenv("REQUIRE_VERIFIED_EMAIL_BILLING") == "True")
+
+	stripe.Key = os.Getenv("SECRET_KEY")
+	srv.mux = srv.routes()
+	return srv
+}
+
+// DB returns the *sql.DB of the store when there is one, so the app can keep
+// its tables in the same database
+func (srv *Server) DB() *sql.DB {
+	if s, ok := srv.store.(interface{ DB() *sql.DB }); ok {
+		return s.DB()
+	}
+	return nil
+}
+
+func (srv *Server) test(w http.ResponseWriter, r *http.Request) {
+	PriceID := os.Getenv("SUBSCRIPTION_PRICE_ID")
+
+	// StripeFunctions.CreateSubscription(1, time.Hour*24*30, PriceID, testeEvent, map[string]string{"extra": "testeCreateSubscription"})
+
+	// StripeFunctions.CreateScheduledSubscription(2, time.Now().AddDate(0, 6, 0), time.Hour*24*30*6, PriceID, testeEvent, map[string]string{"extra": "testeCreateScheduledSubscription"})
+
+	// StripeFunctions.CreateFreeTrial(3, time.Now().AddDate(0, 0, 0), time.Hour*24*30*6, PriceID, testeEvent, map[string]string{"extra": "CreateFreeTrial"})
+
+	// StripeFunctions.CreatePayment(4, 49.99, testeEvent, map[string]string{"extra": "CreatePayment"})
+
+	payment2, err := srv.Stripe.CreateSubscriptionPageContext(r.Context(), 1, PriceID, map[string]string{"extra": "testzaomeudeus"},
+		srv.domain+"/success", srv.domain+"/cancel")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, payment2.URL, http.StatusSeeOther)
+
+	// payment, err := StripeFunctions.CreatePaymentPage(6, 49.99, testeEvent, "https://picsum.photos/200/300", "desc", map[string]string{"extra": "testzaomeudeus"},
+	// 	domain+"/success", domain+"/cancel")
+	// if err != nil {
+	// 	fmt.Println(err)
+	// 	http.Error(w, "Failed to create payment", http.StatusInternalServerError)
+	// 	return
+	// }
+	// // redirect to payment page
+	// http.Redirect(w, r, payment.URL, http.StatusSeeOther)
+}
+
+// set port like "4242"
+func (srv *Server) InitListen(port string) {
+	port_int, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatal("Invalid port")
+	}
+	if port_int <= 0 || port_int > 65535 {
+		log.Fatal("Invalid port")
+	}
+
+	addr := "0.0.0.0:" + port
+	log.Printf("Listening on %s", addr)
+
+	// Start HTTP server, every POST goes through the CSRF checks
+	log.Fatal(http.ListenAndServe(addr, srv.Handler()))
+}
+
+// Handler returns the routes of the server, every POST goes through the CSRF
+// checks. Use it to serve Tokenize from your own http.Server or to mount it
+// next to your own routes.
+func (srv *Server) Handler() http.Handler {
+	return srv.CSRF.Protect(srv.mux)
+}
+
+// Handle adds a route of the app to the server, InitListen and Handler serve
+// it next to Tokenize's
+func (srv *Server) Handle(pattern string, handler http.Handler) {
+	srv.mux.Handle(pattern, handler)
+}
+
+// every Server keeps its routes in a mux of its own
+func (srv *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// PriceID := os.Getenv("SUBSCRIPTION_PRICE_ID")
+
+	mux.Handle("/create-portal-session", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.createPortalSession)))) //para checkar info da subscricao
+	mux.HandleFunc("/webhook", handleWebhook)
+
+	//auth
+	mux.Handle("/create-user", srv.Login.OptionalLogin(http.HandlerFunc(srv.createUser)))
+	mux.HandleFunc("/login-user", srv.loginUsr)
+	mux.HandleFunc("/request-login-link", srv.requestLoginLink)
+	mux.HandleFunc("/login-link", srv.loginWithLink)
+	mux.Handle("/logout-user", srv.Login.RequireLogin(http.HandlerFunc(srv.logoutUsr)))
+	mux.Handle("/list-sessions", srv.Login.RequireLogin(http.HandlerFunc(srv.listSessions)))
+	mux.Handle("/revoke-session", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.revokeSession))))
+	mux.HandleFunc("/refresh-token", srv.refreshToken)
+	mux.HandleFunc("/request-password-reset", srv.requestPasswordReset)
+	mux.HandleFunc("/reset-password", srv.resetPassword)
+	mux.Handle("/change-password", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.changePassword))))
+	mux.HandleFunc("/verify-email", srv.verifyEmail)
+	mux.HandleFunc("/resend-verification", srv.resendVerification)
+
+	//two factor
+	mux.HandleFunc("/verify-2fa", srv.verifyTwoFactor)
+	mux.Handle("/enroll-2fa", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.enrollTwoFactor))))
+	mux.Handle("/confirm-2fa", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.confirmTwoFactor))))
+	mux.Handle("/disable-2fa", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.disableTwoFactor))))
+
+	//passkeys
+	mux.Handle("/begin-passkey-registration", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.beginPasskeyRegistration))))
+	mux.Handle("/finish-passkey-registration", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.finishPasskeyRegistration))))
+	mux.HandleFunc("/begin-passkey-login", srv.beginPasskeyLogin)
+	mux.HandleFunc("/finish-passkey-login", srv.finishPasskeyLogin)
+	mux.Handle("/list-passkeys", srv.Login.RequireLogin(http.HandlerFunc(srv.listPasskeys)))
+	mux.Handle("/delete-passkey", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.deletePasskey))))
+
+	//openid connect
+	mux.HandleFunc("/oidc-login", srv.beginOIDCLogin)
+	mux.HandleFunc("/oidc-callback", srv.finishOIDCLogin)
+	mux.Handle("/list-identities", srv.Login.RequireLogin(http.HandlerFunc(srv.listIdentities)))
+	mux.Handle("/unlink-identity", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.unlinkIdentity))))
+
+	//api keys
+	mux.Handle("/create-api-key", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.createAPIKey))))
+	mux.Handle("/list-api-keys", srv.Login.RequireLogin(http.HandlerFunc(srv.listAPIKeys)))
+	mux.Handle("/revoke-api-key", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.revokeAPIKey))))
+
+	//impersonation
+	mux.Handle("/start-impersonation", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.startImpersonation))))
+	mux.Handle("/stop-impersonation", srv.Login.RequireLogin(http.HandlerFunc(srv.stopImpersonation)))
+
+	mux.HandleFunc("/.well-known/jwks.json", srv.getJWKS)
+
+	//authorization server for other apps
+	if os.Getenv("OAUTH_SERVER") == "True" {
+		mux.HandleFunc("/.well-known/openid-configuration", srv.getOIDCConfiguration)
+		mux.Handle("/oauth/authorize", srv.Login.OptionalLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.oauthAuthorize))))
+		mux.Handle("/oauth/consent", srv.Login.RequireLogin(srv.Login.DenyImpersonation(http.HandlerFunc(srv.oauthConsent))))
+		mux.HandleFunc("/oauth/token", srv.oauthToken)
+		mux.HandleFunc("/oauth/userinfo", srv.oauthUserinfo)
+	}
+
+	mux.HandleFunc("/csrf-token", getCSRFToken)
+	// authenticated by the Stripe signature and by the client credentials
+	srv.CSRF.Exempt("/webhook", "/oauth/token")
+
+	mux.HandleFunc("/health", healthCheck)
+	mux.HandleFunc("/getPrecoSub", getPrecoSub)
+
+	if os.Getenv("DEV") == "True" {
+		mux.Handle("/", http.FileServer(http.Dir("public"))) //for testing
+		mux.HandleFunc("/test", srv.test)
+	}
 
-	// Start HTTP server
-	log.Fatal(http.ListenAndServe(addr, nil))
+	return mux
 }
@@ -5,6 +5,6 @@ import (
 )
 
 func TestThis(t *testing.T) {
-	Initialize()
-	InitListen("4242")
+	srv := Initialize(nil)
+	srv.InitListen("4242")
 }
@@ -1,53 +1,77 @@
 package UserFuncs
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 
+	"github.com/Maruqes/Tokenize/Login"
+	"github.com/Maruqes/Tokenize/Logs"
 	"github.com/Maruqes/Tokenize/database"
 )
 
-func GetAllUsers() ([]database.User, error) {
-	return database.GetAllUsers()
+// Service manages the users of its store, the admin functions that touch
+// logins go through the Login service
+type Service struct {
+	store database.UserStore
+	login *Login.Service
 }
 
-func GetUserByID(id int) (database.User, error) {
-	return database.GetUser(id)
+func New(store database.UserStore, login *Login.Service) *Service {
+	return &Service{store: store, login: login}
 }
 
-func GetUserByEmail(email string) (database.User, error) {
-	return database.GetUserByEmail(email)
+func (svc *Service) GetAllUsers() ([]database.User, error) {
+	return svc.store.GetAllUsers()
 }
 
-func ProhibitUser(id int) error {
-	return database.ProhibitUser(id)
+func (svc *Service) GetUserByID(id int) (database.User, error) {
+	return svc.store.GetUser(id)
 }
 
-func UnprohibitUser(id int) error {
-	return database.UnprohibitUser(id)
+func (svc *Service) GetUserByIDContext(ctx context.Context, id int) (database.User, error) {
+	return svc.store.GetUserContext(ctx, id)
 }
 
-func IsProhibited(id int) (bool, error) {
-	return database.CheckIfUserIsProhibited(id)
+func (svc *Service) GetUserByEmail(email string) (database.User, error) {
+	return svc.store.GetUserByEmail(email)
 }
 
-// assumes that the user is already validated
-func CheckProhibitedUser(w http.ResponseWriter, r *http.Request) bool {
-	//get id
-	customer_id_cookie, err := r.Cookie("id")
-	if err != nil {
-		http.Error(w, "Error getting id", http.StatusInternalServerError)
+func (svc *Service) GetUserByEmailContext(ctx context.Context, email string) (database.User, error) {
+	return svc.store.GetUserByEmailContext(ctx, email)
+}
+
+func (svc *Service) ProhibitUser(id int) error {
+	return svc.store.ProhibitUser(id)
+}
+
+func (svc *Service) UnprohibitUser(id int) error {
+	return svc.store.UnprohibitUser(id)
+}
+
+func (svc *Service) IsProhibited(id int) (bool, error) {
+	return svc.store.CheckIfUserIsProhibited(id)
+}
+
+// assumes that the user is already validated, behind Login.RequireLogin or
+// Login.OptionalLogin it uses the user of the request context
+func (svc *Service) CheckProhibitedUser(w http.ResponseWriter, r *http.Request) bool {
+	if usr, ok := Login.CurrentUser(r.Context()); ok {
+		if usr.IsProhibited {
+			http.Error(w, "User is prohibited", http.StatusForbidden)
+			return true
+		}
 		return false
 	}
 
-	customer_id := customer_id_cookie.Value
-	customerIDInt, err := strconv.Atoi(customer_id)
+	//get id
+	customerIDInt, err := svc.login.GetIdWithRequest(r)
 	if err != nil {
-		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		http.Error(w, "Error getting id", http.StatusInternalServerError)
 		return false
 	}
 
-	prohibited, err := IsProhibited(customerIDInt)
+	prohibited, err := svc.IsProhibited(customerIDInt)
 	if err != nil {
 		http.Error(w, "Error checking if user is prohibited", http.StatusInternalServerError)
 		return false
@@ -61,10 +85,33 @@ func CheckProhibitedUser(w http.ResponseWriter, r *http.Request) bool {
 	return false
 }
 
-func ActivateUser(id int) error {
-	return database.ActivateUser(id)
+func (svc *Service) ActivateUser(id int) error {
+	return svc.store.ActivateUser(id)
+}
+
+func (svc *Service) DeactivateUser(id int) error {
+	return svc.store.DeactivateUser(id)
+}
+
+// removes 2FA from a user that lost their authenticator and recovery codes
+func (svc *Service) ResetTwoFactor(id int) error {
+	err := svc.login.ResetTwoFactor(id)
+	if err != nil {
+		return err
+	}
+	Logs.LogMessage("Two factor reset by an admin for user with id " + strconv.Itoa(id))
+	return nil
+}
+
+// removes the lockout of an account, by its email or username, after too many
+// failed logins
+func (svc *Service) UnlockLogin(identifier string) {
+	svc.login.UnlockLogin(identifier)
+	Logs.LogMessage("Login unlocked by an admin for " + identifier)
 }
 
-func DeactivateUser(id int) error {
-	return database.DeactivateUser(id)
+// removes the lockout of a client IP after too many failed logins
+func (svc *Service) UnlockIP(ip string) {
+	svc.login.UnlockIP(ip)
+	Logs.LogMessage("Login unlocked by an admin for IP " + ip)
 }
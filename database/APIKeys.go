@@ -0,0 +1,123 @@
+package database
+
+import "context"
+
+type APIKey struct {
+	ID     int
+	UserID int
+	Name   string
+	// first characters of the key, shown so the user can tell keys apart
+	Prefix  string
+	KeyHash string
+	Created int64
+	// unix times, 0 means the key never expires or was never used
+	Expires  int64
+	LastUsed int64
+	Revoked  bool
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, created, expires, last_used, revoked`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.Created, &key.Expires, &key.LastUsed, &key.Revoked)
+	return key, err
+}
+
+// saves the key and its permission scope in one transaction
+func (s *sqlStore) AddAPIKey(key APIKey, permissionIDs []int) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := tx.insert(context.Background(), `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, created, expires)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, key.UserID, key.Name, key.Prefix, key.KeyHash, key.Created, key.Expires)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, permissionID := range permissionIDs {
+		_, err := tx.Exec(`INSERT INTO api_key_permissions (api_key_id, permission_id) VALUES (?, ?);`, id, permissionID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (s *sqlStore) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ?;`
+	return scanAPIKey(s.db.QueryRow(query, keyHash))
+}
+
+func (s *sqlStore) GetAPIKey(id int) (APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = ?;`
+	return scanAPIKey(s.db.QueryRow(query, id))
+}
+
+func (s *sqlStore) GetUserAPIKeys(userID int) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = ? AND revoked = FALSE;`
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) GetAPIKeyPermissions(apiKeyID int) ([]Permission, error) {
+	query := `
+	SELECT permissions.id, permissions.name, permissions.permission
+	FROM permissions
+	JOIN api_key_permissions ON permissions.id = api_key_permissions.permission_id
+	WHERE api_key_permissions.api_key_id = ?;
+	`
+	rows, err := s.db.Query(query, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []Permission
+	for rows.Next() {
+		var permission Permission
+		if err := rows.Scan(&permission.ID, &permission.Name, &permission.Permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// returns false if the key does not exist or belongs to another user
+func (s *sqlStore) RevokeAPIKey(userID int, apiKeyID int) (bool, error) {
+	query := `UPDATE api_keys SET revoked = TRUE WHERE id = ? AND user_id = ? AND revoked = FALSE;`
+	result, err := s.db.Exec(query, apiKeyID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) TouchAPIKey(apiKeyID int, lastUsed int64) error {
+	query := `UPDATE api_keys SET last_used = ? WHERE id = ?;`
+	_, err := s.db.Exec(query, lastUsed, apiKeyID)
+	return err
+}
@@ -0,0 +1,28 @@
+package database
+
+func (s *sqlStore) CountUserDevices(userID int) (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM user_devices WHERE user_id = ?;`, userID).Scan(&count)
+	return count, err
+}
+
+// saves the device or updates its last seen time, returns true if the user
+// never logged in from it before
+func (s *sqlStore) AddUserDevice(userID int, deviceHash string, now int64) (bool, error) {
+	query := `INSERT INTO user_devices (user_id, device_hash, first_seen, last_seen) VALUES (?, ?, ?, ?)
+	ON CONFLICT(user_id, device_hash) DO NOTHING;`
+	result, err := s.db.Exec(query, userID, deviceHash, now, now)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if added > 0 {
+		return true, nil
+	}
+
+	_, err = s.db.Exec(`UPDATE user_devices SET last_seen = ? WHERE user_id = ? AND device_hash = ?;`, now, userID, deviceHash)
+	return false, err
+}
@@ -0,0 +1,67 @@
+package database
+
+import "context"
+
+// ExternalIdentity links a user to an account of an OpenID Connect provider
+type ExternalIdentity struct {
+	ID       int
+	UserID   int
+	Provider string
+	// the "sub" claim, unique per provider
+	Subject string
+	Email   string
+	Created int64
+}
+
+const externalIdentityColumns = `id, user_id, provider, subject, email, created`
+
+func scanExternalIdentity(row rowScanner) (ExternalIdentity, error) {
+	var identity ExternalIdentity
+	err := row.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Email, &identity.Created)
+	return identity, err
+}
+
+func (s *sqlStore) AddExternalIdentity(identity ExternalIdentity) (int64, error) {
+	return s.db.insert(context.Background(), `
+		INSERT INTO external_identities (user_id, provider, subject, email, created)
+		VALUES (?, ?, ?, ?, ?)
+	`, identity.UserID, identity.Provider, identity.Subject, identity.Email, identity.Created)
+}
+
+func (s *sqlStore) GetExternalIdentity(provider, subject string) (ExternalIdentity, error) {
+	query := `SELECT ` + externalIdentityColumns + ` FROM external_identities WHERE provider = ? AND subject = ?;`
+	return scanExternalIdentity(s.db.QueryRow(query, provider, subject))
+}
+
+func (s *sqlStore) GetUserExternalIdentities(userID int) ([]ExternalIdentity, error) {
+	query := `SELECT ` + externalIdentityColumns + ` FROM external_identities WHERE user_id = ?;`
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []ExternalIdentity
+	for rows.Next() {
+		identity, err := scanExternalIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// returns false if the identity does not exist or belongs to another user
+func (s *sqlStore) DeleteExternalIdentity(userID int, id int) (bool, error) {
+	query := `DELETE FROM external_identities WHERE id = ? AND user_id = ?;`
+	result, err := s.db.Exec(query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
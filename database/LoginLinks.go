@@ -0,0 +1,47 @@
+package database
+
+type LoginLink struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	// hash of the secret cookie of the browser that asked for the link
+	BrowserHash string
+	Created     int64
+	Expires     int64
+	// unix time the link was used, 0 while unused
+	Used int64
+}
+
+func (s *sqlStore) AddLoginLink(link LoginLink) error {
+	query := `INSERT INTO login_links (user_id, token_hash, browser_hash, created, expires) VALUES (?, ?, ?, ?, ?);`
+	_, err := s.db.Exec(query, link.UserID, link.TokenHash, link.BrowserHash, link.Created, link.Expires)
+	return err
+}
+
+func (s *sqlStore) GetLoginLinkByHash(tokenHash string) (LoginLink, error) {
+	query := `SELECT id, user_id, token_hash, browser_hash, created, expires, used FROM login_links WHERE token_hash = ?;`
+	row := s.db.QueryRow(query, tokenHash)
+	var link LoginLink
+	err := row.Scan(&link.ID, &link.UserID, &link.TokenHash, &link.BrowserHash, &link.Created, &link.Expires, &link.Used)
+	return link, err
+}
+
+// returns false if the link was already used
+func (s *sqlStore) MarkLoginLinkUsed(id int, used int64) (bool, error) {
+	query := `UPDATE login_links SET used = ? WHERE id = ? AND used = 0;`
+	result, err := s.db.Exec(query, used, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) DeleteExpiredLoginLinks(now int64) error {
+	query := `DELETE FROM login_links WHERE expires <= ?;`
+	_, err := s.db.Exec(query, now)
+	return err
+}
@@ -0,0 +1,193 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// OAuthClient is an app that logs in its users with Tokenize
+type OAuthClient struct {
+	ID   string
+	Name string
+	// empty for public clients (single page and mobile apps)
+	SecretHash   string
+	RedirectURIs []string
+	Created      int64
+}
+
+const oauthClientColumns = `id, name, secret_hash, redirect_uris, created`
+
+func scanOAuthClient(row rowScanner) (OAuthClient, error) {
+	var client OAuthClient
+	var redirectURIs string
+	err := row.Scan(&client.ID, &client.Name, &client.SecretHash, &redirectURIs, &client.Created)
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	return client, err
+}
+
+func (s *sqlStore) AddOAuthClient(client OAuthClient) error {
+	_, err := s.db.Exec(`
+		INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, created)
+		VALUES (?, ?, ?, ?, ?)
+	`, client.ID, client.Name, client.SecretHash, strings.Join(client.RedirectURIs, " "), client.Created)
+	return err
+}
+
+func (s *sqlStore) GetOAuthClient(id string) (OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE id = ?;`
+	return scanOAuthClient(s.db.QueryRow(query, id))
+}
+
+func (s *sqlStore) GetOAuthClients() ([]OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients;`
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []OAuthClient
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+// also removes the consents given to the client and its pending codes and
+// consent requests
+func (s *sqlStore) DeleteOAuthClient(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"oauth_codes", "oauth_consent_requests", "oauth_consents"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE client_id = ?;`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM oauth_clients WHERE id = ?;`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// returns the space separated scopes the user allowed the client, empty if
+// there is no consent
+func (s *sqlStore) GetOAuthConsent(userID int, clientID string) (string, error) {
+	row := s.db.QueryRow(`SELECT scope FROM oauth_consents WHERE user_id = ? AND client_id = ?;`, userID, clientID)
+	var scope string
+	err := row.Scan(&scope)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return scope, err
+}
+
+func (s *sqlStore) SetOAuthConsent(userID int, clientID, scope string, created int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO oauth_consents (user_id, client_id, scope, created)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, client_id) DO UPDATE SET scope = excluded.scope, created = excluded.created
+	`, userID, clientID, scope, created)
+	return err
+}
+
+func (s *sqlStore) DeleteOAuthConsent(userID int, clientID string) error {
+	_, err := s.db.Exec(`DELETE FROM oauth_consents WHERE user_id = ? AND client_id = ?;`, userID, clientID)
+	return err
+}
+
+// OAuthCode is an authorization code waiting to be exchanged at /oauth/token,
+// only a hash of the code is saved
+type OAuthCode struct {
+	CodeHash    string
+	UserID      int
+	ClientID    string
+	RedirectURI string
+	// space separated
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      int64
+	Expires       int64
+}
+
+// OAuthConsentRequest is an authorization request waiting for the user to
+// allow or deny it, only a hash of its ID is saved
+type OAuthConsentRequest struct {
+	IDHash      string
+	UserID      int
+	ClientID    string
+	RedirectURI string
+	// space separated
+	Scope         string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      int64
+	Expires       int64
+}
+
+const oauthCodeColumns = `code_hash, user_id, client_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires`
+
+const oauthConsentRequestColumns = `id_hash, user_id, client_id, redirect_uri, scope, state, nonce, code_challenge, auth_time, expires`
+
+func (s *sqlStore) AddOAuthCode(code OAuthCode) error {
+	_, err := s.db.Exec(`
+		INSERT INTO oauth_codes (`+oauthCodeColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, code.CodeHash, code.UserID, code.ClientID, code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge, code.AuthTime, code.Expires)
+	return err
+}
+
+// returns and deletes the code in one statement, so a code can only be taken
+// once even by two instances at the same time. sql.ErrNoRows if there is none
+func (s *sqlStore) TakeOAuthCode(codeHash string) (OAuthCode, error) {
+	query := `DELETE FROM oauth_codes WHERE code_hash = ? RETURNING ` + oauthCodeColumns + `;`
+	var code OAuthCode
+	err := s.db.QueryRow(query, codeHash).Scan(&code.CodeHash, &code.UserID, &code.ClientID, &code.RedirectURI,
+		&code.Scope, &code.Nonce, &code.CodeChallenge, &code.AuthTime, &code.Expires)
+	return code, err
+}
+
+func (s *sqlStore) AddOAuthConsentRequest(req OAuthConsentRequest) error {
+	_, err := s.db.Exec(`
+		INSERT INTO oauth_consent_requests (`+oauthConsentRequestColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.IDHash, req.UserID, req.ClientID, req.RedirectURI, req.Scope, req.State, req.Nonce, req.CodeChallenge, req.AuthTime, req.Expires)
+	return err
+}
+
+func scanOAuthConsentRequest(row rowScanner) (OAuthConsentRequest, error) {
+	var req OAuthConsentRequest
+	err := row.Scan(&req.IDHash, &req.UserID, &req.ClientID, &req.RedirectURI, &req.Scope,
+		&req.State, &req.Nonce, &req.CodeChallenge, &req.AuthTime, &req.Expires)
+	return req, err
+}
+
+// only returns the request to the user it belongs to, sql.ErrNoRows otherwise
+func (s *sqlStore) GetOAuthConsentRequest(idHash string, userID int) (OAuthConsentRequest, error) {
+	query := `SELECT ` + oauthConsentRequestColumns + ` FROM oauth_consent_requests WHERE id_hash = ? AND user_id = ?;`
+	return scanOAuthConsentRequest(s.db.QueryRow(query, idHash, userID))
+}
+
+// returns and deletes the request of the user, like TakeOAuthCode a request
+// can only be answered once
+func (s *sqlStore) TakeOAuthConsentRequest(idHash string, userID int) (OAuthConsentRequest, error) {
+	query := `DELETE FROM oauth_consent_requests WHERE id_hash = ? AND user_id = ? RETURNING ` + oauthConsentRequestColumns + `;`
+	return scanOAuthConsentRequest(s.db.QueryRow(query, idHash, userID))
+}
+
+func (s *sqlStore) DeleteExpiredOAuthGrants(now int64) error {
+	if _, err := s.db.Exec(`DELETE FROM oauth_codes WHERE expires <= ?;`, now); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM oauth_consent_requests WHERE expires <= ?;`, now)
+	return err
+}
@@ -0,0 +1,75 @@
+package database
+
+import "context"
+
+type Passkey struct {
+	ID     int
+	UserID int
+	Name   string
+	// base64url credential ID chosen by the authenticator
+	CredentialID string
+	// COSE encoded public key
+	PublicKey []byte
+	SignCount uint32
+	Created   int64
+	LastUsed  int64
+}
+
+const passkeyColumns = `id, user_id, name, credential_id, public_key, sign_count, created, last_used`
+
+func scanPasskey(row rowScanner) (Passkey, error) {
+	var passkey Passkey
+	err := row.Scan(&passkey.ID, &passkey.UserID, &passkey.Name, &passkey.CredentialID, &passkey.PublicKey, &passkey.SignCount, &passkey.Created, &passkey.LastUsed)
+	return passkey, err
+}
+
+func (s *sqlStore) AddPasskey(passkey Passkey) (int64, error) {
+	return s.db.insert(context.Background(), `
+		INSERT INTO passkeys (user_id, name, credential_id, public_key, sign_count, created)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, passkey.UserID, passkey.Name, passkey.CredentialID, passkey.PublicKey, passkey.SignCount, passkey.Created)
+}
+
+func (s *sqlStore) GetPasskeyByCredentialID(credentialID string) (Passkey, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM passkeys WHERE credential_id = ?;`
+	return scanPasskey(s.db.QueryRow(query, credentialID))
+}
+
+func (s *sqlStore) GetUserPasskeys(userID int) ([]Passkey, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM passkeys WHERE user_id = ?;`
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func (s *sqlStore) UpdatePasskeySignCount(id int, signCount uint32, lastUsed int64) error {
+	query := `UPDATE passkeys SET sign_count = ?, last_used = ? WHERE id = ?;`
+	_, err := s.db.Exec(query, signCount, lastUsed, id)
+	return err
+}
+
+// returns false if the passkey does not exist or belongs to another user
+func (s *sqlStore) DeletePasskey(userID int, id int) (bool, error) {
+	query := `DELETE FROM passkeys WHERE id = ? AND user_id = ?;`
+	result, err := s.db.Exec(query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -0,0 +1,73 @@
+package database
+
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	Created   int64
+	Expires   int64
+	// unix time the token was used, 0 while unused
+	Used int64
+}
+
+func (s *sqlStore) AddPasswordReset(reset PasswordReset) error {
+	query := `INSERT INTO password_resets (user_id, token_hash, created, expires) VALUES (?, ?, ?, ?);`
+	_, err := s.db.Exec(query, reset.UserID, reset.TokenHash, reset.Created, reset.Expires)
+	return err
+}
+
+func (s *sqlStore) GetPasswordResetByHash(tokenHash string) (PasswordReset, error) {
+	query := `SELECT id, user_id, token_hash, created, expires, used FROM password_resets WHERE token_hash = ?;`
+	row := s.db.QueryRow(query, tokenHash)
+	var reset PasswordReset
+	err := row.Scan(&reset.ID, &reset.UserID, &reset.TokenHash, &reset.Created, &reset.Expires, &reset.Used)
+	return reset, err
+}
+
+// returns false if the token was already used
+func (s *sqlStore) MarkPasswordResetUsed(id int, used int64) (bool, error) {
+	query := `UPDATE password_resets SET used = ? WHERE id = ? AND used = 0;`
+	result, err := s.db.Exec(query, used, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) DeleteExpiredPasswordResets(now int64) error {
+	query := `DELETE FROM password_resets WHERE expires <= ?;`
+	_, err := s.db.Exec(query, now)
+	return err
+}
+
+// changes the password and invalidates every password reset token of the user
+func (s *sqlStore) SetUserPassword(id int, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET password = ?
+		WHERE id = ?
+	`, hashedPassword, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM password_resets WHERE user_id = ?;`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
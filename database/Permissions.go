@@ -11,38 +11,9 @@ type Permission struct {
 	Permission string
 }
 
-func CreatePermissionsTable() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS permissions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		permission TEXT NOT NULL,
-		name TEXT NOT NULL
-	);`
-
-	_, err := db.Exec(query)
-	if err != nil {
-		return err
-	}
-
-	query2 := `
-	CREATE TABLE IF NOT EXISTS user_permissions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		permission_id INTEGER NOT NULL,
-		FOREIGN KEY(user_id) REFERENCES users(id),
-		FOREIGN KEY(permission_id) REFERENCES permissions(id)
-	);`
-
-	_, err = db.Exec(query2)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return nil
-}
-
-func CreateNewPermission(name, permission string) error {
+func (s *sqlStore) CreateNewPermission(name, permission string) error {
 	query := `INSERT INTO permissions (name, permission) VALUES (?, ?);`
-	_, err := db.Exec(query, name, permission)
+	_, err := s.db.Exec(query, name, permission)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -50,27 +21,38 @@ func CreateNewPermission(name, permission string) error {
 	return nil
 }
 
-func DeletePermissionWithID(id int) error {
-	query := `DELETE FROM permissions WHERE id = ?;`
-	_, err := db.Exec(query, id)
+// also takes the permission from the users and API keys that have it
+func (s *sqlStore) DeletePermissionWithID(id int) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM user_permissions WHERE permission_id = ?;`,
+		`DELETE FROM api_key_permissions WHERE permission_id = ?;`,
+		`DELETE FROM permissions WHERE id = ?;`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func CheckPermissionID(id int) bool {
+func (s *sqlStore) CheckPermissionID(id int) bool {
 	query := `SELECT id FROM permissions WHERE id = ?;`
-	row := db.QueryRow(query, id)
+	row := s.db.QueryRow(query, id)
 	var result int
 	err := row.Scan(&result)
 	return err == nil
 }
 
-func AddUserPermission(userID int, permission_id int) error {
+func (s *sqlStore) AddUserPermission(userID int, permission_id int) error {
 	query := `INSERT INTO user_permissions (user_id, permission_id) VALUES (?, ?);`
-	_, err := db.Exec(query, userID, permission_id)
+	_, err := s.db.Exec(query, userID, permission_id)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -78,9 +60,9 @@ func AddUserPermission(userID int, permission_id int) error {
 	return nil
 }
 
-func RemoveUserPermission(userID int, permission_id int) error {
+func (s *sqlStore) RemoveUserPermission(userID int, permission_id int) error {
 	query := `DELETE FROM user_permissions WHERE user_id = ? AND permission_id = ?;`
-	_, err := db.Exec(query, userID, permission_id)
+	_, err := s.db.Exec(query, userID, permission_id)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -88,14 +70,14 @@ func RemoveUserPermission(userID int, permission_id int) error {
 	return nil
 }
 
-func GetUserPermissions(userID int) ([]Permission, error) {
+func (s *sqlStore) GetUserPermissions(userID int) ([]Permission, error) {
 	query := `
 	SELECT permissions.id, permissions.name, permissions.permission
 	FROM permissions
 	JOIN user_permissions ON permissions.id = user_permissions.permission_id
 	WHERE user_permissions.user_id = ?;
 	`
-	rows, err := db.Query(query, userID)
+	rows, err := s.db.Query(query, userID)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -113,9 +95,9 @@ func GetUserPermissions(userID int) ([]Permission, error) {
 	return permissions, nil
 }
 
-func GetPermissionWithID(id int) (Permission, error) {
+func (s *sqlStore) GetPermissionWithID(id int) (Permission, error) {
 	query := `SELECT id, name, permission FROM permissions WHERE id = ?;`
-	row := db.QueryRow(query, id)
+	row := s.db.QueryRow(query, id)
 	var permission Permission
 	err := row.Scan(&permission.ID, &permission.Name, &permission.Permission)
 	if err != nil {
@@ -125,17 +107,17 @@ func GetPermissionWithID(id int) (Permission, error) {
 	return permission, nil
 }
 
-func CheckUserPermission(userID int, permissionID int) bool {
+func (s *sqlStore) CheckUserPermission(userID int, permissionID int) bool {
 	query := `SELECT id FROM user_permissions WHERE user_id = ? AND permission_id = ?;`
-	row := db.QueryRow(query, userID, permissionID)
+	row := s.db.QueryRow(query, userID, permissionID)
 	var result int
 	err := row.Scan(&result)
 	return err == nil
 }
 
-func GetPermissionWithName(name string) (Permission, error) {
+func (s *sqlStore) GetPermissionWithName(name string) (Permission, error) {
 	query := `SELECT id, name, permission FROM permissions WHERE name = ?;`
-	row := db.QueryRow(query, name)
+	row := s.db.QueryRow(query, name)
 	var permission Permission
 	err := row.Scan(&permission.ID, &permission.Name, &permission.Permission)
 	if err != nil {
@@ -147,9 +129,9 @@ func GetPermissionWithName(name string) (Permission, error) {
 	return permission, nil
 }
 
-func GetPermissionWithPermission(permission_type_string string) (Permission, error) {
+func (s *sqlStore) GetPermissionWithPermission(permission_type_string string) (Permission, error) {
 	query := `SELECT id, name, permission FROM permissions WHERE permission = ?;`
-	row := db.QueryRow(query, permission_type_string)
+	row := s.db.QueryRow(query, permission_type_string)
 	var permission Permission
 	err := row.Scan(&permission.ID, &permission.Name, &permission.Permission)
 	if err != nil {
@@ -161,9 +143,9 @@ func GetPermissionWithPermission(permission_type_string string) (Permission, err
 	return permission, nil
 }
 
-func GetPermissions() ([]Permission, error) {
+func (s *sqlStore) GetPermissions() ([]Permission, error) {
 	query := `SELECT id, name, permission FROM permissions;`
-	rows, err := db.Query(query)
+	rows, err := s.db.Query(query)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -181,13 +163,13 @@ func GetPermissions() ([]Permission, error) {
 	return permissions, nil
 }
 
-func GetAllUsersPermissions() ([]Permission, error) {
+func (s *sqlStore) GetAllUsersPermissions() ([]Permission, error) {
 	query := `
 	SELECT permissions.id, permissions.name, permissions.permission
 	FROM permissions
 	JOIN user_permissions ON permissions.id = user_permissions.permission_id;
 	`
-	rows, err := db.Query(query)
+	rows, err := s.db.Query(query)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -0,0 +1,87 @@
+package database
+
+type RefreshToken struct {
+	ID        string
+	FamilyID  string
+	UserID    int
+	TokenHash string
+	Created   int64
+	Expires   int64
+	// unix time the token was exchanged for a new one, 0 while unused
+	Used    int64
+	Revoked bool
+	// the access session issued together with the token
+	SessionID string
+}
+
+func (s *sqlStore) AddRefreshToken(token RefreshToken) error {
+	query := `
+	INSERT INTO refresh_tokens (id, family_id, user_id, token_hash, created, expires, used, revoked, session_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := s.db.Exec(query, token.ID, token.FamilyID, token.UserID, token.TokenHash, token.Created, token.Expires, token.Used, token.Revoked, token.SessionID)
+	return err
+}
+
+func (s *sqlStore) GetRefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	query := `
+	SELECT id, family_id, user_id, token_hash, created, expires, used, revoked, session_id
+	FROM refresh_tokens
+	WHERE token_hash = ?;`
+	row := s.db.QueryRow(query, tokenHash)
+	var token RefreshToken
+	err := row.Scan(&token.ID, &token.FamilyID, &token.UserID, &token.TokenHash, &token.Created, &token.Expires, &token.Used, &token.Revoked, &token.SessionID)
+	return token, err
+}
+
+// returns the access sessions issued with the tokens of the family
+func (s *sqlStore) GetRefreshTokenFamilySessions(familyID string) ([]string, error) {
+	query := `SELECT session_id FROM refresh_tokens WHERE family_id = ? AND session_id != '';`
+	rows, err := s.db.Query(query, familyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	return sessionIDs, rows.Err()
+}
+
+// returns false if the token was already used, so two concurrent refreshes
+// with the same token can not both succeed
+func (s *sqlStore) MarkRefreshTokenUsed(id string, used int64) (bool, error) {
+	query := `UPDATE refresh_tokens SET used = ? WHERE id = ? AND used = 0 AND revoked = FALSE;`
+	result, err := s.db.Exec(query, used, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) RevokeRefreshTokenFamily(familyID string) error {
+	query := `UPDATE refresh_tokens SET revoked = TRUE WHERE family_id = ?;`
+	_, err := s.db.Exec(query, familyID)
+	return err
+}
+
+func (s *sqlStore) RevokeUserRefreshTokens(userID int) error {
+	query := `UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ?;`
+	_, err := s.db.Exec(query, userID)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredRefreshTokens(now int64) error {
+	query := `DELETE FROM refresh_tokens WHERE expires <= ?;`
+	_, err := s.db.Exec(query, now)
+	return err
+}
@@ -0,0 +1,101 @@
+package database
+
+type Session struct {
+	ID        string
+	UserID    int
+	TokenHash string
+	Created   int64
+	LastSeen  int64
+	Expires   int64
+	Remember  bool
+	// the user acting as UserID in an impersonated session, 0 otherwise
+	ImpersonatorID int
+	// the session of ImpersonatorID that started the impersonation
+	ImpersonatorSessionID string
+	// the client that logged in
+	IP        string
+	UserAgent string
+}
+
+const sessionColumns = `id, user_id, token_hash, created, last_seen, expires, remember, impersonator_id, impersonator_session, ip, user_agent`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.UserID, &session.TokenHash, &session.Created, &session.LastSeen, &session.Expires, &session.Remember, &session.ImpersonatorID, &session.ImpersonatorSessionID, &session.IP, &session.UserAgent)
+	return session, err
+}
+
+func (s *sqlStore) AddSession(session Session) error {
+	query := `INSERT INTO sessions (` + sessionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := s.db.Exec(query, session.ID, session.UserID, session.TokenHash, session.Created, session.LastSeen, session.Expires, session.Remember, session.ImpersonatorID, session.ImpersonatorSessionID, session.IP, session.UserAgent)
+	return err
+}
+
+func (s *sqlStore) GetSessionByTokenHash(tokenHash string) (Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE token_hash = ?;`
+	return scanSession(s.db.QueryRow(query, tokenHash))
+}
+
+func (s *sqlStore) GetUserSessions(userID int) ([]Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE user_id = ?;`
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// returns false if the session does not exist or belongs to another user
+func (s *sqlStore) DeleteSession(userID int, sessionID string) (bool, error) {
+	query := `DELETE FROM sessions WHERE id = ? AND user_id = ?;`
+	result, err := s.db.Exec(query, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) DeleteUserSessions(userID int) error {
+	query := `DELETE FROM sessions WHERE user_id = ?;`
+	_, err := s.db.Exec(query, userID)
+	return err
+}
+
+func (s *sqlStore) TouchSession(sessionID string, lastSeen int64) error {
+	query := `UPDATE sessions SET last_seen = ? WHERE id = ?;`
+	_, err := s.db.Exec(query, lastSeen, sessionID)
+	return err
+}
+
+// saves the client IP and user agent of the session
+func (s *sqlStore) SetSessionClient(sessionID, ip, userAgent string) error {
+	query := `UPDATE sessions SET ip = ?, user_agent = ? WHERE id = ?;`
+	_, err := s.db.Exec(query, ip, userAgent, sessionID)
+	return err
+}
+
+// deletes the sessions past their expiration and the non "remember me" ones
+// last seen before idleBefore
+func (s *sqlStore) DeleteExpiredSessions(now int64, idleBefore int64) error {
+	query := `DELETE FROM sessions WHERE expires <= ? OR (remember = FALSE AND last_seen < ?);`
+	_, err := s.db.Exec(query, now, idleBefore)
+	return err
+}
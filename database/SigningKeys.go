@@ -0,0 +1,95 @@
+package database
+
+// held by the instance adding a signing key on postgres, see
+// AddSigningKeyIfNoneSince
+const signingKeyLockID = 7316454
+
+type SigningKey struct {
+	ID         string
+	PrivateKey string
+	Created    int64
+	// unix time the key stopped signing, 0 while it is the active key
+	Retired int64
+}
+
+func (s *sqlStore) AddSigningKey(key SigningKey) error {
+	query := `INSERT INTO signing_keys (id, private_key, created, retired) VALUES (?, ?, ?, ?);`
+	_, err := s.db.Exec(query, key.ID, key.PrivateKey, key.Created, key.Retired)
+	return err
+}
+
+// newest keys first
+func (s *sqlStore) GetSigningKeys() ([]SigningKey, error) {
+	query := `SELECT id, private_key, created, retired FROM signing_keys ORDER BY created DESC;`
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var key SigningKey
+		if err := rows.Scan(&key.ID, &key.PrivateKey, &key.Created, &key.Retired); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// AddSigningKeyIfNoneSince saves key as the active key and retires the other
+// ones, unless an active key was created at or after since, like the one of
+// another instance rotating at the same time. It returns false when it added
+// nothing.
+func (s *sqlStore) AddSigningKeyIfNoneSince(key SigningKey, since int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// sqlite locks the database with the insert, postgres needs the lock so
+	// two instances do not both find no key
+	if s.db.dialect == postgresDialect {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?);`, signingKeyLockID); err != nil {
+			return false, err
+		}
+	}
+	result, err := tx.Exec(`
+		INSERT INTO signing_keys (id, private_key, created, retired)
+		SELECT CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS BIGINT), 0
+		WHERE NOT EXISTS (SELECT 1 FROM signing_keys WHERE retired = 0 AND created >= ?);
+	`, key.ID, key.PrivateKey, key.Created, since)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	if err != nil || added == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE signing_keys SET retired = ? WHERE retired = 0 AND id != ?;`, key.Created, key.ID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// replaces the saved private key, used to encrypt the keys saved before
+func (s *sqlStore) SetSigningKeyPrivateKey(id, privateKey string) error {
+	query := `UPDATE signing_keys SET private_key = ? WHERE id = ?;`
+	_, err := s.db.Exec(query, privateKey, id)
+	return err
+}
+
+// retires every active key except the one with keepID
+func (s *sqlStore) RetireSigningKeys(keepID string, retired int64) error {
+	query := `UPDATE signing_keys SET retired = ? WHERE retired = 0 AND id != ?;`
+	_, err := s.db.Exec(query, retired, keepID)
+	return err
+}
+
+func (s *sqlStore) DeleteSigningKeysRetiredBefore(before int64) error {
+	query := `DELETE FROM signing_keys WHERE retired != 0 AND retired < ?;`
+	_, err := s.db.Exec(query, before)
+	return err
+}
@@ -0,0 +1,99 @@
+package database
+
+type TOTP struct {
+	UserID  int
+	Secret  string
+	Enabled bool
+	// time step of the last accepted code, a code can not be used twice
+	LastStep int64
+}
+
+// saves a new secret for the user, disabled until the first code is confirmed
+func (s *sqlStore) SetTOTPSecret(userID int, secret string) error {
+	query := `
+	INSERT INTO user_totp (user_id, secret, enabled, last_step) VALUES (?, ?, FALSE, 0)
+	ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, enabled = FALSE, last_step = 0;`
+	_, err := s.db.Exec(query, userID, secret)
+	return err
+}
+
+func (s *sqlStore) GetTOTP(userID int) (TOTP, error) {
+	query := `SELECT user_id, secret, enabled, last_step FROM user_totp WHERE user_id = ?;`
+	row := s.db.QueryRow(query, userID)
+	var totp TOTP
+	err := row.Scan(&totp.UserID, &totp.Secret, &totp.Enabled, &totp.LastStep)
+	return totp, err
+}
+
+func (s *sqlStore) EnableTOTP(userID int) error {
+	query := `UPDATE user_totp SET enabled = TRUE WHERE user_id = ?;`
+	_, err := s.db.Exec(query, userID)
+	return err
+}
+
+// returns false if a code of this or a later time step was already used
+func (s *sqlStore) SetTOTPLastStep(userID int, step int64) (bool, error) {
+	query := `UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?;`
+	result, err := s.db.Exec(query, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// removes the secret and the recovery codes of the user
+func (s *sqlStore) DeleteTOTP(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM user_totp WHERE user_id = ?;`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?;`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?;`, userID)
+	if err != nil {
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?);`, userID, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// marks the code as used, returns false if it does not exist or was used
+func (s *sqlStore) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	query := `UPDATE recovery_codes SET used = TRUE WHERE user_id = ? AND code_hash = ? AND used = FALSE;`
+	result, err := s.db.Exec(query, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config controls where the store is and how its connections are kept
+type Config struct {
+	// the sqlite file or postgres DSN that Tokenize's Initialize opens, see Open
+	DSN string
+	// connections open at once, 0 means no limit
+	MaxOpenConns int
+	// connections kept open while unused, 0 closes them right away
+	MaxIdleConns int
+	// connections are closed after this long, 0 keeps them forever
+	ConnMaxLifetime time.Duration
+	// connections unused for this long are closed, 0 keeps them forever
+	ConnMaxIdleTime time.Duration
+	// how long a sqlite connection waits for another one to release the
+	// database before failing with "database is locked"
+	BusyTimeout time.Duration
+	// also apply the dot and "+tag" rules of the mail providers when comparing
+	// emails, see EmailKey
+	EmailProviderRules bool
+}
+
+// DefaultConfig is the config of the stores opened by Open, OpenSQLite and
+// OpenPostgres
+func DefaultConfig() Config {
+	return Config{
+		DSN:             "./users.db",
+		MaxOpenConns:    25,
+		MaxIdleConns:    25,
+		ConnMaxIdleTime: 5 * time.Minute,
+		BusyTimeout:     5 * time.Second,
+	}
+}
+
+// LoadConfig returns the default config overridden by DATABASE_URL,
+// DATABASE_MAX_OPEN_CONNS, DATABASE_MAX_IDLE_CONNS, DATABASE_CONN_MAX_LIFETIME,
+// DATABASE_CONN_MAX_IDLE_TIME, SQLITE_BUSY_TIMEOUT and EMAIL_PROVIDER_RULES,
+// the durations use go durations like "30s" or "5m"
+func LoadConfig() Config {
+	config := DefaultConfig()
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		config.DSN = dsn
+	}
+	config.MaxOpenConns = intFromEnv("DATABASE_MAX_OPEN_CONNS", config.MaxOpenConns)
+	config.MaxIdleConns = intFromEnv("DATABASE_MAX_IDLE_CONNS", config.MaxIdleConns)
+	config.ConnMaxLifetime = durationFromEnv("DATABASE_CONN_MAX_LIFETIME", config.ConnMaxLifetime)
+	config.ConnMaxIdleTime = durationFromEnv("DATABASE_CONN_MAX_IDLE_TIME", config.ConnMaxIdleTime)
+	config.BusyTimeout = durationFromEnv("SQLITE_BUSY_TIMEOUT", config.BusyTimeout)
+	config.EmailProviderRules = os.Getenv("EMAIL_PROVIDER_RULES") == "True"
+	return config
+}
+
+func intFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid number in env variable %s: %v", name, err)
+	}
+	return i
+}
+
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration in env variable %s: %v", name, err)
+	}
+	return d
+}
+
+// adds the pragmas every sqlite connection runs when it opens: WAL so reads do
+// not wait for writes, foreign keys and the busy timeout. Options already in
+// path (like "users.db?_journal_mode=DELETE") are kept
+func sqliteDSN(path string, busyTimeout time.Duration) string {
+	file, query, _ := strings.Cut(path, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return path
+	}
+	// go-sqlite3 accepts each option under two names
+	defaults := []struct{ key, alias, value string }{
+		{"_journal_mode", "_journal", "WAL"},
+		{"_synchronous", "_sync", "NORMAL"},
+		{"_foreign_keys", "_fk", "on"},
+		{"_busy_timeout", "_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10)},
+	}
+	for _, option := range defaults {
+		if !params.Has(option.key) && !params.Has(option.alias) {
+			params.Set(option.key, option.value)
+		}
+	}
+	return file + "?" + params.Encode()
+}
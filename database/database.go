@@ -1,18 +1,16 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var db *sql.DB
-
 type Date struct {
 	Day   int
 	Month int
@@ -58,66 +56,30 @@ type User struct {
 	Name         string
 	IsProhibited bool
 	IsActive     bool
+	// true until the user opens the link of the verification email
+	PendingVerification bool
 }
 
-func CreateTable() {
-	query := `
-    CREATE TABLE IF NOT EXISTS users (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        stripe_id TEXT,
-        email TEXT NOT NULL UNIQUE,
-        name TEXT NOT NULL, 
-        password TEXT,
-    	is_prohibited BOOLEAN DEFAULT 0,
-		is_active BOOLEAN DEFAULT 0
-    );
-    `
-	_, err := db.Exec(query)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func Init() *sql.DB {
-	var err error
-	// Check if the database file exists
-	if _, err := os.Stat("./users.db"); os.IsNotExist(err) {
-		// Create the database file if it does not exist
-		file, err := os.Create("./users.db")
-		if err != nil {
-			log.Fatal(err)
-		}
-		file.Close()
-	}
-
-	db, err = sql.Open("sqlite3", "./users.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-	CreateTable()
-	return db
-}
-
-func ProhibitUser(id int) error {
-	_, err := db.Exec(`
+func (s *sqlStore) ProhibitUser(id int) error {
+	_, err := s.db.Exec(`
     UPDATE users
-    SET is_prohibited = 1
+    SET is_prohibited = TRUE
     WHERE id = ?
   `, id)
 	return err
 }
 
-func UnprohibitUser(id int) error {
-	_, err := db.Exec(`
+func (s *sqlStore) UnprohibitUser(id int) error {
+	_, err := s.db.Exec(`
     UPDATE users
-    SET is_prohibited = 0
+    SET is_prohibited = FALSE
     WHERE id = ?
   `, id)
 	return err
 }
 
-func CheckIfUserIsProhibited(id int) (bool, error) {
-	row := db.QueryRow(`
+func (s *sqlStore) CheckIfUserIsProhibited(id int) (bool, error) {
+	row := s.db.QueryRow(`
     SELECT is_prohibited
     FROM users
     WHERE id = ?
@@ -127,12 +89,21 @@ func CheckIfUserIsProhibited(id int) (bool, error) {
 	return isProhibited, err
 }
 
-func CheckIfCanUserBeAdded(email, name string) (bool, error) {
-	row := db.QueryRow(`
+// emails are compared by their EmailKey and usernames ignore case
+func (s *sqlStore) CheckIfCanUserBeAdded(email, name string) (bool, error) {
+	return s.CheckIfCanUserBeAddedContext(context.Background(), email, name)
+}
+
+func (s *sqlStore) CheckIfCanUserBeAddedContext(ctx context.Context, email, name string) (bool, error) {
+	if strings.Contains(name, "@") {
+		return false, nil // the name would be taken for an email at login
+	}
+	row := s.db.QueryRowContext(ctx, `
         SELECT id
         FROM users
-        WHERE email = ? OR name = ?
-    `, email, name)
+        WHERE email_key = ? OR lower(name) = lower(?)
+        LIMIT 1
+    `, s.EmailKey(email), strings.TrimSpace(name))
 	var result int
 	err := row.Scan(&result)
 	if err == sql.ErrNoRows {
@@ -143,8 +114,21 @@ func CheckIfCanUserBeAdded(email, name string) (bool, error) {
 	return false, nil // User exists
 }
 
-func AddUser(stripeID, email, name, password string) (int64, error) {
-	canBeAdded, err := CheckIfCanUserBeAdded(email, name)
+// the email is saved normalized (see NormalizeEmail) and the name trimmed
+func (s *sqlStore) AddUser(stripeID, email, name, password string) (int64, error) {
+	return s.AddUserContext(context.Background(), stripeID, email, name, password)
+}
+
+func (s *sqlStore) AddUserContext(ctx context.Context, stripeID, email, name, password string) (int64, error) {
+	email = NormalizeEmail(email)
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, "@") {
+		return 0, fmt.Errorf("username can not contain @")
+	}
+	canBeAdded, err := s.CheckIfCanUserBeAddedContext(ctx, email, name)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
 	if err != nil {
 		return 0, fmt.Errorf("error checking if user can be added maybe user/email being used")
 	}
@@ -157,22 +141,18 @@ func AddUser(stripeID, email, name, password string) (int64, error) {
 		return 0, err
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO users (stripe_id, email, name, password)
-		VALUES (?, ?, ?, ?)
-	`, stripeID, email, name, hashedPassword)
-	if err != nil {
-		return 0, err
-	}
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
+	return s.db.insert(ctx, `
+		INSERT INTO users (stripe_id, email, email_key, name, password, pending_verification)
+		VALUES (?, ?, ?, ?, ?, TRUE)
+	`, stripeID, email, s.EmailKey(email), name, hashedPassword)
+}
+
+func (s *sqlStore) SetUserStripeID(id int, stripeID string) error {
+	return s.SetUserStripeIDContext(context.Background(), id, stripeID)
 }
 
-func SetUserStripeID(id int, stripeID string) error {
-	_, err := db.Exec(`
+func (s *sqlStore) SetUserStripeIDContext(ctx context.Context, id int, stripeID string) error {
+	_, err := s.db.ExecContext(ctx, `
 		UPDATE users
 		SET stripe_id = ?
 		WHERE id = ?
@@ -180,8 +160,8 @@ func SetUserStripeID(id int, stripeID string) error {
 	return err
 }
 
-func CheckIfUserIDExists(id int) (bool, error) {
-	row := db.QueryRow(`
+func (s *sqlStore) CheckIfUserIDExists(id int) (bool, error) {
+	row := s.db.QueryRow(`
 		SELECT id
 		FROM users
 		WHERE id = ?
@@ -196,31 +176,78 @@ func CheckIfUserIDExists(id int) (bool, error) {
 	return true, nil // User ID exists
 }
 
-func GetUser(id int) (User, error) {
-	row := db.QueryRow(`
-		SELECT id, stripe_id, email, name, is_prohibited, is_active
+func (s *sqlStore) GetUser(id int) (User, error) {
+	return s.GetUserContext(context.Background(), id)
+}
+
+func (s *sqlStore) GetUserContext(ctx context.Context, id int) (User, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, stripe_id, email, name, is_prohibited, is_active, pending_verification
 		FROM users
 		WHERE id = ?
 	`, id)
 	var user User
-	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive)
+	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive, &user.PendingVerification)
 	return user, err
 }
 
-func GetUserByEmail(email string) (User, error) {
-	row := db.QueryRow(`
-		SELECT id, stripe_id, email, name, is_prohibited, is_active
+// finds the user by the EmailKey of the email, so case, spaces and (with the
+// provider rules) dots and "+tags" do not matter
+func (s *sqlStore) GetUserByEmail(email string) (User, error) {
+	return s.GetUserByEmailContext(context.Background(), email)
+}
+
+func (s *sqlStore) GetUserByEmailContext(ctx context.Context, email string) (User, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, stripe_id, email, name, is_prohibited, is_active, pending_verification
 		FROM users
-		WHERE email = ?
-	`, email)
+		WHERE email_key = ?
+	`, s.EmailKey(email))
 	var user User
-	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive)
+	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive, &user.PendingVerification)
 	return user, err
 }
 
-func GetAllUsers() ([]User, error) {
-	rows, err := db.Query(`
-		SELECT id, stripe_id, email, name,is_prohibited, is_active
+// usernames ignore case, an exact match wins in databases where two names
+// only differ in case
+func (s *sqlStore) GetUserByName(name string) (User, error) {
+	return s.GetUserByNameContext(context.Background(), name)
+}
+
+func (s *sqlStore) GetUserByNameContext(ctx context.Context, name string) (User, error) {
+	name = strings.TrimSpace(name)
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, stripe_id, email, name, is_prohibited, is_active, pending_verification
+		FROM users
+		WHERE lower(name) = lower(?)
+		ORDER BY name = ? DESC
+		LIMIT 1
+	`, name, name)
+	var user User
+	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive, &user.PendingVerification)
+	return user, err
+}
+
+// finds the user by email when the identifier has an "@", otherwise by
+// username. New usernames can not have an "@", the ones saved before that
+// are still found by name when no email matches
+func (s *sqlStore) GetUserByLogin(identifier string) (User, error) {
+	return s.GetUserByLoginContext(context.Background(), identifier)
+}
+
+func (s *sqlStore) GetUserByLoginContext(ctx context.Context, identifier string) (User, error) {
+	if strings.Contains(identifier, "@") {
+		user, err := s.GetUserByEmailContext(ctx, identifier)
+		if err != sql.ErrNoRows {
+			return user, err
+		}
+	}
+	return s.GetUserByNameContext(ctx, identifier)
+}
+
+func (s *sqlStore) GetAllUsers() ([]User, error) {
+	rows, err := s.db.Query(`
+		SELECT id, stripe_id, email, name, is_prohibited, is_active, pending_verification
 		FROM users
 	`)
 	if err != nil {
@@ -231,7 +258,7 @@ func GetAllUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive)
+		err := rows.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive, &user.PendingVerification)
 		if err != nil {
 			return nil, err
 		}
@@ -240,28 +267,37 @@ func GetAllUsers() ([]User, error) {
 	return users, nil
 }
 
-func ActivateUser(id int) error {
-	_, err := db.Exec(`
+func (s *sqlStore) ActivateUser(id int) error {
+	_, err := s.db.Exec(`
 		UPDATE users
-		SET is_active = 1
+		SET is_active = TRUE
 		WHERE id = ?
 	`, id)
 	return err
 }
 
-func DeactivateUser(id int) error {
-	_, err := db.Exec(`
+func (s *sqlStore) SetEmailVerified(id int) error {
+	_, err := s.db.Exec(`
 		UPDATE users
-		SET is_active = 0
+		SET pending_verification = FALSE
 		WHERE id = ?
 	`, id)
 	return err
 }
 
-func DeactivateUserByStripeID(stripeID string) error {
-	_, err := db.Exec(`
+func (s *sqlStore) DeactivateUser(id int) error {
+	_, err := s.db.Exec(`
 		UPDATE users
-		SET is_active = 0
+		SET is_active = FALSE
+		WHERE id = ?
+	`, id)
+	return err
+}
+
+func (s *sqlStore) DeactivateUserByStripeID(stripeID string) error {
+	_, err := s.db.Exec(`
+		UPDATE users
+		SET is_active = FALSE
 		WHERE stripe_id = ?
 	`, stripeID)
 	return err
@@ -277,8 +313,12 @@ func VerifyPassword(password, hash string) bool {
 	return err == nil
 }
 
-func CheckUserPassword(id int, password string) bool {
-	row := db.QueryRow(`
+func (s *sqlStore) CheckUserPassword(id int, password string) bool {
+	return s.CheckUserPasswordContext(context.Background(), id, password)
+}
+
+func (s *sqlStore) CheckUserPasswordContext(ctx context.Context, id int, password string) bool {
+	row := s.db.QueryRowContext(ctx, `
 		SELECT password
 		FROM users
 		WHERE id = ?
@@ -291,13 +331,17 @@ func CheckUserPassword(id int, password string) bool {
 	return VerifyPassword(password, hashedPassword)
 }
 
-func GetUserByStripeID(stripeID string) (User, error) {
-	row := db.QueryRow(`
-		SELECT id, stripe_id, email, name, is_prohibited, is_active
+func (s *sqlStore) GetUserByStripeID(stripeID string) (User, error) {
+	return s.GetUserByStripeIDContext(context.Background(), stripeID)
+}
+
+func (s *sqlStore) GetUserByStripeIDContext(ctx context.Context, stripeID string) (User, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, stripe_id, email, name, is_prohibited, is_active, pending_verification
 		FROM users
 		WHERE stripe_id = ?
 	`, stripeID)
 	var user User
-	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive)
+	err := row.Scan(&user.ID, &user.StripeID, &user.Email, &user.Name, &user.IsProhibited, &user.IsActive, &user.PendingVerification)
 	return user, err
 }
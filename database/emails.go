@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// emailProvider describes how a mail provider treats the local part of its
+// addresses, the ones that ignore dots or "+tags" deliver the variants to the
+// same inbox
+type emailProvider struct {
+	ignoreDots bool
+	ignorePlus bool
+	// the domain the provider's aliases are folded to
+	domain string
+}
+
+var emailProviders = map[string]emailProvider{
+	"gmail.com":      {ignoreDots: true, ignorePlus: true, domain: "gmail.com"},
+	"googlemail.com": {ignoreDots: true, ignorePlus: true, domain: "gmail.com"},
+	"outlook.com":    {ignorePlus: true, domain: "outlook.com"},
+	"hotmail.com":    {ignorePlus: true, domain: "hotmail.com"},
+	"live.com":       {ignorePlus: true, domain: "live.com"},
+	"icloud.com":     {ignorePlus: true, domain: "icloud.com"},
+	"me.com":         {ignorePlus: true, domain: "icloud.com"},
+	"mac.com":        {ignorePlus: true, domain: "icloud.com"},
+	"fastmail.com":   {ignorePlus: true, domain: "fastmail.com"},
+	"protonmail.com": {ignorePlus: true, domain: "proton.me"},
+	"proton.me":      {ignorePlus: true, domain: "proton.me"},
+}
+
+// NormalizeEmail trims and lowercases an email, it is how emails are saved
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailKey is the canonical form used to compare emails, two emails with the
+// same key belong to the same account. With the provider rules
+// "John.Smith+shop@googlemail.com" and "johnsmith@gmail.com" share a key.
+func EmailKey(email string, providerRules bool) string {
+	email = NormalizeEmail(email)
+	if !providerRules {
+		return email
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+	provider, ok := emailProviders[domain]
+	if !ok {
+		return email
+	}
+	if provider.ignorePlus {
+		local, _, _ = strings.Cut(local, "+")
+	}
+	if provider.ignoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + provider.domain
+}
+
+// fills email_key for users saved before it existed or before the provider
+// rules changed. It runs inside the migrations, before the keys are made
+// unique and on every start after that, and fails if two accounts would share
+// a key or a username instead of leaving one of them with a stale key
+func syncEmailKeys(ctx context.Context, m migrationConn, providerRules bool) error {
+	rows, err := m.conn.QueryContext(ctx, `SELECT id, email, name, COALESCE(email_key, '') FROM users;`)
+	if err != nil {
+		return err
+	}
+
+	outdated := make(map[int]string)
+	emails := make(map[string]int)
+	names := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var email, name, key string
+		if err := rows.Scan(&id, &email, &name, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		newKey := EmailKey(email, providerRules)
+		if other, ok := emails[newKey]; ok {
+			rows.Close()
+			return fmt.Errorf("users %d and %d have the same email %s, change one of them before migrating", other, id, newKey)
+		}
+		emails[newKey] = id
+		lowerName := strings.ToLower(name)
+		if other, ok := names[lowerName]; ok {
+			rows.Close()
+			return fmt.Errorf("users %d and %d have the same username %s, change one of them before migrating", other, id, lowerName)
+		}
+		names[lowerName] = id
+		if newKey != key {
+			outdated[id] = newKey
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// cleared first so a key can move to another user without breaking the
+	// unique index halfway
+	for id := range outdated {
+		if _, err := m.exec(ctx, `UPDATE users SET email_key = NULL WHERE id = ?;`, id); err != nil {
+			return err
+		}
+	}
+	for id, key := range outdated {
+		if _, err := m.exec(ctx, `UPDATE users SET email_key = ? WHERE id = ?;`, key, id); err != nil {
+			return fmt.Errorf("updating the email key of user %d: %w", id, err)
+		}
+	}
+	if len(outdated) > 0 {
+		log.Printf("Updated the email keys of %d users", len(outdated))
+	}
+	return nil
+}
+
+// SetEmailProviderRules turns the provider rules of EmailKey on or off for the
+// emails of this store, call it before Migrate so the saved keys follow it
+func (s *sqlStore) SetEmailProviderRules(enabled bool) {
+	s.emailProviderRules = enabled
+}
+
+// EmailKey returns the key the store compares email by
+func (s *sqlStore) EmailKey(email string) string {
+	return EmailKey(email, s.emailProviderRules)
+}
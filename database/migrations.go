@@ -0,0 +1,251 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations/<dialect>/NNNN_name.up.sql and NNNN_name.down.sql, numbered from
+// 1 without gaps, one for each feature so they can be reverted on their own.
+// A released migration is never edited, changes go in a new one
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// any number works as long as it is the same for every instance
+const migrationLockID = 7316453
+
+// the migration that makes the email keys unique, from it on the keys are
+// synced with syncEmailKeys whenever the migrations run
+const emailKeysMigration = "0016_unique_logins"
+
+// Migrator changes the schema of a store, Tokenize's Initialize runs Migrate
+// unless SKIP_MIGRATIONS=True
+type Migrator interface {
+	// brings the schema to the latest version of this build and updates the
+	// email keys (see EmailKey), it fails if two accounts share one
+	Migrate() error
+	// runs the up or down migrations until the schema is at version, at 0
+	// only the baseline tables (users and permissions) are left
+	MigrateTo(version int) error
+	// the version the schema is at, 0 before the first migration, and the one
+	// Migrate goes to
+	SchemaVersion() (current int, latest int, err error)
+}
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+func loadMigrations(d dialect) ([]migration, error) {
+	dir := path.Join("migrations", d.String())
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		base, direction, _ := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		number, _, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if err != nil || !strings.HasSuffix(file, ".sql") || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration file %s is not named NNNN_name.up.sql or NNNN_name.down.sql", file)
+		}
+		content, err := fs.ReadFile(migrationFiles, path.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: base}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]migration, len(byVersion))
+	for version, m := range byVersion {
+		if version < 1 || version > len(migrations) || m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %s is out of order or misses its up or down file", m.name)
+		}
+		migrations[version-1] = *m
+	}
+	return migrations, nil
+}
+
+func (s *sqlStore) Migrate() error {
+	migrations, err := loadMigrations(s.db.dialect)
+	if err != nil {
+		return err
+	}
+	return s.migrate(migrations, len(migrations))
+}
+
+func (s *sqlStore) MigrateTo(version int) error {
+	migrations, err := loadMigrations(s.db.dialect)
+	if err != nil {
+		return err
+	}
+	if version < 0 || version > len(migrations) {
+		return fmt.Errorf("there is no schema version %d, the latest is %d", version, len(migrations))
+	}
+	return s.migrate(migrations, version)
+}
+
+func (s *sqlStore) SchemaVersion() (int, int, error) {
+	migrations, err := loadMigrations(s.db.dialect)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version';`
+	if s.db.dialect == postgresDialect {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_version';`
+	}
+	var tables int
+	if err := s.db.QueryRow(query).Scan(&tables); err != nil {
+		return 0, 0, err
+	}
+	if tables == 0 {
+		return 0, len(migrations), nil
+	}
+
+	var current int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&current)
+	return current, len(migrations), err
+}
+
+// the whole run is one transaction that holds a lock, an instance starting at
+// the same time waits for it and then finds the migrations applied
+func (s *sqlStore) migrate(migrations []migration, target int) (err error) {
+	ctx := context.Background()
+	c, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	m := migrationConn{conn: c, dialect: s.db.dialect}
+
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			c.ExecContext(ctx, `ROLLBACK;`)
+			return
+		}
+		_, err = c.ExecContext(ctx, `COMMIT;`)
+	}()
+
+	_, err = m.exec(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		applied BIGINT NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	var current int
+	if err := c.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("the database schema is at version %d, this build only knows up to %d", current, len(migrations))
+	}
+
+	for ; current < target; current++ {
+		next := migrations[current]
+		if next.name == emailKeysMigration {
+			if err := syncEmailKeys(ctx, m, s.emailProviderRules); err != nil {
+				return fmt.Errorf("migration %s: %w", next.name, err)
+			}
+		}
+		if _, err := m.exec(ctx, next.up); err != nil {
+			return fmt.Errorf("migration %s: %w", next.name, err)
+		}
+		if _, err := m.exec(ctx, `INSERT INTO schema_version (version, applied) VALUES (?, ?);`, next.version, time.Now().Unix()); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %s", next.name)
+	}
+
+	for ; current > target; current-- {
+		previous := migrations[current-1]
+		if _, err := m.exec(ctx, previous.down); err != nil {
+			return fmt.Errorf("reverting migration %s: %w", previous.name, err)
+		}
+		if _, err := m.exec(ctx, `DELETE FROM schema_version WHERE version = ?;`, previous.version); err != nil {
+			return err
+		}
+		log.Printf("Reverted migration %s", previous.name)
+	}
+
+	// the provider rules (EMAIL_PROVIDER_RULES) can change between starts
+	for _, applied := range migrations[:current] {
+		if applied.name == emailKeysMigration {
+			return syncEmailKeys(ctx, m, s.emailProviderRules)
+		}
+	}
+	return nil
+}
+
+// the connection that runs the migrations, the transaction is begun and ended
+// by hand because sqlite needs BEGIN IMMEDIATE to lock right away
+type migrationConn struct {
+	conn    *sql.Conn
+	dialect dialect
+}
+
+// files with only comments, like the down of the baseline, run nothing
+func (m migrationConn) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if !hasStatements(query) {
+		return driver.ResultNoRows, nil
+	}
+	return m.conn.ExecContext(ctx, m.dialect.rebind(query), args...)
+}
+
+func hasStatements(query string) bool {
+	for _, line := range strings.Split(query, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlite takes the write lock, other connections wait for it up to their busy
+// timeout. Postgres takes an advisory lock released when the transaction ends
+func (m migrationConn) lock(ctx context.Context) error {
+	if m.dialect == postgresDialect {
+		if _, err := m.exec(ctx, `BEGIN;`); err != nil {
+			return err
+		}
+		if _, err := m.exec(ctx, `SELECT pg_advisory_xact_lock(?);`, migrationLockID); err != nil {
+			m.exec(ctx, `ROLLBACK;`)
+			return err
+		}
+		return nil
+	}
+	_, err := m.exec(ctx, `BEGIN IMMEDIATE;`)
+	return err
+}
@@ -0,0 +1,2 @@
+-- the baseline tables keep the users of databases older than the migrations,
+-- going back to version 0 leaves them as they were
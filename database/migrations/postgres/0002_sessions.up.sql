@@ -0,0 +1,10 @@
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created BIGINT NOT NULL,
+    last_seen BIGINT NOT NULL,
+    expires BIGINT NOT NULL,
+    remember BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE refresh_tokens (
+    id TEXT PRIMARY KEY,
+    family_id TEXT NOT NULL,
+    user_id BIGINT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created BIGINT NOT NULL,
+    expires BIGINT NOT NULL,
+    used BIGINT DEFAULT 0,
+    revoked BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,20 @@
+CREATE TABLE api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    created BIGINT NOT NULL,
+    expires BIGINT DEFAULT 0,
+    last_used BIGINT DEFAULT 0,
+    revoked BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE api_key_permissions (
+    id BIGSERIAL PRIMARY KEY,
+    api_key_id BIGINT NOT NULL,
+    permission_id BIGINT NOT NULL,
+    FOREIGN KEY(api_key_id) REFERENCES api_keys(id),
+    FOREIGN KEY(permission_id) REFERENCES permissions(id)
+);
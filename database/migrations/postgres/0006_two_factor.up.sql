@@ -0,0 +1,15 @@
+CREATE TABLE user_totp (
+    user_id BIGINT PRIMARY KEY,
+    secret TEXT NOT NULL,
+    enabled BOOLEAN DEFAULT FALSE,
+    last_step BIGINT DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    code_hash TEXT NOT NULL,
+    used BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE passkeys (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    credential_id TEXT NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT DEFAULT 0,
+    created BIGINT NOT NULL,
+    last_used BIGINT DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE password_resets (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created BIGINT NOT NULL,
+    expires BIGINT NOT NULL,
+    used BIGINT DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE login_links (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    browser_hash TEXT NOT NULL,
+    created BIGINT NOT NULL,
+    expires BIGINT NOT NULL,
+    used BIGINT DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
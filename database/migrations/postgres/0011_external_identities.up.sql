@@ -0,0 +1,10 @@
+CREATE TABLE external_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT,
+    created BIGINT NOT NULL,
+    UNIQUE(provider, subject),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
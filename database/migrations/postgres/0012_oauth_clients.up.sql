@@ -0,0 +1,17 @@
+CREATE TABLE oauth_clients (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    redirect_uris TEXT NOT NULL,
+    created BIGINT NOT NULL
+);
+
+CREATE TABLE oauth_consents (
+    user_id BIGINT NOT NULL,
+    client_id TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    created BIGINT NOT NULL,
+    PRIMARY KEY(user_id, client_id),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(client_id) REFERENCES oauth_clients(id)
+);
@@ -0,0 +1,3 @@
+DROP TABLE user_devices;
+ALTER TABLE sessions DROP COLUMN user_agent;
+ALTER TABLE sessions DROP COLUMN ip;
@@ -0,0 +1,3 @@
+DROP INDEX users_name_lower;
+DROP INDEX users_email_lower;
+DROP INDEX users_email_key;
@@ -0,0 +1,5 @@
+-- the email keys are filled before this runs (see syncEmailKeys), it fails
+-- if two accounts still share an email or a username
+CREATE UNIQUE INDEX users_email_key ON users(email_key);
+CREATE UNIQUE INDEX users_email_lower ON users(lower(email));
+CREATE UNIQUE INDEX users_name_lower ON users(lower(name));
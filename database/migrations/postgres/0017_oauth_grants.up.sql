@@ -0,0 +1,30 @@
+-- authorization codes and the requests waiting for consent, saved in the
+-- database so every instance behind a load balancer sees them
+CREATE TABLE oauth_codes (
+    code_hash TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    client_id TEXT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_challenge TEXT NOT NULL,
+    auth_time BIGINT NOT NULL,
+    expires BIGINT NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(client_id) REFERENCES oauth_clients(id)
+);
+
+CREATE TABLE oauth_consent_requests (
+    id_hash TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    client_id TEXT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    state TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_challenge TEXT NOT NULL,
+    auth_time BIGINT NOT NULL,
+    expires BIGINT NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(client_id) REFERENCES oauth_clients(id)
+);
@@ -0,0 +1 @@
+ALTER TABLE refresh_tokens ADD COLUMN session_id TEXT DEFAULT '';
@@ -0,0 +1,10 @@
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created INTEGER NOT NULL,
+    last_seen INTEGER NOT NULL,
+    expires INTEGER NOT NULL,
+    remember BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE signing_keys (
+    id TEXT PRIMARY KEY,
+    private_key TEXT NOT NULL,
+    created INTEGER NOT NULL,
+    retired INTEGER DEFAULT 0
+);
@@ -0,0 +1,20 @@
+CREATE TABLE api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    created INTEGER NOT NULL,
+    expires INTEGER DEFAULT 0,
+    last_used INTEGER DEFAULT 0,
+    revoked BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE api_key_permissions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    api_key_id INTEGER NOT NULL,
+    permission_id INTEGER NOT NULL,
+    FOREIGN KEY(api_key_id) REFERENCES api_keys(id),
+    FOREIGN KEY(permission_id) REFERENCES permissions(id)
+);
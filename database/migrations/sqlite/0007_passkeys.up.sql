@@ -0,0 +1,11 @@
+CREATE TABLE passkeys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    credential_id TEXT NOT NULL UNIQUE,
+    public_key BLOB NOT NULL,
+    sign_count INTEGER DEFAULT 0,
+    created INTEGER NOT NULL,
+    last_used INTEGER DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
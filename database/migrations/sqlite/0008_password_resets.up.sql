@@ -0,0 +1,9 @@
+CREATE TABLE password_resets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created INTEGER NOT NULL,
+    expires INTEGER NOT NULL,
+    used INTEGER DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE login_links (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    browser_hash TEXT NOT NULL,
+    created INTEGER NOT NULL,
+    expires INTEGER NOT NULL,
+    used INTEGER DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
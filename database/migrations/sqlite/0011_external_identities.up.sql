@@ -0,0 +1,10 @@
+CREATE TABLE external_identities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT,
+    created INTEGER NOT NULL,
+    UNIQUE(provider, subject),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
@@ -0,0 +1 @@
+ALTER TABLE sessions ADD COLUMN impersonator_id INTEGER DEFAULT 0;
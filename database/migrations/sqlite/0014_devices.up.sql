@@ -0,0 +1,14 @@
+ALTER TABLE sessions ADD COLUMN ip TEXT DEFAULT '';
+ALTER TABLE sessions ADD COLUMN user_agent TEXT DEFAULT '';
+
+-- the devices a user logged in from, used to email the user about logins
+-- from new ones
+CREATE TABLE user_devices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    device_hash TEXT NOT NULL,
+    first_seen INTEGER NOT NULL,
+    last_seen INTEGER NOT NULL,
+    UNIQUE(user_id, device_hash),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
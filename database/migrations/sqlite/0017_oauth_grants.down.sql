@@ -0,0 +1,2 @@
+DROP TABLE oauth_consent_requests;
+DROP TABLE oauth_codes;
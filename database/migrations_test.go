@@ -0,0 +1,236 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMigrationsMatchBetweenDialects(t *testing.T) {
+	sqlite, err := loadMigrations(sqliteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := loadMigrations(postgresDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("sqlite has %d migrations and postgres %d", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].name != postgres[i].name {
+			t.Fatalf("migration %d is %s for sqlite and %s for postgres", i+1, sqlite[i].name, postgres[i].name)
+		}
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		current, latest, err := s.SchemaVersion()
+		if err != nil || current != latest || latest == 0 {
+			t.Fatalf("expected the latest version, got %d of %d: %v", current, latest, err)
+		}
+		// running it again changes nothing
+		if err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+
+		userID := addTestUser(t, s, "kept@example.com", "kept")
+
+		// every migration is reverted and applied again on its own
+		for version := latest - 1; version >= 0; version-- {
+			if err := s.MigrateTo(version); err != nil {
+				t.Fatalf("reverting to version %d: %v", version, err)
+			}
+			if current, _, _ := s.SchemaVersion(); current != version {
+				t.Fatalf("expected version %d, got %d", version, current)
+			}
+		}
+		if _, err := s.GetSessionByTokenHash("h"); err == nil || errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("the sessions table is still there at version 0: %v", err)
+		}
+		// the baseline keeps the users
+		db := s.(interface{ DB() *sql.DB }).DB()
+		var kept int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE email = 'kept@example.com';`).Scan(&kept); err != nil || kept != 1 {
+			t.Fatalf("the users were dropped at version 0: %v", err)
+		}
+		for version := 1; version <= latest; version++ {
+			if err := s.MigrateTo(version); err != nil {
+				t.Fatalf("migrating to version %d: %v", version, err)
+			}
+		}
+
+		if err := s.MigrateTo(latest + 1); err == nil {
+			t.Fatal("migrated to a version that does not exist")
+		}
+
+		if err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		if usr, err := s.GetUser(userID); err != nil || usr.Email != "kept@example.com" {
+			t.Fatalf("the user is gone after migrating again %+v: %v", usr, err)
+		}
+		addTestUser(t, s, "again@example.com", "again")
+	})
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := OpenSQLite(path)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer s.Close()
+			errs[i] = s.Migrate()
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var applied, latest int
+	if err := s.DB().QueryRow(`SELECT COUNT(*) FROM schema_version;`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if _, latest, err = s.SchemaVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if applied != latest {
+		t.Fatalf("expected every migration to run once, %d rows for %d migrations", applied, latest)
+	}
+}
+
+// databases created before migrations existed have the baseline tables,
+// without the columns added since
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stripe_id TEXT,
+		email TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		password TEXT,
+		is_prohibited BOOLEAN DEFAULT 0,
+		is_active BOOLEAN DEFAULT 0
+	);
+	INSERT INTO users (stripe_id, email, name, password) VALUES ('', 'Old@Example.com', 'old', '');
+	CREATE TABLE IF NOT EXISTS permissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		permission TEXT NOT NULL,
+		name TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS user_permissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		permission_id INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(permission_id) REFERENCES permissions(id)
+	);`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	usr, err := s.GetUserByEmail("old@example.com")
+	if err != nil || usr.Name != "old" {
+		t.Fatalf("the old user was not found by its email key %+v: %v", usr, err)
+	}
+	if err := s.AddSession(Session{ID: "s", UserID: usr.ID, TokenHash: "h", Created: 1, LastSeen: 1, Expires: 2, IP: "203.0.113.7"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateRefusesSharedEmailKeys(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	before := emailKeysVersion(t)
+	if err := s.MigrateTo(before - 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB().Exec(`
+	INSERT INTO users (stripe_id, email, name, password) VALUES ('', 'john.smith@gmail.com', 'john', '');
+	INSERT INTO users (stripe_id, email, name, password) VALUES ('', 'johnsmith@gmail.com', 'smith', '');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetEmailProviderRules(true)
+	if err := s.Migrate(); err == nil || !strings.Contains(err.Error(), "same email") {
+		t.Fatalf("expected the shared email key to stop the migration, got %v", err)
+	}
+	if current, _, _ := s.SchemaVersion(); current != before-1 {
+		t.Fatalf("the failed migration was kept, the schema is at version %d", current)
+	}
+
+	// without the provider rules the emails are different accounts
+	s.SetEmailProviderRules(false)
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateUpdatesEmailKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestUser(t, s, "John.Smith+shop@googlemail.com", "john")
+
+		s.SetEmailProviderRules(true)
+		if err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		if usr, err := s.GetUserByEmail("johnsmith@gmail.com"); err != nil || usr.Name != "john" {
+			t.Fatalf("the email key was not updated for the provider rules %+v: %v", usr, err)
+		}
+	})
+}
+
+func emailKeysVersion(t *testing.T) int {
+	migrations, err := loadMigrations(sqliteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.name == emailKeysMigration {
+			return m.version
+		}
+	}
+	t.Fatalf("there is no %s migration", emailKeysMigration)
+	return 0
+}
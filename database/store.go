@@ -0,0 +1,287 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// UserStore keeps the accounts and their passwords
+type UserStore interface {
+	AddUser(stripeID, email, name, password string) (int64, error)
+	CheckIfCanUserBeAdded(email, name string) (bool, error)
+	CheckIfUserIDExists(id int) (bool, error)
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUserByName(name string) (User, error)
+	GetUserByLogin(identifier string) (User, error)
+	GetAllUsers() ([]User, error)
+	CheckUserPassword(id int, password string) bool
+	// the form emails are compared by, see EmailKey
+	EmailKey(email string) string
+	SetEmailProviderRules(enabled bool)
+	// the same as the ones above but their queries stop when ctx is done
+	AddUserContext(ctx context.Context, stripeID, email, name, password string) (int64, error)
+	GetUserContext(ctx context.Context, id int) (User, error)
+	GetUserByEmailContext(ctx context.Context, email string) (User, error)
+	GetUserByNameContext(ctx context.Context, name string) (User, error)
+	GetUserByLoginContext(ctx context.Context, identifier string) (User, error)
+	CheckUserPasswordContext(ctx context.Context, id int, password string) bool
+	// also invalidates every password reset token of the user
+	SetUserPassword(id int, password string) error
+	SetEmailVerified(id int) error
+	ProhibitUser(id int) error
+	UnprohibitUser(id int) error
+	CheckIfUserIsProhibited(id int) (bool, error)
+	ActivateUser(id int) error
+	DeactivateUser(id int) error
+}
+
+// PermissionStore keeps the permissions and which users have them
+type PermissionStore interface {
+	CreateNewPermission(name, permission string) error
+	DeletePermissionWithID(id int) error
+	CheckPermissionID(id int) bool
+	GetPermissionWithID(id int) (Permission, error)
+	GetPermissionWithName(name string) (Permission, error)
+	GetPermissionWithPermission(permission string) (Permission, error)
+	GetPermissions() ([]Permission, error)
+	AddUserPermission(userID int, permissionID int) error
+	RemoveUserPermission(userID int, permissionID int) error
+	CheckUserPermission(userID int, permissionID int) bool
+	GetUserPermissions(userID int) ([]Permission, error)
+	GetAllUsersPermissions() ([]Permission, error)
+}
+
+// SessionStore keeps the sessions, refresh tokens and known devices of users
+type SessionStore interface {
+	AddSession(session Session) error
+	GetSessionByTokenHash(tokenHash string) (Session, error)
+	GetUserSessions(userID int) ([]Session, error)
+	DeleteSession(userID int, sessionID string) (bool, error)
+	DeleteUserSessions(userID int) error
+	TouchSession(sessionID string, lastSeen int64) error
+	SetSessionClient(sessionID, ip, userAgent string) error
+	DeleteExpiredSessions(now int64, idleBefore int64) error
+
+	AddRefreshToken(token RefreshToken) error
+	GetRefreshTokenByHash(tokenHash string) (RefreshToken, error)
+	MarkRefreshTokenUsed(id string, used int64) (bool, error)
+	RevokeRefreshTokenFamily(familyID string) error
+	GetRefreshTokenFamilySessions(familyID string) ([]string, error)
+	RevokeUserRefreshTokens(userID int) error
+	DeleteExpiredRefreshTokens(now int64) error
+
+	CountUserDevices(userID int) (int, error)
+	AddUserDevice(userID int, deviceHash string, now int64) (bool, error)
+}
+
+// BillingStore links users to their Stripe customers and keeps them active
+// while they pay
+type BillingStore interface {
+	GetUser(id int) (User, error)
+	GetUserByStripeID(stripeID string) (User, error)
+	SetUserStripeID(id int, stripeID string) error
+	GetUserContext(ctx context.Context, id int) (User, error)
+	GetUserByStripeIDContext(ctx context.Context, stripeID string) (User, error)
+	SetUserStripeIDContext(ctx context.Context, id int, stripeID string) error
+	ActivateUser(id int) error
+	DeactivateUser(id int) error
+	DeactivateUserByStripeID(stripeID string) error
+}
+
+// TokenStore keeps the single use tokens sent by email and the keys that sign
+// the login tokens
+type TokenStore interface {
+	AddPasswordReset(reset PasswordReset) error
+	GetPasswordResetByHash(tokenHash string) (PasswordReset, error)
+	MarkPasswordResetUsed(id int, used int64) (bool, error)
+	DeleteExpiredPasswordResets(now int64) error
+
+	AddLoginLink(link LoginLink) error
+	GetLoginLinkByHash(tokenHash string) (LoginLink, error)
+	MarkLoginLinkUsed(id int, used int64) (bool, error)
+	DeleteExpiredLoginLinks(now int64) error
+
+	AddSigningKey(key SigningKey) error
+	GetSigningKeys() ([]SigningKey, error)
+	RetireSigningKeys(keepID string, retired int64) error
+	AddSigningKeyIfNoneSince(key SigningKey, since int64) (bool, error)
+	SetSigningKeyPrivateKey(id, privateKey string) error
+	DeleteSigningKeysRetiredBefore(before int64) error
+}
+
+// CredentialStore keeps the other ways users prove who they are: API keys,
+// passkeys, 2FA and linked external identities
+type CredentialStore interface {
+	AddAPIKey(key APIKey, permissionIDs []int) (int64, error)
+	GetAPIKeyByHash(keyHash string) (APIKey, error)
+	GetAPIKey(id int) (APIKey, error)
+	GetUserAPIKeys(userID int) ([]APIKey, error)
+	GetAPIKeyPermissions(apiKeyID int) ([]Permission, error)
+	RevokeAPIKey(userID int, apiKeyID int) (bool, error)
+	TouchAPIKey(apiKeyID int, lastUsed int64) error
+
+	AddPasskey(passkey Passkey) (int64, error)
+	GetPasskeyByCredentialID(credentialID string) (Passkey, error)
+	GetUserPasskeys(userID int) ([]Passkey, error)
+	UpdatePasskeySignCount(id int, signCount uint32, lastUsed int64) error
+	DeletePasskey(userID int, id int) (bool, error)
+
+	SetTOTPSecret(userID int, secret string) error
+	GetTOTP(userID int) (TOTP, error)
+	EnableTOTP(userID int) error
+	SetTOTPLastStep(userID int, step int64) (bool, error)
+	DeleteTOTP(userID int) error
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	UseRecoveryCode(userID int, codeHash string) (bool, error)
+
+	AddExternalIdentity(identity ExternalIdentity) (int64, error)
+	GetExternalIdentity(provider, subject string) (ExternalIdentity, error)
+	GetUserExternalIdentities(userID int) ([]ExternalIdentity, error)
+	DeleteExternalIdentity(userID int, id int) (bool, error)
+}
+
+// OAuthStore keeps the apps registered with the authorization server and
+// what users allowed them
+type OAuthStore interface {
+	AddOAuthClient(client OAuthClient) error
+	GetOAuthClient(id string) (OAuthClient, error)
+	GetOAuthClients() ([]OAuthClient, error)
+	DeleteOAuthClient(id string) error
+	GetOAuthConsent(userID int, clientID string) (string, error)
+	SetOAuthConsent(userID int, clientID, scope string, created int64) error
+	DeleteOAuthConsent(userID int, clientID string) error
+	AddOAuthCode(code OAuthCode) error
+	TakeOAuthCode(codeHash string) (OAuthCode, error)
+	AddOAuthConsentRequest(req OAuthConsentRequest) error
+	GetOAuthConsentRequest(idHash string, userID int) (OAuthConsentRequest, error)
+	TakeOAuthConsentRequest(idHash string, userID int) (OAuthConsentRequest, error)
+	// removes the codes and consent requests that expired at the unix time now
+	DeleteExpiredOAuthGrants(now int64) error
+}
+
+// Store is everything Tokenize saves, SQLiteStore is the default one and
+// PostgresStore the one for servers
+type Store interface {
+	UserStore
+	PermissionStore
+	SessionStore
+	BillingStore
+	TokenStore
+	CredentialStore
+	OAuthStore
+
+	Migrator
+	Close() error
+}
+
+// the Store methods are shared by every SQL database, conn adapts the queries
+type sqlStore struct {
+	db *conn
+	// compare emails with the rules of their mail provider, see EmailKey
+	emailProviderRules bool
+}
+
+// SQLiteStore is the Store kept in a sqlite database file
+type SQLiteStore struct {
+	sqlStore
+}
+
+// PostgresStore is the Store kept in a PostgreSQL database
+type PostgresStore struct {
+	sqlStore
+}
+
+var (
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*PostgresStore)(nil)
+)
+
+// Open opens the store of dsn: PostgresStore for "postgres://" and
+// "postgresql://" URLs or "host=... dbname=..." strings, SQLiteStore for
+// anything else, which is the path of the sqlite file. It uses the
+// DefaultConfig, see OpenConfig to change it
+func Open(dsn string) (Store, error) {
+	config := DefaultConfig()
+	config.DSN = dsn
+	return OpenConfig(config)
+}
+
+// OpenConfig opens the store of config.DSN like Open, with the pool limits
+// and the email rules of config
+func OpenConfig(config Config) (Store, error) {
+	if isPostgresDSN(config.DSN) {
+		return openPostgres(config.DSN, config)
+	}
+	return openSQLite(config.DSN, config)
+}
+
+func isPostgresDSN(dsn string) bool {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return true
+	}
+	for _, field := range strings.Fields(dsn) {
+		key, _, ok := strings.Cut(field, "=")
+		if ok && (key == "host" || key == "dbname") {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenSQLite opens (or creates) the sqlite database at path, with WAL, foreign
+// keys and the busy timeout of the DefaultConfig turned on
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	return openSQLite(path, DefaultConfig())
+}
+
+func openSQLite(path string, config Config) (*SQLiteStore, error) {
+	db, err := openConn("sqlite3", sqliteDSN(path, config.BusyTimeout), sqliteDialect, config)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{sqlStore{db: db, emailProviderRules: config.EmailProviderRules}}, nil
+}
+
+// OpenPostgres connects to the PostgreSQL database of dsn, in any format
+// lib/pq accepts
+func OpenPostgres(dsn string) (*PostgresStore, error) {
+	return openPostgres(dsn, DefaultConfig())
+}
+
+func openPostgres(dsn string, config Config) (*PostgresStore, error) {
+	db, err := openConn("postgres", dsn, postgresDialect, config)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{sqlStore{db: db, emailProviderRules: config.EmailProviderRules}}, nil
+}
+
+func openConn(driver, dsn string, d dialect, config Config) (*conn, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &conn{DB: db, dialect: d}, nil
+}
+
+// DB returns the connection, for apps that keep their own tables next to
+// Tokenize's
+func (s *sqlStore) DB() *sql.DB {
+	return s.db.DB
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
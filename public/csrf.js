@@ -0,0 +1,12 @@
+// Gets the CSRF token every POST to Tokenize has to send in the
+// X-CSRF-Token header (or in a csrf_token field for HTML forms).
+let csrfTokenPromise = null;
+
+function getCsrfToken() {
+  if (!csrfTokenPromise) {
+    csrfTokenPromise = fetch('/csrf-token')
+      .then((response) => response.json())
+      .then((data) => data.csrf_token);
+  }
+  return csrfTokenPromise;
+}